@@ -0,0 +1,429 @@
+// Command mellow inspects and edits mellowdb files.
+//
+//	mellow [flags] <file> <command> [arguments]
+//
+// Commands:
+//
+//	get <key>                         print the value of a key
+//	put [-ttl d] <key> <value>        store a value
+//	del <key>                         delete a key
+//	scan [-prefix p] [-start s] [-end e] [-limit n]
+//	                                  print the items in key order
+//	stats                             print file and tree statistics
+//	pages                             list every page with its type and fill
+//	dump [-dot] [-depth n] [-key-length n]
+//	                                  print the tree of the collection
+//	export [-prefix p] [collection ...]
+//	                                  write the items as JSON Lines
+//	import [file]                     load JSON Lines from file or stdin
+//
+// Commands that only read open the file read-only. They never create the file
+// or a collection, and leave the file unchanged.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	stdio "io"
+	"os"
+	"time"
+
+	"github.com/rettenwander/mellowdb/db"
+)
+
+var ErrUsage = errors.New("Invalid arguments")
+
+type options struct {
+	pageSize   uint
+	readOnly   bool
+	format     string
+	collection string
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "mellow:", err)
+
+		if errors.Is(err, ErrUsage) {
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdin stdio.Reader, stdout, stderr stdio.Writer) error {
+	opts := options{}
+
+	flags := flag.NewFlagSet("mellow", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.UintVar(&opts.pageSize, "page-size", 0, "page size of a new DB file, 0 for the system page size")
+	flags.BoolVar(&opts.readOnly, "read-only", false, "open the file read-only with a shared lock")
+	flags.StringVar(&opts.format, "format", "text", "output format, text or json")
+	flags.StringVar(&opts.collection, "collection", db.DefaultCollection, "collection to work on")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: mellow [flags] <file> <command> [arguments]")
+		fmt.Fprintln(stderr, "commands: get, put, del, scan, stats, pages, dump, export, import")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", ErrUsage, err)
+	}
+
+	if opts.format != "text" && opts.format != "json" {
+		return fmt.Errorf("%w: unknown format %q", ErrUsage, opts.format)
+	}
+
+	if flags.NArg() < 2 {
+		flags.Usage()
+		return ErrUsage
+	}
+
+	command, ok := commands[flags.Arg(1)]
+	if !ok {
+		return fmt.Errorf("%w: unknown command %q", ErrUsage, flags.Arg(1))
+	}
+
+	dbEngine, err := db.NewDBWithOptions(flags.Arg(0), db.Options{
+		PageSize: int(opts.pageSize),
+		ReadOnly: opts.readOnly || readCommands[flags.Arg(1)],
+	})
+	if err != nil {
+		return err
+	}
+
+	out := &output{r: stdin, w: stdout, json: opts.format == "json"}
+	err = command(dbEngine, opts, flags.Args()[2:], out)
+
+	if closeErr := dbEngine.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+type command func(dbEngine *db.DB, opts options, args []string, out *output) error
+
+var commands = map[string]command{
+	"get":    get,
+	"put":    put,
+	"del":    del,
+	"scan":   scan,
+	"stats":  stats,
+	"pages":  pages,
+	"dump":   dump,
+	"export": export,
+	"import": importItems,
+}
+
+// Commands that open the file read-only.
+var readCommands = map[string]bool{
+	"get":    true,
+	"scan":   true,
+	"stats":  true,
+	"pages":  true,
+	"dump":   true,
+	"export": true,
+}
+
+type output struct {
+	// Input for commands that read data.
+	r    stdio.Reader
+	w    stdio.Writer
+	json bool
+}
+
+// Writes v as one JSON value or, in text mode, the text returned by text.
+func (o *output) write(v any, text func() string) error {
+	if o.json {
+		return json.NewEncoder(o.w).Encode(v)
+	}
+
+	_, err := fmt.Fprint(o.w, text())
+	return err
+}
+
+// Keys and values are base64 encoded by encoding/json, like in an export.
+type itemJSON struct {
+	Key       []byte
+	Value     []byte
+	ExpiresAt *time.Time `json:",omitempty"`
+}
+
+func newItemJSON(i *db.Item) itemJSON {
+	item := itemJSON{Key: i.Key(), Value: i.Value()}
+	if expiresAt, ok := i.ExpiresAt(); ok {
+		item.ExpiresAt = &expiresAt
+	}
+
+	return item
+}
+
+func get(dbEngine *db.DB, opts options, args []string, out *output) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%w: get <key>", ErrUsage)
+	}
+
+	tree, err := dbEngine.FindCollection(opts.collection)
+	if err != nil {
+		return err
+	}
+
+	item, err := tree.Find([]byte(args[0]))
+	if err != nil {
+		return err
+	}
+
+	return out.write(newItemJSON(item), func() string {
+		return string(item.Value()) + "\n"
+	})
+}
+
+func put(dbEngine *db.DB, opts options, args []string, out *output) error {
+	flags := flag.NewFlagSet("put", flag.ContinueOnError)
+	flags.SetOutput(stdio.Discard)
+	ttl := flags.Duration("ttl", 0, "expire the item after this duration")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		return fmt.Errorf("%w: put [-ttl d] <key> <value>", ErrUsage)
+	}
+
+	key, value := []byte(flags.Arg(0)), []byte(flags.Arg(1))
+
+	var item *db.Item
+	var err error
+	if *ttl > 0 {
+		item, err = db.NewItemWithExpiry(key, value, time.Now().Add(*ttl))
+	} else {
+		item, err = db.NewItem(key, value)
+	}
+	if err != nil {
+		return err
+	}
+
+	tree, err := dbEngine.Collection(opts.collection)
+	if err != nil {
+		return err
+	}
+
+	return tree.Insert(item)
+}
+
+func del(dbEngine *db.DB, opts options, args []string, out *output) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%w: del <key>", ErrUsage)
+	}
+
+	// A missing collection holds no key to delete.
+	tree, err := dbEngine.FindCollection(opts.collection)
+	if errors.Is(err, db.ErrCollectionNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return tree.Delete([]byte(args[0]))
+}
+
+func scan(dbEngine *db.DB, opts options, args []string, out *output) error {
+	flags := flag.NewFlagSet("scan", flag.ContinueOnError)
+	flags.SetOutput(stdio.Discard)
+	prefix := flags.String("prefix", "", "only items whose key starts with prefix")
+	start := flags.String("start", "", "first key of the range")
+	end := flags.String("end", "", "end of the range, exclusive")
+	limit := flags.Int("limit", 0, "maximum number of items, zero for all")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return fmt.Errorf("%w: scan [-prefix p] [-start s] [-end e] [-limit n]", ErrUsage)
+	}
+
+	if *prefix != "" && (*start != "" || *end != "") {
+		return fmt.Errorf("%w: -prefix can't be combined with -start or -end", ErrUsage)
+	}
+
+	tree, err := dbEngine.FindCollection(opts.collection)
+	if err != nil {
+		return err
+	}
+
+	var writeErr error
+	n := 0
+	fn := func(i *db.Item) bool {
+		item := newItemJSON(i)
+		writeErr = out.write(item, func() string {
+			return fmt.Sprintf("%s\t%s\n", item.Key, item.Value)
+		})
+
+		n++
+		return writeErr == nil && (*limit == 0 || n < *limit)
+	}
+
+	if *prefix != "" {
+		err = tree.ScanPrefix([]byte(*prefix), fn)
+	} else {
+		var startKey, endKey []byte
+		if *start != "" {
+			startKey = []byte(*start)
+		}
+		if *end != "" {
+			endKey = []byte(*end)
+		}
+
+		err = tree.Scan(startKey, endKey, fn)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return writeErr
+}
+
+type statsJSON struct {
+	DB          db.Stats
+	Collections map[string]db.TreeStats
+}
+
+func stats(dbEngine *db.DB, opts options, args []string, out *output) error {
+	if len(args) != 0 {
+		return fmt.Errorf("%w: stats", ErrUsage)
+	}
+
+	names, err := dbEngine.Collections()
+	if err != nil {
+		return err
+	}
+
+	result := statsJSON{Collections: map[string]db.TreeStats{}}
+	for _, name := range names {
+		tree, err := dbEngine.FindCollection(name)
+		if err != nil {
+			return err
+		}
+
+		if result.Collections[name], err = tree.Stats(); err != nil {
+			return err
+		}
+	}
+
+	// Read last, so the stats include the reads of the tree stats.
+	if result.DB, err = dbEngine.Stats(); err != nil {
+		return err
+	}
+
+	return out.write(result, func() string {
+		s := result.DB
+		text := fmt.Sprintf("file size\t%d\nfree pages\t%d\npage reads\t%d\npage writes\t%d\nallocations\t%d\nsplits\t%d\ncache hit rate\t%.2f\n",
+			s.FileSize, s.FreePages, s.PageReads, s.PageWrites, s.Allocations, s.Splits, s.CacheHitRate())
+
+		for _, name := range names {
+			t := result.Collections[name]
+			text += fmt.Sprintf("\ncollection %s\nitems\t%d\nheight\t%d\nnodes\t%d\nnodes per level\t%v\nkey bytes\t%d\nvalue bytes\t%d\naverage fill\t%.2f\n",
+				name, t.Items, t.Height, t.Nodes, t.NodesPerLevel, t.KeyBytes, t.ValueBytes, t.AverageFill)
+		}
+
+		return text
+	})
+}
+
+func pages(dbEngine *db.DB, opts options, args []string, out *output) error {
+	if len(args) != 0 {
+		return fmt.Errorf("%w: pages", ErrUsage)
+	}
+
+	infos, err := dbEngine.Pages()
+	if err != nil {
+		return err
+	}
+
+	return out.write(infos, func() string {
+		text := ""
+		for _, info := range infos {
+			text += fmt.Sprintf("%d\t%s", info.ID, info.Type)
+
+			if info.Type == db.PageLeaf || info.Type == db.PageInternal {
+				collection := info.Collection
+				if collection == "" {
+					collection = "(catalog)"
+				}
+
+				text += fmt.Sprintf("\t%s\tdepth=%d\titems=%d\tfill=%.2f", collection, info.Depth, info.Items, info.Fill)
+			}
+
+			text += "\n"
+		}
+
+		return text
+	})
+}
+
+func dump(dbEngine *db.DB, opts options, args []string, out *output) error {
+	flags := flag.NewFlagSet("dump", flag.ContinueOnError)
+	flags.SetOutput(stdio.Discard)
+	dot := flags.Bool("dot", false, "write a Graphviz digraph")
+	depth := flags.Int("depth", 0, "number of levels to show, zero for all")
+	keyLength := flags.Int("key-length", 0, "cut off longer keys, zero for whole keys")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return fmt.Errorf("%w: dump [-dot] [-depth n] [-key-length n]", ErrUsage)
+	}
+
+	visualizeOptions := db.VisualizeOptions{MaxDepth: *depth, MaxKeyLength: *keyLength}
+	if *dot {
+		visualizeOptions.Format = db.VisualizeDOT
+	} else if out.json {
+		visualizeOptions.Format = db.VisualizeJSON
+	}
+
+	tree, err := dbEngine.FindCollection(opts.collection)
+	if err != nil {
+		return err
+	}
+
+	return tree.Visualize(out.w, visualizeOptions)
+}
+
+func export(dbEngine *db.DB, opts options, args []string, out *output) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.SetOutput(stdio.Discard)
+	prefix := flags.String("prefix", "", "only items whose key starts with prefix")
+
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w: export [-prefix p] [collection ...]", ErrUsage)
+	}
+
+	exportOptions := db.ExportOptions{Prefix: []byte(*prefix)}
+	if flags.NArg() > 0 {
+		exportOptions.Collections = flags.Args()
+	}
+
+	return dbEngine.Export(out.w, exportOptions)
+}
+
+func importItems(dbEngine *db.DB, opts options, args []string, out *output) error {
+	if len(args) > 1 {
+		return fmt.Errorf("%w: import [file]", ErrUsage)
+	}
+
+	r := out.r
+	if len(args) == 1 {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		r = f
+	}
+
+	count, err := dbEngine.Import(r)
+	if err != nil {
+		return err
+	}
+
+	return out.write(map[string]int{"Items": count}, func() string {
+		return fmt.Sprintf("imported %d items\n", count)
+	})
+}
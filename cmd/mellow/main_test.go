@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/db"
+)
+
+func runCommand(t *testing.T, args ...string) (string, error) {
+	return runCommandWithInput(t, "", args...)
+}
+
+func runCommandWithInput(t *testing.T, input string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	err := run(args, strings.NewReader(input), &stdout, &stderr)
+	return stdout.String(), err
+}
+
+func TestCommands(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	for i := range 300 {
+		key := "user:" + strconv.Itoa(1000+i)
+		if _, err := runCommand(t, file, "put", key, "value"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, err := runCommand(t, file, "get", "user:1005")
+	if err != nil || out != "value5\n" {
+		t.Fatalf("Expected value5, got %q, %v", out, err)
+	}
+
+	out, err = runCommand(t, "-format", "json", file, "get", "user:1005")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var item itemJSON
+	if err := json.Unmarshal([]byte(out), &item); err != nil || string(item.Value) != "value5" {
+		t.Fatalf("Expected value5 as JSON, got %q, %v", out, err)
+	}
+
+	if _, err := runCommand(t, file, "del", "user:1005"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := runCommand(t, file, "get", "user:1005"); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+
+	out, err = runCommand(t, file, "scan", "-prefix", "user:100")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Count(out, "\n"); lines != 9 {
+		t.Fatalf("Expected 9 items with prefix user:100, got %d:\n%s", lines, out)
+	}
+
+	out, err = runCommand(t, file, "scan", "-start", "user:1010", "-end", "user:1020", "-limit", "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out != "user:1010\tvalue10\nuser:1011\tvalue11\nuser:1012\tvalue12\n" {
+		t.Fatalf("Unexpected range scan:\n%s", out)
+	}
+
+	out, err = runCommand(t, "-format", "json", file, "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stats statsJSON
+	if err := json.Unmarshal([]byte(out), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Collections[db.DefaultCollection].Items != 299 {
+		t.Fatalf("Expected 299 items, got %+v", stats.Collections)
+	}
+
+	out, err = runCommand(t, file, "pages")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(out, "0\tmetadata\n") || !strings.Contains(out, "\tleaf\t"+db.DefaultCollection) {
+		t.Fatalf("Unexpected pages:\n%s", out)
+	}
+
+	out, err = runCommand(t, file, "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(out, "node ") || !strings.Contains(out, "\n  node ") {
+		t.Fatalf("Unexpected dump:\n%s", out)
+	}
+
+	out, err = runCommand(t, file, "dump", "-dot", "-depth", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(out, "digraph btree {") || strings.Contains(out, " -> ") {
+		t.Fatalf("Unexpected DOT dump:\n%s", out)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source.mellow")
+	target := filepath.Join(dir, "target.mellow")
+
+	for i := range 100 {
+		if _, err := runCommand(t, "-collection", "users", source, "put", strconv.Itoa(1000+i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exported, err := runCommand(t, source, "export", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runCommandWithInput(t, exported, target, "import")
+	if err != nil || out != "imported 100 items\n" {
+		t.Fatalf("Expected 100 imported items, got %q, %v", out, err)
+	}
+
+	out, err = runCommand(t, "-collection", "users", target, "get", "1042")
+	if err != nil || out != "value\n" {
+		t.Fatalf("Expected value, got %q, %v", out, err)
+	}
+
+	file := filepath.Join(dir, "export.jsonl")
+	if err := os.WriteFile(file, []byte(exported), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := runCommand(t, filepath.Join(dir, "other.mellow"), "import", file); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	// The read commands don't create the file.
+	if _, err := runCommand(t, file, "put", "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{
+		{file},
+		{file, "unknown"},
+		{"-format", "xml", file, "stats"},
+		{file, "get"},
+		{file, "scan", "-prefix", "a", "-start", "b"},
+	} {
+		if _, err := runCommand(t, args...); !errors.Is(err, ErrUsage) {
+			t.Fatalf("Expected ErrUsage for %v, got %v", args, err)
+		}
+	}
+}
+
+func TestReadCommandsDontChangeTheFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "test.mellow")
+
+	if _, err := runCommand(t, file, "put", "key", "\xff\x00binary"); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{
+		{file, "get", "key"},
+		{file, "scan"},
+		{file, "stats"},
+		{file, "pages"},
+		{file, "dump"},
+		{file, "export"},
+	} {
+		if _, err := runCommand(t, args...); err != nil {
+			t.Fatalf("%v failed: %v", args, err)
+		}
+	}
+
+	if _, err := runCommand(t, "-collection", "missing", file, "get", "key"); !errors.Is(err, db.ErrCollectionNotFound) {
+		t.Fatalf("Expected ErrCollectionNotFound, got %v", err)
+	}
+
+	after, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(before, after) {
+		t.Fatal("Read commands changed the file")
+	}
+
+	missing := filepath.Join(dir, "missing.mellow")
+	if _, err := runCommand(t, missing, "get", "key"); err == nil {
+		t.Fatal("Expected get on a missing file to fail")
+	}
+
+	if _, err := os.Stat(missing); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected get not to create the file, got %v", err)
+	}
+}
+
+func TestItemJSONIsBase64(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	value := "\xff\xfe"
+	if _, err := runCommand(t, file, "put", "key", value); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runCommand(t, "-format", "json", file, "get", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var item itemJSON
+	if err := json.Unmarshal([]byte(out), &item); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(item.Value) != value {
+		t.Fatalf("Expected the binary value to survive JSON, got %q", item.Value)
+	}
+}
@@ -1,8 +1,13 @@
 package db
 
 import (
-	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/rettenwander/mellowdb/io"
 )
@@ -11,20 +16,150 @@ type NodeReader interface {
 	ReadNode(id io.PageID) (*Node, error)
 	WriteNode(*Node) error
 	GetNewNode() *Node
+	FreeNode(id io.PageID)
 	GetMaxNodeSize() int
 }
 
 type BTree struct {
 	Root io.PageID
 
+	// Compression of values written through this tree.
+	// Trees of a DB inherit the DB's options, see DB.SetCompression.
+	Compression CompressionOptions
+
+	// Combines operands passed to Merge with the stored values.
+	// Trees of a DB inherit the DB's operator, see DB.SetMergeOperator.
+	MergeOperator MergeOperator
+
 	NodeReader
+
+	// Shared by all trees of a DB. Nil if the tree isn't owned by a DB.
+	mu *sync.RWMutex
+	db *DB
+
+	// Name of the collection, empty if the tree isn't a collection.
+	name    string
+	indexes []*index
+
+	// Last value handed out by NextSequence, stored with the next commit.
+	sequence uint64
 }
 
 func NewBTree(db NodeReader, root io.PageID) *BTree {
-	return &BTree{NodeReader: db, Root: root}
+	t := &BTree{NodeReader: db, Root: root}
+	if d, ok := db.(*DB); ok {
+		t.Compression = d.compression
+		t.MergeOperator = d.mergeOperator
+		t.mu = &d.mu
+		t.db = d
+	}
+
+	return t
+}
+
+func (t *BTree) lock() {
+	if t.mu != nil {
+		t.mu.Lock()
+	}
+}
+
+func (t *BTree) unlock() {
+	if t.mu != nil {
+		t.mu.Unlock()
+	}
 }
 
+// Runs fn with the lock held. Syncs the DB afterwards if its SyncMode is SyncAlways.
+func (t *BTree) write(fn func() error) error {
+	err := func() error {
+		t.lock()
+		defer t.unlock()
+
+		return fn()
+	}()
+
+	if err != nil || t.db == nil {
+		return err
+	}
+
+	return t.db.syncAlways()
+}
+
+// Returns ErrReadOnly if the DB of the tree is read-only, or if the tree is
+// a collection of a follower DB and the follower isn't writing.
+// The caller must hold the lock of the tree.
+func (t *BTree) checkWritable() error {
+	if t.db == nil {
+		return nil
+	}
+
+	if t.db.io.ReadOnly() {
+		return ErrReadOnly
+	}
+
+	if t.db.follower && !t.db.applying && t.name != "" && !isInternalCollection(t.name) {
+		return ErrFollowerDB
+	}
+
+	return nil
+}
+
+// Returns ErrKeyTooLong or ErrValueTooLong if the item exceeds the limits of
+// the DB. Every tree of a DB is limited, also one made with NewBTree, except
+// the catalog and the internal collections, which use the maximum sizes.
+func (t *BTree) checkLimits(i *Item) error {
+	if t.db == nil || t == t.db.catalog || isInternalCollection(t.name) {
+		return nil
+	}
+
+	if len(i.key) > t.db.options.MaxKeySize {
+		return fmt.Errorf("%w: the DB allows %d bytes", ErrKeyTooLong, t.db.options.MaxKeySize)
+	}
+
+	if len(i.value) > t.db.options.MaxValueSize {
+		return fmt.Errorf("%w: the DB allows %d bytes", ErrValueTooLong, t.db.options.MaxValueSize)
+	}
+
+	return nil
+}
+
+func (t *BTree) rlock() {
+	if t.mu != nil {
+		t.mu.RLock()
+	}
+}
+
+func (t *BTree) runlock() {
+	if t.mu != nil {
+		t.mu.RUnlock()
+	}
+}
+
+// Returns the item of the key. Expired items are reported as ErrNotFound.
 func (t *BTree) Find(key []byte) (*Item, error) {
+	return t.FindContext(context.Background(), key)
+}
+
+// Like Find, but returns the error of ctx if it is done before the item was found.
+func (t *BTree) FindContext(ctx context.Context, key []byte) (*Item, error) {
+	t.rlock()
+	defer t.runlock()
+
+	view, _ := t.withContext(ctx)
+	item, err := view.find(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if item.isExpired(time.Now()) {
+		return nil, ErrNotFound
+	}
+
+	return decompressItem(item)
+}
+
+// Returns the item as stored, including expired items.
+func (t *BTree) find(key []byte) (*Item, error) {
 	if t.Root == 0 {
 		return nil, ErrNotFound
 	}
@@ -43,8 +178,7 @@ func (t *BTree) Find(key []byte) (*Item, error) {
 		return nil, ErrNotFound
 	}
 
-	item := node.items[index]
-	return item, nil
+	return node.items[index], nil
 }
 
 func (t *BTree) findKey(node *Node, key []byte, exect bool) (int, *Node, []int, error) {
@@ -83,73 +217,413 @@ func (t *BTree) findKeyHelper(node *Node, key []byte, exect bool, ancestorsIndex
 }
 
 func (t *BTree) Insert(i *Item) error {
+	return t.InsertContext(context.Background(), i)
+}
+
+// Like Insert, but returns the error of ctx if it is done before the item was
+// written. A cancelled insert leaves the tree unchanged.
+func (t *BTree) InsertContext(ctx context.Context, i *Item) error {
+	return t.write(func() error {
+		view, r := t.withContext(ctx)
+		err := view.upsert(i.key, func(*Item) (*Item, error) {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			r.writing = true
+			return i, nil
+		})
+
+		t.Root = view.Root
+		return err
+	})
+}
+
+// Stores the item returned by fn in a single descent. Fn gets the decompressed
+// stored item of the key, or nil if there is none or it expired. If fn returns
+// an error nothing is written.
+func (t *BTree) upsert(key []byte, fn func(old *Item) (*Item, error)) error {
+	var stored, old, i *Item
+	adding := false
+
+	err := t.put(key, func(s *Item) (*Item, error) {
+		old = s
+		if old != nil && old.isExpired(time.Now()) {
+			old = nil
+		}
+
+		var err error
+		i, err = fn(old)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := t.checkLimits(i); err != nil {
+			return nil, err
+		}
+
+		if err := t.checkIndexes(s, i); err != nil {
+			return nil, err
+		}
+
+		compressed, err := compressItem(i, t.Compression)
+		if err != nil {
+			return nil, err
+		}
+
+		// The new index entries are written before the item, so the index
+		// never misses it.
+		stored = s
+		adding = true
+		return compressed, t.addIndexEntries(s, i)
+	})
+	if err != nil {
+		if adding {
+			// Entries that can't be removed are stale, lookups skip them.
+			t.removeIndexEntries(i, stored)
+		}
+
+		return err
+	}
+
+	t.recordChange(ChangePut, key, old, i)
+	return t.removeIndexEntries(stored, i)
+}
+
+// Stores the item returned by fn, which gets the decompressed stored item
+// of the key, expired or not.
+func (t *BTree) put(key []byte, fn func(stored *Item) (*Item, error)) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+
 	var rootNode *Node
 	var err error
 
 	if t.Root == 0 {
-		rootNode = t.GetNewNode()
-		t.Root = rootNode.pageId
+		i, err := fn(nil)
+		if err != nil {
+			return err
+		}
 
+		rootNode = t.GetNewNode()
 		rootNode.AddItem(i, 0)
-		t.WriteNode(rootNode)
+
+		if err := t.WriteNode(rootNode); err != nil {
+			t.FreeNode(rootNode.pageId)
+			return err
+		}
+
+		t.Root = rootNode.pageId
 		return nil
 	}
 
-	rootNode, err = t.ReadNode(t.Root)
+	path, childIndexes, found, index, err := t.descend(key)
 	if err != nil {
 		return err
 	}
+	node := path[len(path)-1]
+
+	var stored *Item
+	if found {
+		stored, err = decompressItem(node.items[index])
+		if err != nil {
+			return err
+		}
+	}
 
-	index, node, ancestorsIndexes, err := t.findKey(rootNode, i.key, false)
+	i, err := fn(stored)
 	if err != nil {
 		return err
 	}
 
-	if len(node.items) > index && bytes.Compare(node.items[index].key, i.key) == 0 {
+	if found {
 		node.items[index] = i
-		t.WriteNode(node)
-		return nil
+	} else {
+		node.AddItem(i, index)
 	}
 
-	node.AddItem(i, index)
+	// Split the over populated nodes bottom-up, a split adds an item to the parent.
+	u := t.newUpdate(path)
+	u.change(node)
 
-	if float64(node.Size()) <= (float64(t.GetMaxNodeSize()) * MaxFillPercent) {
-		t.WriteNode(node)
-		return nil
+	for l := len(path) - 1; l > 0; l-- {
+		if t.isOverPopulated(path[l]) {
+			t.splitNode(u, path[l-1], path[l], childIndexes[l])
+		}
 	}
 
-	ancestors := []*Node{rootNode}
-	cur := rootNode
-	// read down to the parent of the leaf only
-	if len(ancestorsIndexes) > 1 {
-		for i := 1; i < len(ancestorsIndexes)-1; i++ {
-			cur, _ = t.ReadNode(cur.children[ancestorsIndexes[i]])
-			ancestors = append(ancestors, cur)
+	if t.isOverPopulated(path[0]) {
+		t.splitRoot(u)
+	}
+
+	return u.apply()
+}
+
+// Returns the nodes from the root down to the node holding the key, or to the
+// leaf it belongs into, and the index of each node in its parent's children.
+// Found and index are the result of FindKeyInNode for the last node.
+func (t *BTree) descend(key []byte) (path []*Node, childIndexes []int, found bool, index int, err error) {
+	node, err := t.ReadNode(t.Root)
+	if err != nil {
+		return nil, nil, false, 0, err
+	}
+
+	path = []*Node{node}
+	childIndexes = []int{0}
+
+	found, index = node.FindKeyInNode(key)
+	for !found && !node.isLeaf() {
+		node, err = t.ReadNode(node.children[index])
+		if err != nil {
+			return nil, nil, false, 0, err
 		}
-		// now append the actual mutated leaf (don't re-read it)
-		ancestors = append(ancestors, node)
+
+		path = append(path, node)
+		childIndexes = append(childIndexes, index)
+		found, index = node.FindKeyInNode(key)
 	}
 
-	for i := len(ancestors) - 2; i >= 0; i-- {
-		parent := ancestors[i]
-		child := ancestors[i+1]
+	return path, childIndexes, found, index, nil
+}
 
-		if float64(child.Size()) > (float64(t.GetMaxNodeSize()) * MaxFillPercent) {
-			t.splitNode(parent, child, ancestorsIndexes[i+1])
+// Removes the key from the tree. Removing a missing key is not an error.
+func (t *BTree) Delete(key []byte) error {
+	return t.write(func() error {
+		_, err := t.delete(key, nil)
+		return err
+	})
+}
+
+// Removes the key if shouldDelete is nil or returns true for the stored item.
+// Returns whether the key was removed.
+func (t *BTree) delete(key []byte, shouldDelete func(i *Item) bool) (bool, error) {
+	var stored *Item
+
+	deleted, err := t.remove(key, func(i *Item) bool {
+		if shouldDelete != nil && !shouldDelete(i) {
+			return false
 		}
+
+		stored = i
+		return true
+	})
+	if err != nil || !deleted {
+		return deleted, err
+	}
+
+	old, err := decompressItem(stored)
+	if err != nil {
+		return true, err
 	}
 
-	if float64(rootNode.Size()) > (float64(t.GetMaxNodeSize()) * MaxFillPercent) {
-		newRoot := t.GetNewNode()
-		newRoot.AddChild(rootNode.pageId, 0)
+	t.recordChange(ChangeDelete, key, old, nil)
+	return true, t.removeIndexEntries(stored, nil)
+}
 
-		t.splitNode(newRoot, rootNode, 0)
-		t.Root = newRoot.pageId
+// Removes the key if shouldDelete returns true for the stored item.
+func (t *BTree) remove(key []byte, shouldDelete func(i *Item) bool) (bool, error) {
+	if err := t.checkWritable(); err != nil {
+		return false, err
 	}
 
+	if t.Root == 0 {
+		return false, nil
+	}
+
+	path, childIndexes, found, index, err := t.descend(key)
+	if err != nil || !found {
+		return false, err
+	}
+	node := path[len(path)-1]
+
+	if !shouldDelete(node.items[index]) {
+		return false, nil
+	}
+
+	if node.isLeaf() {
+		node.items = slices.Delete(node.items, index, index+1)
+	} else {
+		// Replace the item with its predecessor, the last item of the left subtree.
+		childIndex := index
+		leaf := node
+		for !leaf.isLeaf() {
+			leaf, err = t.ReadNode(leaf.children[childIndex])
+			if err != nil {
+				return false, err
+			}
+
+			path = append(path, leaf)
+			childIndexes = append(childIndexes, childIndex)
+			childIndex = len(leaf.children) - 1
+		}
+
+		node.items[index] = leaf.items[len(leaf.items)-1]
+		leaf.items = leaf.items[:len(leaf.items)-1]
+	}
+
+	u := t.newUpdate(path)
+	u.change(node, path[len(path)-1])
+
+	// Rebalance bottom-up. Borrowing and merging changes the parent,
+	// which is handled in the next iteration.
+	for i := len(path) - 1; i > 0; i-- {
+		parent := path[i-1]
+		child := path[i]
+
+		if t.isUnderPopulated(child) {
+			if err := t.rebalance(u, parent, child, childIndexes[i]); err != nil {
+				u.abort()
+				return false, err
+			}
+		} else if t.isOverPopulated(child) {
+			t.splitNode(u, parent, child, childIndexes[i])
+		}
+	}
+
+	rootNode := path[0]
+	if len(rootNode.items) == 0 {
+		u.free(rootNode)
+
+		if rootNode.isLeaf() {
+			u.root = 0
+		} else {
+			u.root = rootNode.children[0]
+		}
+	} else if t.isOverPopulated(rootNode) {
+		t.splitRoot(u)
+	}
+
+	return true, u.apply()
+}
+
+// Fixes the under populated node by borrowing an item from a sibling or merging with it.
+func (t *BTree) rebalance(u *treeUpdate, parent *Node, node *Node, index int) error {
+	var left, right *Node
+	var err error
+
+	if index > 0 {
+		left, err = t.ReadNode(parent.children[index-1])
+		if err != nil {
+			return err
+		}
+
+		if t.canLendItem(left, len(left.items)-1) && t.canTakeItem(node, parent.items[index-1]) {
+			last := len(left.items) - 1
+			node.AddItem(parent.items[index-1], 0)
+			parent.items[index-1] = left.items[last]
+			left.items = left.items[:last]
+
+			if !left.isLeaf() {
+				node.AddChild(left.children[last+1], 0)
+				left.children = left.children[:last+1]
+			}
+
+			u.change(left, node, parent)
+			return nil
+		}
+	}
+
+	if index < len(parent.children)-1 {
+		right, err = t.ReadNode(parent.children[index+1])
+		if err != nil {
+			return err
+		}
+
+		if t.canLendItem(right, 0) && t.canTakeItem(node, parent.items[index]) {
+			node.AddItem(parent.items[index], len(node.items))
+			parent.items[index] = right.items[0]
+			right.items = right.items[1:]
+
+			if !right.isLeaf() {
+				node.AddChild(right.children[0], len(node.children))
+				right.children = right.children[1:]
+			}
+
+			u.change(right, node, parent)
+			return nil
+		}
+	}
+
+	if left != nil {
+		t.mergeNodes(u, parent, left, node, index-1)
+	} else if right != nil {
+		t.mergeNodes(u, parent, node, right, index)
+	}
+
+	// A node without siblings can only be fixed by its parent.
 	return nil
 }
 
+// Moves the separator parent.items[separatorIndex] and all of right into left.
+func (t *BTree) mergeNodes(u *treeUpdate, parent *Node, left *Node, right *Node, separatorIndex int) {
+	left.items = append(left.items, parent.items[separatorIndex])
+	left.items = append(left.items, right.items...)
+	left.children = append(left.children, right.children...)
+
+	parent.items = slices.Delete(parent.items, separatorIndex, separatorIndex+1)
+	parent.children = slices.Delete(parent.children, separatorIndex+1, separatorIndex+2)
+
+	u.change(left, parent)
+	u.free(right)
+
+	// Items differ in size, so the merged node can be too large for a page.
+	if t.isOverPopulated(left) {
+		t.splitNode(u, parent, left, separatorIndex)
+	}
+}
+
+func (t *BTree) maxNodeSize() float64 {
+	if t.db != nil {
+		return float64(t.GetMaxNodeSize()) * t.db.options.MaxFill
+	}
+
+	return float64(t.GetMaxNodeSize()) * MaxFillPercent
+}
+
+func (t *BTree) minNodeSize() float64 {
+	if t.db != nil {
+		return float64(t.GetMaxNodeSize()) * t.db.options.MinFill
+	}
+
+	return float64(t.GetMaxNodeSize()) * MinFillPercent
+}
+
+func (t *BTree) isOverPopulated(n *Node) bool {
+	return float64(n.Size()) > t.maxNodeSize()
+}
+
+func (t *BTree) isUnderPopulated(n *Node) bool {
+	return float64(n.Size()) < t.minNodeSize()
+}
+
+// Reports if the node stays populated without the item at index.
+func (t *BTree) canLendItem(n *Node, index int) bool {
+	if len(n.items) < 2 {
+		return false
+	}
+
+	size := n.Size() - n.items[index].Size() - 2 - io.PageIDSize
+	return float64(size) >= t.minNodeSize()
+}
+
+// Reports if the node can take the item without becoming over populated.
+func (t *BTree) canTakeItem(n *Node, i *Item) bool {
+	size := n.Size() + i.Size() + 2 + io.PageIDSize
+	return float64(size) <= t.maxNodeSize()
+}
+
+// Splits the root of the update below a new root.
+func (t *BTree) splitRoot(u *treeUpdate) {
+	rootNode := u.path[0]
+
+	newRoot := u.newNode()
+	newRoot.AddChild(rootNode.pageId, 0)
+	t.splitNode(u, newRoot, rootNode, 0)
+
+	u.root = newRoot.pageId
+}
+
 func (t *BTree) getSplitIndex(n *Node) int {
 	size := 3
 	size += io.PageIDSize
@@ -159,19 +633,29 @@ func (t *BTree) getSplitIndex(n *Node) int {
 		size += 3
 		size += item.Size()
 
-		if float32(size) > (float32(t.GetMaxNodeSize())*MinFillPercent) && i < len(n.items)-1 {
+		// Keep at least one item for the new node, empty nodes can't be rebalanced.
+		if float64(size) > t.minNodeSize() && i < len(n.items)-2 {
 			return i + 1
 		}
 	}
 
-	return -1
+	// The items are too large to fill both halves. Keep the new node as small as possible.
+	if len(n.items) > 2 {
+		return len(n.items) - 2
+	}
+
+	return len(n.items) - 1
 }
 
-func (t *BTree) splitNode(parent *Node, nodeToSplit *Node, childIndexOfNodeToSplit int) {
+// Moves the items after the middle item to a new node and the middle item to
+// the parent. Nothing is written.
+func (t *BTree) splitNode(u *treeUpdate, parent *Node, nodeToSplit *Node, childIndexOfNodeToSplit int) {
+	u.splits++
+
 	splitIndex := t.getSplitIndex(nodeToSplit)
 
 	middleItem := nodeToSplit.items[splitIndex].Clone()
-	newNode := t.GetNewNode()
+	newNode := u.newNode()
 
 	if nodeToSplit.isLeaf() {
 		newNode.items = nodeToSplit.items[splitIndex+1:]
@@ -192,22 +676,57 @@ func (t *BTree) splitNode(parent *Node, nodeToSplit *Node, childIndexOfNodeToSpl
 		parent.children[childIndexOfNodeToSplit+1] = newNode.pageId
 	}
 
-	t.WriteNode(newNode)
-	t.WriteNode(nodeToSplit)
-	t.WriteNode(parent)
+	u.change(nodeToSplit, parent)
 }
 
+// Walks the tree and reports how much space compression saved.
+func (t *BTree) CompressionStats() (CompressionStats, error) {
+	t.rlock()
+	defer t.runlock()
+
+	stats := CompressionStats{}
+
+	err := t.forEachItem(func(i *Item) error {
+		stats.Items++
+		stats.StoredValueBytes += len(i.value)
+
+		if !i.isCompressed() {
+			stats.RawValueBytes += len(i.value)
+			return nil
+		}
+
+		raw, err := decompressItem(i)
+		if err != nil {
+			return err
+		}
+
+		stats.CompressedItems++
+		stats.RawValueBytes += len(raw.value)
+		return nil
+	})
+
+	return stats, err
+}
+
+// Logs the nodes below the page as indented text, one node per line.
+//
+// Deprecated: Use Visualize with VisualizeText.
 func (tr *BTree) DumpTree(t *testing.T, pg io.PageID, indent string) {
-	n, err := tr.ReadNode(pg)
+	t.Helper()
+
+	tr.rlock()
+	v, err := tr.visualNode(pg, 0, VisualizeOptions{})
+	tr.runlock()
 	if err != nil {
 		t.Fatalf("read %d: %v", pg, err)
 	}
-	ks := make([]string, len(n.items))
-	for i, it := range n.items {
-		ks[i] = string(it.key)
+
+	var b strings.Builder
+	if err := writeVisualText(&b, v, 0); err != nil {
+		t.Fatal(err)
 	}
-	t.Logf("%snode %d keys=%v children=%v", indent, n.PageID(), ks, n.children)
-	for _, ch := range n.children {
-		tr.DumpTree(t, ch, indent+"  ")
+
+	for _, line := range strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n") {
+		t.Logf("%s%s", indent, line)
 	}
 }
@@ -1,8 +1,11 @@
 package db_test
 
 import (
+	"bytes"
 	"errors"
+	"math/rand/v2"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/rettenwander/mellowdb/db"
@@ -16,6 +19,9 @@ type NodeReaderMOCK struct {
 	ReadCounter   int
 	WriteCounter  int
 	GetNewCounter int
+
+	// No ID below this is free.
+	lowestFree io.PageID
 }
 
 func (r *NodeReaderMOCK) ReadNode(id io.PageID) (*db.Node, error) {
@@ -29,7 +35,9 @@ func (r *NodeReaderMOCK) ReadNode(id io.PageID) (*db.Node, error) {
 	node.WriteToBuffer(buf)
 
 	clone := db.NewEmptyNode(node.PageID())
-	clone.ReadFromBuffer(buf)
+	if err := clone.ReadFromBuffer(buf); err != nil {
+		return nil, err
+	}
 	return clone, nil
 }
 
@@ -41,12 +49,13 @@ func (r *NodeReaderMOCK) WriteNode(n *db.Node) error {
 
 func (r *NodeReaderMOCK) GetNewNode() *db.Node {
 	r.GetNewCounter++
-	id := io.PageID(1)
+	id := max(r.lowestFree, 1)
 	for {
 		_, ok := r.nodes[id]
 		if !ok {
 			node := db.NewEmptyNode(id)
 			r.nodes[id] = *node
+			r.lowestFree = id + 1
 			return node
 		}
 
@@ -54,10 +63,24 @@ func (r *NodeReaderMOCK) GetNewNode() *db.Node {
 	}
 }
 
+func (r *NodeReaderMOCK) FreeNode(id io.PageID) {
+	delete(r.nodes, id)
+	r.lowestFree = min(r.lowestFree, id)
+}
+
 func (r *NodeReaderMOCK) GetMaxNodeSize() int {
 	return r.MaxNodeSize
 }
 
+func dumpTree(t *testing.T, tree *db.BTree) {
+	var buf strings.Builder
+	if err := tree.Visualize(&buf, db.VisualizeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log("\n" + buf.String())
+}
+
 func TestBTreeFind(t *testing.T) {
 	reader := &NodeReaderMOCK{
 		nodes: make(map[int64]db.Node),
@@ -160,11 +183,11 @@ func TestInsert(t *testing.T) {
 			for _, node := range reader.nodes {
 				found, _ := node.FindKeyInNode(key)
 				if found == true {
-					tree.DumpTree(t, tree.Root, "")
+					dumpTree(t, tree)
 					t.Fatalf("Key %s not found: but there", key)
 				}
 			}
-			tree.DumpTree(t, tree.Root, "")
+			dumpTree(t, tree)
 			t.Fatalf("Key %s not found", key)
 		}
 
@@ -199,3 +222,199 @@ func TestInsert(t *testing.T) {
 		}
 	}
 }
+
+func TestDelete(t *testing.T) {
+	reader := &NodeReaderMOCK{
+		nodes:       make(map[int64]db.Node),
+		MaxNodeSize: 512,
+	}
+
+	tree := db.NewBTree(reader, 0)
+	rnd := rand.New(rand.NewPCG(1, 2))
+
+	numOfItems := 3000
+	values := make(map[string][]byte)
+
+	for _, i := range rnd.Perm(numOfItems) {
+		key := []byte(strconv.Itoa(i))
+		// Items of different sizes exercise merges that overflow a page.
+		value := bytes.Repeat([]byte{'v'}, rnd.IntN(100))
+		item, _ := db.NewItem(key, value)
+
+		if err := tree.Insert(item); err != nil {
+			t.Fatalf("Error inserting %d, %v", i, err)
+		}
+		values[string(key)] = value
+	}
+
+	for n, i := range rnd.Perm(numOfItems) {
+		key := []byte(strconv.Itoa(i))
+		if err := tree.Delete(key); err != nil {
+			t.Fatalf("Error deleting %d, %v", i, err)
+		}
+		delete(values, string(key))
+
+		if _, err := tree.Find(key); !errors.Is(err, db.ErrNotFound) {
+			t.Fatalf("Deleted key %s still found: %v", key, err)
+		}
+
+		if n%250 != 0 {
+			continue
+		}
+
+		for k, v := range values {
+			item, err := tree.Find([]byte(k))
+			if err != nil {
+				dumpTree(t, tree)
+				t.Fatalf("Key %s not found after deleting %d keys: %v", k, n+1, err)
+			}
+
+			if !bytes.Equal(item.Value(), v) {
+				t.Fatalf("Key %s has the wrong value", k)
+			}
+		}
+
+		for id, node := range reader.nodes {
+			if float32(node.Size()) > float32(reader.MaxNodeSize)*db.MaxFillPercent {
+				t.Fatalf("A node is too big: %d, %d", node.Size(), id)
+			}
+		}
+	}
+
+	if tree.Root != 0 {
+		t.Fatalf("Root of empty tree is %d", tree.Root)
+	}
+
+	if len(reader.nodes) != 0 {
+		t.Fatalf("%d nodes were not freed", len(reader.nodes))
+	}
+
+	// Deleting from an empty tree is a no-op.
+	if err := tree.Delete([]byte("1")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Fails the nth read or write from now on. Zero never fails.
+type failingNodeReader struct {
+	*NodeReaderMOCK
+
+	failRead  int
+	failWrite int
+}
+
+var errInjected = errors.New("injected failure")
+
+func (r *failingNodeReader) ReadNode(id io.PageID) (*db.Node, error) {
+	if r.failRead > 0 {
+		r.failRead--
+		if r.failRead == 0 {
+			return nil, errInjected
+		}
+	}
+
+	return r.NodeReaderMOCK.ReadNode(id)
+}
+
+func (r *failingNodeReader) WriteNode(n *db.Node) error {
+	if r.failWrite > 0 {
+		r.failWrite--
+		if r.failWrite == 0 {
+			return errInjected
+		}
+	}
+
+	return r.NodeReaderMOCK.WriteNode(n)
+}
+
+func (r *NodeReaderMOCK) snapshot() map[io.PageID][]byte {
+	pages := make(map[io.PageID][]byte)
+	for id, node := range r.nodes {
+		buf := make([]byte, node.Size())
+		node.WriteToBuffer(buf)
+		pages[id] = buf
+	}
+
+	return pages
+}
+
+func (r *NodeReaderMOCK) restore(pages map[io.PageID][]byte) {
+	r.nodes = make(map[io.PageID]db.Node)
+	r.lowestFree = 0
+	for id, buf := range pages {
+		node := db.NewEmptyNode(id)
+		node.ReadFromBuffer(buf)
+		r.nodes[id] = *node
+	}
+}
+
+func TestInsertFailures(t *testing.T) {
+	reader := &failingNodeReader{
+		NodeReaderMOCK: &NodeReaderMOCK{
+			nodes:       make(map[int64]db.Node),
+			MaxNodeSize: 200,
+		},
+	}
+	tree := db.NewBTree(reader, 0)
+
+	for i := range 500 {
+		key := []byte(strconv.Itoa(i))
+		item, _ := db.NewItem(key, append([]byte("Value "), key...))
+
+		// Fail every read of the insert in turn, then every write. The insert
+		// that gets through the reads is undone to test the writes.
+		for _, failRead := range []bool{true, false} {
+			root := tree.Root
+			pages := reader.snapshot()
+
+			for step := 1; ; step++ {
+				if failRead {
+					reader.failRead = step
+				} else {
+					reader.failWrite = step
+				}
+
+				err := tree.Insert(item)
+				reader.failRead, reader.failWrite = 0, 0
+				if err == nil {
+					break
+				}
+
+				if !errors.Is(err, errInjected) {
+					t.Fatalf("Expected the injected error, got %v", err)
+				}
+
+				if tree.Root != root {
+					t.Fatalf("Insert of %s failed at step %d but changed the root", key, step)
+				}
+
+				after := reader.snapshot()
+				if len(after) != len(pages) {
+					t.Fatalf("Insert of %s failed at step %d but left %d pages instead of %d", key, step, len(after), len(pages))
+				}
+
+				for id, page := range pages {
+					if !bytes.Equal(after[id], page) {
+						t.Fatalf("Insert of %s failed at step %d but changed page %d", key, step, id)
+					}
+				}
+			}
+
+			if failRead {
+				reader.restore(pages)
+				tree.Root = root
+			}
+		}
+
+		if _, err := tree.Find(key); err != nil {
+			t.Fatalf("Key %s not found after insert: %v", key, err)
+		}
+	}
+
+	for i := range 500 {
+		key := []byte(strconv.Itoa(i))
+		if _, err := tree.Find(key); err != nil {
+			t.Fatalf("Key %s not found: %v", key, err)
+		}
+	}
+}
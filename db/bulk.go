@@ -0,0 +1,255 @@
+package db
+
+import (
+	"bytes"
+	"slices"
+
+	"github.com/rettenwander/mellowdb/io"
+)
+
+// Builds a tree bottom-up from items in ascending key order. Only the
+// rightmost node of every level is kept in memory, full nodes are written
+// as soon as the next item doesn't fit.
+//
+// Items that aren't greater than the previous one, and all items for trees
+// that aren't empty or have indexes, are inserted one by one instead.
+// The caller must hold the lock of the tree until finish or pause returns.
+type bulkLoader struct {
+	tree *BTree
+	bulk bool
+	// Set by pause if resume can go on with the bulk load.
+	paused bool
+
+	// The rightmost node of every level, the leaf first.
+	levels  []*Node
+	lastKey []byte
+	// Pages of the right edge taken over by resume, freed once the new root is set.
+	replaced []io.PageID
+}
+
+func (t *BTree) newBulkLoader() *bulkLoader {
+	return &bulkLoader{tree: t, bulk: t.Root == 0 && len(t.indexes) == 0}
+}
+
+func (l *bulkLoader) add(i *Item) error {
+	if l.bulk && l.lastKey != nil && bytes.Compare(i.key, l.lastKey) <= 0 {
+		if err := l.finish(); err != nil {
+			return err
+		}
+	}
+
+	if err := l.tree.checkLimits(i); err != nil {
+		return err
+	}
+
+	if !l.bulk {
+		return l.tree.upsert(i.key, func(*Item) (*Item, error) {
+			return i, nil
+		})
+	}
+
+	stored, err := compressItem(i, l.tree.Compression)
+	if err != nil {
+		return err
+	}
+
+	if err := l.push(0, stored, 0); err != nil {
+		return err
+	}
+
+	l.tree.recordChange(ChangePut, i.key, nil, i)
+	l.lastKey = append(l.lastKey[:0], i.key...)
+	return nil
+}
+
+// Appends the item to the node of the level. Child is the page left of the
+// item and only used for internal levels. If the node is full, it's written
+// and the item moves up as the separator to the next node.
+func (l *bulkLoader) push(level int, i *Item, child io.PageID) error {
+	t := l.tree
+
+	if level == len(l.levels) {
+		l.levels = append(l.levels, t.GetNewNode())
+	}
+
+	n := l.levels[level]
+	if level > 0 {
+		n.children = append(n.children, child)
+	}
+
+	if len(n.items) == 0 || t.canTakeItem(n, i) {
+		n.items = append(n.items, i)
+		return nil
+	}
+
+	if err := t.WriteNode(n); err != nil {
+		return err
+	}
+
+	l.levels[level] = t.GetNewNode()
+	return l.push(level+1, i, n.pageId)
+}
+
+// Finishes the tree, so the lock of the tree can be released. Once it's held
+// again, resume goes on with the bulk load.
+func (l *bulkLoader) pause() error {
+	l.paused = l.bulk
+	return l.finish()
+}
+
+// Takes the right edge of the tree as the rightmost nodes of the levels, if the
+// bulk load was paused. Other writes may have changed the tree in between, so
+// the last key is the largest key of the tree. The nodes move to new pages,
+// the tree keeps the old ones until finish sets the new root.
+func (l *bulkLoader) resume() error {
+	t := l.tree
+	if !l.paused || len(t.indexes) > 0 {
+		l.paused = false
+		return nil
+	}
+	l.paused = false
+
+	var levels []*Node
+	for id := t.Root; id != 0; {
+		n, err := t.ReadNode(id)
+		if err != nil {
+			return err
+		}
+
+		levels = append(levels, n)
+		if n.isLeaf() {
+			break
+		}
+
+		// Finish links the node below as the last child again.
+		id = n.children[len(n.children)-1]
+		n.children = n.children[:len(n.children)-1]
+	}
+	slices.Reverse(levels)
+
+	for _, n := range levels {
+		l.replaced = append(l.replaced, n.pageId)
+		n.pageId = t.GetNewNode().pageId
+	}
+
+	l.bulk = true
+	l.levels = levels
+	l.lastKey = l.lastKey[:0]
+	if len(levels) > 0 && len(levels[0].items) > 0 {
+		leaf := levels[0]
+		l.lastKey = append(l.lastKey, leaf.items[len(leaf.items)-1].key...)
+	}
+
+	return nil
+}
+
+// Links the rightmost nodes into their parents and sets the root of the tree.
+func (l *bulkLoader) finish() error {
+	if !l.bulk {
+		return nil
+	}
+
+	t := l.tree
+	levels := l.levels
+	l.bulk = false
+	l.levels = nil
+
+	if len(levels) == 0 {
+		return nil
+	}
+
+	for level, n := range levels[:len(levels)-1] {
+		parent := levels[level+1]
+		parent.children = append(parent.children, n.pageId)
+
+		if err := t.WriteNode(n); err != nil {
+			return err
+		}
+	}
+
+	root := levels[len(levels)-1]
+	if err := t.WriteNode(root); err != nil {
+		return err
+	}
+	t.Root = root.pageId
+
+	for _, id := range l.replaced {
+		t.FreeNode(id)
+	}
+	l.replaced = nil
+
+	return l.repairRightEdge()
+}
+
+// The rightmost nodes of the levels can be under populated or even empty.
+// Going down the right edge, every such node is merged with its left sibling.
+func (l *bulkLoader) repairRightEdge() error {
+	t := l.tree
+
+	if err := l.collapseRoot(); err != nil || t.Root == 0 {
+		return err
+	}
+
+	parent, err := t.ReadNode(t.Root)
+	if err != nil {
+		return err
+	}
+
+	path := []*Node{parent}
+	for !parent.isLeaf() {
+		index := len(parent.children) - 1
+		child, err := t.ReadNode(parent.children[index])
+		if err != nil {
+			return err
+		}
+
+		if t.isUnderPopulated(child) && index > 0 {
+			left, err := t.ReadNode(parent.children[index-1])
+			if err != nil {
+				return err
+			}
+
+			u := t.newUpdate(slices.Concat(path, []*Node{child}))
+			t.mergeNodes(u, parent, left, child, index-1)
+			if err := u.apply(); err != nil {
+				return err
+			}
+
+			// The merge or a split after it changed the last child.
+			if child, err = t.ReadNode(parent.children[len(parent.children)-1]); err != nil {
+				return err
+			}
+		}
+
+		path = append(path, child)
+		parent = child
+	}
+
+	// A merge can take the last item of the root.
+	return l.collapseRoot()
+}
+
+// Replaces roots without items by their only child.
+func (l *bulkLoader) collapseRoot() error {
+	t := l.tree
+
+	for t.Root != 0 {
+		root, err := t.ReadNode(t.Root)
+		if err != nil {
+			return err
+		}
+
+		if len(root.items) > 0 {
+			return nil
+		}
+
+		t.FreeNode(root.pageId)
+		if root.isLeaf() {
+			t.Root = 0
+		} else {
+			t.Root = root.children[0]
+		}
+	}
+
+	return nil
+}
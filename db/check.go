@@ -0,0 +1,211 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+
+	"github.com/rettenwander/mellowdb/io"
+)
+
+// Problem is an inconsistency found by Check.
+type Problem struct {
+	Page io.PageID
+	// Name of the collection the page belongs to. Empty for the catalog and for unreachable pages.
+	Collection string
+	Message    string
+}
+
+func (p Problem) String() string {
+	if p.Collection == "" {
+		return fmt.Sprintf("page %d: %s", p.Page, p.Message)
+	}
+
+	return fmt.Sprintf("page %d (%s): %s", p.Page, p.Collection, p.Message)
+}
+
+type checker struct {
+	db       *DB
+	problems []Problem
+
+	// Number of references to each page.
+	references map[io.PageID]int
+}
+
+// Verifies the structure of the DB file and returns the problems found. It checks that
+// every node decodes, keys are sorted and within the bounds of their parent,
+// all leaves of a tree are at the same depth, and every page is either
+// referenced exactly once or released.
+func (e *DB) Check() []Problem {
+	e.collectionsMu.Lock()
+	defer e.collectionsMu.Unlock()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	c := &checker{db: e, references: make(map[io.PageID]int)}
+	c.checkTree("", e.catalog.Root)
+
+	roots := map[string]io.PageID{}
+	err := e.catalog.forEachItem(func(i *Item) error {
+		record, err := decodeCollectionRecord(i.value)
+		if err != nil {
+			c.report(e.catalog.Root, string(i.key), "collection record doesn't decode: %v", err)
+			return nil
+		}
+
+		roots[string(i.key)] = record.root
+		return nil
+	})
+	if err != nil {
+		c.report(e.catalog.Root, "", "catalog can't be read: %v", err)
+	}
+
+	// Open collections may have roots that aren't in the catalog yet.
+	for name, tree := range e.collections {
+		roots[name] = tree.Root
+	}
+
+	for name, root := range roots {
+		c.checkTree(name, root)
+	}
+
+	// The free list pages are referenced by the metadata.
+	for _, id := range e.io.FreelistPages() {
+		c.reference(id, "", "free list page")
+	}
+
+	c.checkPages()
+	return c.problems
+}
+
+func (c *checker) report(page io.PageID, collection string, format string, args ...any) {
+	c.problems = append(c.problems, Problem{Page: page, Collection: collection, Message: fmt.Sprintf(format, args...)})
+}
+
+func (c *checker) checkTree(name string, root io.PageID) {
+	if root == 0 {
+		return
+	}
+
+	leafDepth := -1
+	c.checkNode(name, root, nil, nil, 0, &leafDepth)
+}
+
+// Checks the subtree at id, whose keys must be greater than lower and less than upper.
+// Nil bounds are open.
+func (c *checker) checkNode(name string, id io.PageID, lower, upper []byte, depth int, leafDepth *int) {
+	if !c.reference(id, name, "page") {
+		return
+	}
+
+	n, err := c.readNode(id)
+	if err != nil {
+		c.report(id, name, "node doesn't decode: %v", err)
+		return
+	}
+
+	if depth > 0 && len(n.items) == 0 {
+		c.report(id, name, "node has no items")
+	}
+
+	for i, item := range n.items {
+		if i > 0 && bytes.Compare(n.items[i-1].key, item.key) >= 0 {
+			c.report(id, name, "key %q isn't greater than the key before it", item.key)
+		}
+
+		if lower != nil && bytes.Compare(item.key, lower) <= 0 {
+			c.report(id, name, "key %q isn't greater than the separator %q of the parent", item.key, lower)
+		}
+
+		if upper != nil && bytes.Compare(item.key, upper) >= 0 {
+			c.report(id, name, "key %q isn't less than the separator %q of the parent", item.key, upper)
+		}
+
+		if _, err := decompressItem(item); err != nil {
+			c.report(id, name, "value of key %q doesn't decode: %v", item.key, err)
+		}
+	}
+
+	if n.isLeaf() {
+		if *leafDepth == -1 {
+			*leafDepth = depth
+		} else if *leafDepth != depth {
+			c.report(id, name, "leaf is at depth %d instead of %d", depth, *leafDepth)
+		}
+
+		return
+	}
+
+	if len(n.children) != len(n.items)+1 {
+		c.report(id, name, "node has %d children for %d items", len(n.children), len(n.items))
+		return
+	}
+
+	for i, child := range n.children {
+		childLower, childUpper := lower, upper
+		if i > 0 {
+			childLower = n.items[i-1].key
+		}
+		if i < len(n.items) {
+			childUpper = n.items[i].key
+		}
+
+		c.checkNode(name, child, childLower, childUpper, depth+1, leafDepth)
+	}
+}
+
+// Counts a reference to the page. Returns false if the page is out of range or
+// was referenced before.
+func (c *checker) reference(id io.PageID, name string, what string) bool {
+	if id <= 0 || id > c.db.io.MaxPageID {
+		c.report(id, name, "%s is out of range", what)
+		return false
+	}
+
+	c.references[id]++
+	if c.references[id] > 1 {
+		c.report(id, name, "%s is referenced more than once", what)
+		return false
+	}
+
+	return true
+}
+
+// Reads the node and checks that it fits into its page.
+func (c *checker) readNode(id io.PageID) (*Node, error) {
+	n, err := c.db.ReadNode(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.Size() > c.db.GetMaxNodeSize() {
+		return nil, fmt.Errorf("node needs %d bytes, the page holds %d", n.Size(), c.db.GetMaxNodeSize())
+	}
+
+	return n, nil
+}
+
+// Checks that every page is either referenced or released, but not both.
+func (c *checker) checkPages() {
+	// Pages freed since the last commit are released once it's made.
+	released := make(map[io.PageID]int)
+	for _, id := range slices.Concat(c.db.io.ReleasedPages, c.db.io.PendingPages()) {
+		released[id]++
+
+		if id <= 0 || id > c.db.io.MaxPageID {
+			c.report(id, "", "released page is out of range")
+		} else if released[id] == 2 {
+			c.report(id, "", "page is released more than once")
+		}
+	}
+
+	for id := io.PageID(1); id <= c.db.io.MaxPageID; id++ {
+		referenced := c.references[id] > 0
+		if referenced && released[id] > 0 {
+			c.report(id, "", "page is referenced and released")
+		} else if !referenced && released[id] == 0 {
+			c.report(id, "", "page is neither referenced nor released")
+		}
+	}
+}
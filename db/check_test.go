@@ -0,0 +1,102 @@
+package db_test
+
+import (
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/db"
+	"github.com/rettenwander/mellowdb/io"
+)
+
+func TestCheck(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	dbEngine, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rnd := rand.New(rand.NewPCG(1, 2))
+	for _, name := range []string{"users", "orders"} {
+		tree, err := dbEngine.Collection(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, i := range rnd.Perm(3000) {
+			item, _ := db.NewItem([]byte(strconv.Itoa(i)), []byte(name))
+			if err := tree.Insert(item); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, i := range rnd.Perm(2000) {
+			if err := tree.Delete([]byte(strconv.Itoa(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if problems := dbEngine.Check(); len(problems) != 0 {
+		t.Fatalf("Expected no problems, got %v", problems)
+	}
+
+	pages, err := dbEngine.Pages()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var leaf io.PageID
+	for _, page := range pages {
+		if page.Type == db.PageLeaf && page.Collection == "users" {
+			leaf = page.ID
+			break
+		}
+	}
+
+	if err := dbEngine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwrite a page with garbage.
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pageSize := int64(os.Getpagesize())
+	garbage := make([]byte, pageSize)
+	for i := range garbage {
+		garbage[i] = byte(rnd.IntN(256))
+	}
+
+	if _, err := f.WriteAt(garbage, int64(leaf)*pageSize); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	dbEngine, err = db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	problems := dbEngine.Check()
+	if len(problems) == 0 {
+		t.Fatal("Expected problems after corrupting a page")
+	}
+
+	found := false
+	for _, problem := range problems {
+		if problem.Page == leaf {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatalf("Expected a problem for page %d, got %v", leaf, problems)
+	}
+}
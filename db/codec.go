@@ -0,0 +1,115 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// A Codec converts keys or values of a typed Collection to bytes. Key codecs
+// must keep the order of the keys, bytes.Compare on two encoded keys has to
+// agree with the order of the keys.
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+type signed interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64
+}
+
+type unsigned interface {
+	~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// Stores strings as they are. Keeps the byte order of the strings.
+type StringCodec struct{}
+
+func (StringCodec) Encode(v string) ([]byte, error) {
+	return []byte(v), nil
+}
+
+func (StringCodec) Decode(data []byte) (string, error) {
+	return string(data), nil
+}
+
+// Stores byte slices as they are.
+type BytesCodec struct{}
+
+func (BytesCodec) Encode(v []byte) ([]byte, error) {
+	return v, nil
+}
+
+func (BytesCodec) Decode(data []byte) ([]byte, error) {
+	return bytes.Clone(data), nil
+}
+
+// Stores signed integers as 8 bytes big endian with the sign bit flipped,
+// so negative numbers sort before positive ones.
+type IntCodec[T signed] struct{}
+
+func (IntCodec[T]) Encode(v T) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, uint64(v)^(1<<63)), nil
+}
+
+func (IntCodec[T]) Decode(data []byte) (T, error) {
+	if len(data) != 8 {
+		return 0, fmt.Errorf("%w: integer has %d bytes", ErrInvalidEncoding, len(data))
+	}
+
+	return T(int64(binary.BigEndian.Uint64(data) ^ (1 << 63))), nil
+}
+
+// Stores unsigned integers as 8 bytes big endian.
+type UintCodec[T unsigned] struct{}
+
+func (UintCodec[T]) Encode(v T) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, uint64(v)), nil
+}
+
+func (UintCodec[T]) Decode(data []byte) (T, error) {
+	if len(data) != 8 {
+		return 0, fmt.Errorf("%w: integer has %d bytes", ErrInvalidEncoding, len(data))
+	}
+
+	return T(binary.BigEndian.Uint64(data)), nil
+}
+
+// Stores values as JSON. Doesn't keep any order, use it for values.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		return v, fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+	}
+
+	return v, nil
+}
+
+// Stores values with encoding/gob. Doesn't keep any order, use it for values.
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (GobCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil {
+		return v, fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+	}
+
+	return v, nil
+}
@@ -0,0 +1,188 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/rettenwander/mellowdb/io"
+)
+
+// A collection is a named B-tree. The DB keeps the root and the sequence of
+// every collection in its catalog, a B-tree that maps collection names to
+// collection records.
+
+const collectionRecordSize = io.PageIDSize + 8
+
+type collectionRecord struct {
+	root     io.PageID
+	sequence uint64
+}
+
+func (r collectionRecord) encode() []byte {
+	buf := make([]byte, collectionRecordSize)
+	binary.LittleEndian.PutUint64(buf, uint64(r.root))
+	binary.LittleEndian.PutUint64(buf[io.PageIDSize:], r.sequence)
+	return buf
+}
+
+func decodeCollectionRecord(buf []byte) (collectionRecord, error) {
+	// Records written before sequences existed only hold the root.
+	if len(buf) != collectionRecordSize && len(buf) != io.PageIDSize {
+		return collectionRecord{}, fmt.Errorf("%w: collection record has %d bytes", ErrCorruptValue, len(buf))
+	}
+
+	record := collectionRecord{root: io.PageID(binary.LittleEndian.Uint64(buf))}
+	if len(buf) == collectionRecordSize {
+		record.sequence = binary.LittleEndian.Uint64(buf[io.PageIDSize:])
+	}
+
+	return record, nil
+}
+
+// Returns the tree of the named collection. The collection is created if it doesn't exist.
+// Names starting with a zero byte are reserved for internal collections.
+//
+// Only the Follower creates the collections of a follower DB, for others a
+// missing collection is an ErrFollowerDB.
+func (e *DB) Collection(name string) (*BTree, error) {
+	if err := checkCollectionName(name); err != nil {
+		return nil, err
+	}
+
+	e.mu.RLock()
+	follower := e.follower
+	e.mu.RUnlock()
+
+	tree, err := e.collection(name, !follower)
+	if follower && errors.Is(err, ErrCollectionNotFound) {
+		return nil, fmt.Errorf("%w: collection %q doesn't exist", ErrFollowerDB, name)
+	}
+
+	return tree, err
+}
+
+// Returns the tree of an existing collection, or ErrCollectionNotFound.
+// Unlike Collection it never writes to the DB.
+func (e *DB) FindCollection(name string) (*BTree, error) {
+	if err := checkCollectionName(name); err != nil {
+		return nil, err
+	}
+
+	return e.collection(name, false)
+}
+
+func checkCollectionName(name string) error {
+	if len(name) == 0 || len(name) > MaxKeySize || isInternalCollection(name) {
+		return ErrInvalidCollectionName
+	}
+
+	return nil
+}
+
+// Opens the collection, a missing one is created if create is set.
+func (e *DB) collection(name string, create bool) (*BTree, error) {
+	e.collectionsMu.Lock()
+	defer e.collectionsMu.Unlock()
+
+	if tree, ok := e.collections[name]; ok {
+		return tree, nil
+	}
+
+	// Commits read the collections with only the lock of the DB held, and
+	// NewBTree reads the options the DB sets under it.
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.loadCollection(name, create)
+}
+
+// Opens a collection that isn't open yet, see collection.
+// The caller must hold the lock of the collections and the lock of the DB.
+func (e *DB) loadCollection(name string, create bool) (*BTree, error) {
+	if len(name) > MaxKeySize {
+		return nil, ErrInvalidCollectionName
+	}
+
+	record := collectionRecord{}
+
+	item, err := e.catalog.find([]byte(name))
+	if err == nil {
+		record, err = decodeCollectionRecord(item.value)
+		if err != nil {
+			return nil, err
+		}
+	} else if err == ErrNotFound {
+		if !create {
+			return nil, fmt.Errorf("%w: %q", ErrCollectionNotFound, name)
+		}
+
+		if e.io.ReadOnly() {
+			return nil, fmt.Errorf("%w: collection %q doesn't exist", ErrReadOnly, name)
+		}
+
+		if err := e.writeCollectionRecord(name, record); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+
+	tree := NewBTree(e, record.root)
+	tree.name = name
+	tree.sequence = record.sequence
+	e.collections[name] = tree
+
+	return tree, nil
+}
+
+func isInternalCollection(name string) bool {
+	return len(name) > 0 && name[0] == 0
+}
+
+// Returns the names of all collections in key order. Internal collections are left out.
+func (e *DB) Collections() ([]string, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	names := []string{}
+
+	err := e.catalog.forEachItem(func(i *Item) error {
+		if !isInternalCollection(string(i.key)) {
+			names = append(names, string(i.key))
+		}
+
+		return nil
+	})
+
+	return names, err
+}
+
+// The caller must hold the lock of the DB.
+func (e *DB) writeCollectionRecord(name string, record collectionRecord) error {
+	item, err := NewItem([]byte(name), record.encode())
+	if err != nil {
+		return err
+	}
+
+	return e.catalog.put(item.key, func(*Item) (*Item, error) {
+		return item, nil
+	})
+}
+
+// Writes the roots and sequences of all open collections to the catalog.
+// The caller must hold the lock of the DB.
+func (e *DB) flushCollections() error {
+	for name, tree := range e.collections {
+		if err := e.writeCollectionRecord(name, tree.record()); err != nil {
+			return err
+		}
+	}
+
+	e.io.RootPageID = e.catalog.Root
+	return nil
+}
+
+func (t *BTree) record() collectionRecord {
+	return collectionRecord{root: t.Root, sequence: t.sequence}
+}
@@ -0,0 +1,114 @@
+package db_test
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/db"
+	"github.com/rettenwander/mellowdb/io"
+)
+
+func TestCollections(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	dbEngine, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"users", "orders"}
+	for _, name := range names {
+		tree, err := dbEngine.Collection(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range 5000 {
+			key := []byte(strconv.Itoa(i))
+			item, _ := db.NewItem(key, []byte(name))
+			if err := tree.Insert(item); err != nil {
+				t.Fatalf("Error inserting %d, %v", i, err)
+			}
+		}
+	}
+
+	if _, err := dbEngine.Collection(""); !errors.Is(err, db.ErrInvalidCollectionName) {
+		t.Fatalf("Expected ErrInvalidCollectionName, got %v", err)
+	}
+
+	if _, err := dbEngine.Collection(strings.Repeat("x", db.MaxKeySize+1)); !errors.Is(err, db.ErrInvalidCollectionName) {
+		t.Fatalf("Expected ErrInvalidCollectionName, got %v", err)
+	}
+
+	if err := dbEngine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dbEngine, err = db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	collections, err := dbEngine.Collections()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(collections, []string{"orders", "users"}) {
+		t.Fatalf("Unexpected collections: %v", collections)
+	}
+
+	for _, name := range names {
+		tree, err := dbEngine.Collection(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range 5000 {
+			key := []byte(strconv.Itoa(i))
+			item, err := tree.Find(key)
+			if err != nil {
+				t.Fatalf("Inserted key not found %d, %v", i, err)
+			}
+
+			if string(item.Value()) != name {
+				t.Fatalf("Key %s has value of another collection: %s", key, item.Value())
+			}
+		}
+	}
+}
+
+func TestFindCollection(t *testing.T) {
+	dbEngine, err := db.NewDBWithStorage(io.NewMemoryStorage(nil), io.EngineOptions{PageSize: io.MetadataPageSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	if _, err := dbEngine.FindCollection("users"); !errors.Is(err, db.ErrCollectionNotFound) {
+		t.Fatalf("Expected ErrCollectionNotFound, got %v", err)
+	}
+
+	collections, err := dbEngine.Collections()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(collections) != 0 {
+		t.Fatalf("Expected FindCollection not to create the collection, got %v", collections)
+	}
+
+	created, err := dbEngine.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found, err := dbEngine.FindCollection("users"); err != nil || found != created {
+		t.Fatalf("Expected the open collection, got %v", err)
+	}
+}
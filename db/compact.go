@@ -0,0 +1,119 @@
+package db
+
+import (
+	"context"
+
+	"github.com/rettenwander/mellowdb/io"
+)
+
+// Rewrites every tree of the DB into the lowest free pages and cuts the
+// pages freed at the end off the file. The trees are rebuilt with the bulk
+// loader, so their nodes are filled up as well.
+//
+// Compact commits and holds the lock of the DB while it runs.
+func (e *DB) Compact() error {
+	return e.CompactContext(context.Background())
+}
+
+// Like Compact, but stops with the error of ctx once it is done, between page
+// reads. The trees rewritten before are kept, the others are left as they were.
+func (e *DB) CompactContext(ctx context.Context) error {
+	if e.io.ReadOnly() {
+		return ErrReadOnly
+	}
+
+	e.collectionsMu.Lock()
+	defer e.collectionsMu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Pages freed before are only reused once they are committed. Every
+	// commit appends the pages it released, so they are sorted again.
+	commit := func() error {
+		if err := e.commit(); err != nil {
+			return err
+		}
+
+		e.io.SortReleasedPages()
+		return nil
+	}
+
+	if err := commit(); err != nil {
+		return err
+	}
+
+	names := []string{}
+	err := e.catalog.forEachItem(func(i *Item) error {
+		names = append(names, string(i.key))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		tree, ok := e.collections[name]
+		if !ok {
+			if tree, err = e.loadCollection(name, false); err != nil {
+				return err
+			}
+		}
+
+		if err := e.atomically(func() error { return tree.compact(ctx) }); err != nil {
+			return err
+		}
+	}
+
+	// The catalog gets the new roots first.
+	if err := commit(); err != nil {
+		return err
+	}
+
+	if err := e.atomically(func() error { return e.catalog.compact(ctx) }); err != nil {
+		return err
+	}
+
+	if err := commit(); err != nil {
+		return err
+	}
+
+	return e.io.Shrink()
+}
+
+// Rebuilds the tree from its items. The caller must hold the lock of the tree.
+func (t *BTree) compact(ctx context.Context) error {
+	view, _ := t.withContext(ctx)
+
+	old := []io.PageID{}
+	err := view.walk(func(n *Node, depth int) error {
+		old = append(old, n.pageId)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The copy has no indexes, so the loader always builds bottom-up.
+	c := *view
+	c.Root = 0
+	c.indexes = nil
+
+	loader := c.newBulkLoader()
+	err = view.forEachItem(func(i *Item) error {
+		return loader.push(0, i, 0)
+	})
+	if err == nil {
+		err = loader.finish()
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, id := range old {
+		t.FreeNode(id)
+	}
+
+	t.Root = c.Root
+	return nil
+}
@@ -0,0 +1,141 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/db"
+)
+
+func fileSize(t *testing.T, file string) int64 {
+	t.Helper()
+
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return info.Size()
+}
+
+// Fills two collections and deletes most of their keys.
+func newCompactTestDB(t *testing.T, file string) *db.DB {
+	dbEngine, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a", "b"} {
+		tree, err := dbEngine.Collection(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range 3000 {
+			item, _ := db.NewItem(fmt.Appendf(nil, "key-%04d", i), fmt.Appendf(nil, "value-%04d", i))
+			if err := tree.Insert(item); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for i := range 3000 {
+			if i%10 == 0 {
+				continue
+			}
+
+			if err := tree.Delete(fmt.Appendf(nil, "key-%04d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := dbEngine.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	return dbEngine
+}
+
+func verifyCompacted(t *testing.T, dbEngine *db.DB) {
+	t.Helper()
+
+	for _, name := range []string{"a", "b"} {
+		tree, err := dbEngine.Collection(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range 3000 {
+			item, err := tree.Find(fmt.Appendf(nil, "key-%04d", i))
+			if i%10 != 0 {
+				if !errors.Is(err, db.ErrNotFound) {
+					t.Fatalf("Expected key %d of %s to be deleted, got %v", i, name, err)
+				}
+				continue
+			}
+
+			if err != nil || string(item.Value()) != fmt.Sprintf("value-%04d", i) {
+				t.Fatalf("Unexpected key %d of %s: %v, %v", i, name, item, err)
+			}
+		}
+	}
+
+	if problems := dbEngine.Check(); len(problems) != 0 {
+		t.Fatalf("Unexpected problems: %v", problems)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+	dbEngine := newCompactTestDB(t, file)
+	defer func() { dbEngine.Close() }()
+
+	before := fileSize(t, file)
+
+	if err := dbEngine.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	after := fileSize(t, file)
+	if after >= before/2 {
+		t.Fatalf("Expected the file to shrink from %d bytes to less than half, got %d", before, after)
+	}
+
+	verifyCompacted(t, dbEngine)
+
+	if err := dbEngine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dbEngine, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifyCompacted(t, dbEngine)
+}
+
+func TestCompactCancelled(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+	dbEngine := newCompactTestDB(t, file)
+	defer dbEngine.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := dbEngine.CompactContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	verifyCompacted(t, dbEngine)
+
+	if err := dbEngine.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	verifyCompacted(t, dbEngine)
+}
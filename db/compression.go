@@ -0,0 +1,103 @@
+package db
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	stdio "io"
+)
+
+// CompressionOptions controls the transparent compression of values.
+// The zero value disables compression.
+type CompressionOptions struct {
+	// Values of at least Threshold bytes are compressed. Zero disables compression.
+	Threshold int
+	// Level is passed to compress/flate. Zero uses flate.DefaultCompression.
+	Level int
+}
+
+func (o CompressionOptions) enabled() bool {
+	return o.Threshold > 0
+}
+
+func (o CompressionOptions) level() int {
+	if o.Level == 0 {
+		return flate.DefaultCompression
+	}
+
+	return o.Level
+}
+
+// CompressionStats reports how much space compression saved in a tree.
+type CompressionStats struct {
+	Items           int
+	CompressedItems int
+
+	// Size of all values before compression.
+	RawValueBytes int
+	// Size of all values as they are stored in the nodes.
+	StoredValueBytes int
+}
+
+func (s CompressionStats) SavedBytes() int {
+	return s.RawValueBytes - s.StoredValueBytes
+}
+
+// Returns a compressed copy of the item, or the item itself if compression
+// is disabled, the value is below the threshold or compressing doesn't pay off.
+func compressItem(i *Item, options CompressionOptions) (*Item, error) {
+	if !options.enabled() || i.isCompressed() || len(i.value) < options.Threshold {
+		return i, nil
+	}
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, options.level())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(i.value); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	if buf.Len() >= len(i.value) {
+		return i, nil
+	}
+
+	compressed := *i
+	compressed.value = buf.Bytes()
+	compressed.flags |= itemFlagCompressed
+	return &compressed, nil
+}
+
+// Returns a copy of the item with the value decompressed.
+func decompressItem(i *Item) (*Item, error) {
+	if !i.isCompressed() {
+		return i, nil
+	}
+
+	r := flate.NewReader(bytes.NewReader(i.value))
+	defer r.Close()
+
+	var buf bytes.Buffer
+	buf.Grow(MaxValueSize)
+
+	// Never inflate more than a valid value can hold.
+	n, err := buf.ReadFrom(stdio.LimitReader(r, MaxValueSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptValue, err)
+	}
+
+	if n > MaxValueSize {
+		return nil, fmt.Errorf("%w: decompressed value exceeds %d bytes", ErrCorruptValue, MaxValueSize)
+	}
+
+	decompressed := *i
+	decompressed.value = buf.Bytes()
+	decompressed.flags &^= itemFlagCompressed
+	return &decompressed, nil
+}
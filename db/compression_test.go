@@ -0,0 +1,163 @@
+package db_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/db"
+	"github.com/rettenwander/mellowdb/io"
+)
+
+func TestCompression(t *testing.T) {
+	reader := &NodeReaderMOCK{
+		nodes:       make(map[int64]db.Node),
+		MaxNodeSize: 4096,
+	}
+
+	tree := db.NewBTree(reader, 0)
+	tree.Compression = db.CompressionOptions{Threshold: 32}
+
+	longValue := bytes.Repeat([]byte("mellow "), 16)
+	shortValue := []byte("short")
+
+	for i := range 20 {
+		key := []byte(strconv.Itoa(i))
+		value := shortValue
+		if i%2 == 0 {
+			value = longValue
+		}
+
+		item, _ := db.NewItem(key, value)
+		if err := tree.Insert(item); err != nil {
+			t.Fatalf("Error inserting %d, %v", i, err)
+		}
+	}
+
+	for i := range 20 {
+		key := []byte(strconv.Itoa(i))
+		expected := shortValue
+		if i%2 == 0 {
+			expected = longValue
+		}
+
+		item, err := tree.Find(key)
+		if err != nil {
+			t.Fatalf("Key %s not found: %v", key, err)
+		}
+
+		if !bytes.Equal(item.Value(), expected) {
+			t.Fatalf("Value of %s is %q, expected %q", key, item.Value(), expected)
+		}
+	}
+
+	stats, err := tree.CompressionStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Items != 20 || stats.CompressedItems != 10 {
+		t.Fatalf("Unexpected item counts: %+v", stats)
+	}
+
+	if stats.RawValueBytes != 10*len(longValue)+10*len(shortValue) {
+		t.Fatalf("Unexpected raw value size: %+v", stats)
+	}
+
+	if stats.SavedBytes() <= 0 {
+		t.Fatalf("Compression saved no space: %+v", stats)
+	}
+}
+
+func TestCompressionUsingDB(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	dbEngine, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbEngine.SetCompression(db.CompressionOptions{Threshold: 16})
+
+	tree, err := dbEngine.Collection("texts")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 1000 {
+		key := []byte(strconv.Itoa(i))
+		value := append(bytes.Repeat([]byte("mellow "), 16), key...)
+		item, _ := db.NewItem(key, value)
+
+		if err := tree.Insert(item); err != nil {
+			t.Fatalf("Error inserting %d, %v", i, err)
+		}
+	}
+
+	if err := dbEngine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading compressed values doesn't need compression to be enabled.
+	dbEngine, err = db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	tree, err = dbEngine.Collection("texts")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 1000 {
+		key := []byte(strconv.Itoa(i))
+		item, err := tree.Find(key)
+		if err != nil {
+			t.Fatalf("Inserted key not found %d, %v", i, err)
+		}
+
+		if !bytes.Equal(item.Value(), append(bytes.Repeat([]byte("mellow "), 16), key...)) {
+			t.Fatalf("Value of %s doesn't match", key)
+		}
+	}
+
+	stats, err := tree.CompressionStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.CompressedItems != 1000 || stats.SavedBytes() <= 0 {
+		t.Fatalf("Values are not stored compressed: %+v", stats)
+	}
+}
+
+func TestSetCompressionOnOpenCollection(t *testing.T) {
+	dbEngine, err := db.NewDBWithStorage(io.NewMemoryStorage(nil), io.EngineOptions{PageSize: io.MetadataPageSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	tree, err := dbEngine.Collection("texts")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbEngine.SetCompression(db.CompressionOptions{Threshold: 16})
+
+	item, _ := db.NewItem([]byte("text"), bytes.Repeat([]byte("mellow "), 16))
+	if err := tree.Insert(item); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := tree.CompressionStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.CompressedItems != 1 {
+		t.Fatalf("Expected the open collection to compress, got %+v", stats)
+	}
+}
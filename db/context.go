@@ -0,0 +1,36 @@
+package db
+
+import (
+	"context"
+
+	"github.com/rettenwander/mellowdb/io"
+)
+
+// Fails page reads once the context is done. A write stops checking once it
+// starts changing pages, so a cancelled write is either abandoned before it
+// changed anything or completed.
+type contextReader struct {
+	NodeReader
+	ctx     context.Context
+	writing bool
+}
+
+func (r *contextReader) ReadNode(id io.PageID) (*Node, error) {
+	if !r.writing {
+		if err := r.ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return r.NodeReader.ReadNode(id)
+}
+
+// Returns a copy of the tree that reads its pages through r. The copy shares
+// the lock and the pages with t; a changed root must be copied back.
+func (t *BTree) withContext(ctx context.Context) (*BTree, *contextReader) {
+	r := &contextReader{NodeReader: t.NodeReader, ctx: ctx}
+
+	view := *t
+	view.NodeReader = r
+	return &view, r
+}
@@ -0,0 +1,128 @@
+package db_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/db"
+)
+
+func newContextTestTree(t *testing.T) (*db.DB, *db.BTree) {
+	dbEngine, err := db.NewDB(filepath.Join(t.TempDir(), "test.mellow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbEngine.Close() })
+
+	tree, err := dbEngine.Collection("items")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 2000 {
+		item, _ := db.NewItem(fmt.Appendf(nil, "key-%04d", i), []byte("value"))
+		if err := tree.Insert(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dbEngine, tree
+}
+
+func TestContextCancelledReads(t *testing.T) {
+	_, tree := newContextTestTree(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if _, err := tree.FindContext(ctx, []byte("key-0001")); err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	err := tree.ScanContext(ctx, nil, nil, func(i *db.Item) bool {
+		count++
+		if count == 10 {
+			cancel()
+		}
+		return true
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	if count != 10 {
+		t.Fatalf("Expected the scan to stop after 10 items, got %d", count)
+	}
+
+	if _, err := tree.FindContext(ctx, []byte("key-0001")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestContextCancelledInsert(t *testing.T) {
+	dbEngine, tree := newContextTestTree(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	item, _ := db.NewItem([]byte("key-0000"), []byte("changed"))
+	if err := tree.InsertContext(ctx, item); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	stored, err := tree.Find([]byte("key-0000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(stored.Value(), []byte("value")) {
+		t.Fatalf("Expected the cancelled insert to change nothing, got %q", stored.Value())
+	}
+
+	// Inserts that split nodes still work with a live context.
+	for i := 2000; i < 3000; i++ {
+		item, _ := db.NewItem(fmt.Appendf(nil, "key-%04d", i), []byte("value"))
+		if err := tree.InsertContext(context.Background(), item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if problems := dbEngine.Check(); len(problems) != 0 {
+		t.Fatalf("Unexpected problems: %v", problems)
+	}
+}
+
+func TestContextCancelledImport(t *testing.T) {
+	source, _ := newContextTestTree(t)
+
+	var buf bytes.Buffer
+	if err := source.Export(&buf, db.ExportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := source.ExportContext(ctx, &bytes.Buffer{}, db.ExportOptions{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	target, err := db.NewDB(filepath.Join(t.TempDir(), "target.mellow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	count, err := target.ImportContext(ctx, &buf)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	if count != 0 {
+		t.Fatalf("Expected no imported items, got %d", count)
+	}
+}
@@ -0,0 +1,183 @@
+package db_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/db"
+	"github.com/rettenwander/mellowdb/io"
+	"github.com/rettenwander/mellowdb/io/faultstorage"
+)
+
+// Inserts and deletes against a reference map while the storage fails. After
+// every crash the DB is reopened and has to hold exactly the data of the last
+// successful sync. An insert or delete that fails without a crash has to leave
+// the DB as it was.
+//
+// The storage either keeps the writes since the last sync when it crashes,
+// like a disk that flushed its cache before the power went out, or drops them.
+func TestCrashConsistency(t *testing.T) {
+	for _, dropUnsynced := range []bool{false, true} {
+		t.Run(fmt.Sprintf("DropUnsynced=%v", dropUnsynced), func(t *testing.T) {
+			for seed := range uint64(16) {
+				t.Run(fmt.Sprint(seed), func(t *testing.T) {
+					runCrashHarness(t, seed, dropUnsynced)
+				})
+			}
+		})
+	}
+}
+
+func runCrashHarness(t *testing.T, seed uint64, dropUnsynced bool) {
+	rnd := rand.New(rand.NewPCG(seed, 7))
+	options := io.EngineOptions{PageSize: io.MetadataPageSize}
+
+	storage, err := faultstorage.New(io.NewMemoryStorage(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.DropUnsynced = dropUnsynced
+
+	var dbEngine *db.DB
+	var tree *db.BTree
+	open := func() {
+		if dbEngine, err = db.NewDBWithStorage(storage, options); err != nil {
+			t.Fatalf("Failed to reopen: %v", err)
+		}
+
+		if tree, err = dbEngine.Collection("data"); err != nil {
+			t.Fatalf("Failed to open the collection: %v", err)
+		}
+	}
+
+	current := map[string][]byte{}
+	durable := map[string][]byte{}
+	crashes := 0
+
+	// A sync that fails may have committed before the storage crashed, so
+	// the state it tried to commit is accepted as well.
+	crash := func(op int, reason string, committing map[string][]byte) {
+		crashes++
+		if err := storage.Crash(); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Restart(); err != nil {
+			t.Fatal(err)
+		}
+
+		open()
+		durable = verifyCrashHarness(t, dbEngine, tree, fmt.Sprintf("op %d, after %s", op, reason), durable, committing)
+		current = maps.Clone(durable)
+	}
+
+	unchanged := func(op int, what string, key string) {
+		value, ok := current[key]
+		stored, err := tree.Find([]byte(key))
+		if ok && (err != nil || !bytes.Equal(stored.Value(), value)) || !ok && !errors.Is(err, db.ErrNotFound) {
+			t.Fatalf("op %d: failed %s changed %s", op, what, key)
+		}
+
+		if problems := dbEngine.Check(); len(problems) != 0 {
+			t.Fatalf("op %d: failed %s left problems: %v", op, what, problems)
+		}
+	}
+
+	open()
+
+	faults := []faultstorage.Fault{faultstorage.FailWrite, faultstorage.TearWrite, faultstorage.NoSpace, faultstorage.Crash}
+	for op := range 3000 {
+		if rnd.IntN(40) == 0 {
+			storage.Schedule(1+rnd.IntN(30), faults[rnd.IntN(len(faults))])
+		}
+
+		key := fmt.Sprintf("key-%03d", rnd.IntN(400))
+		switch r := rnd.IntN(100); {
+		case r < 60:
+			value := make([]byte, rnd.IntN(120))
+			for i := range value {
+				value[i] = byte(rnd.IntN(256))
+			}
+
+			item, _ := db.NewItem([]byte(key), value)
+			err := tree.Insert(item)
+			if err == nil {
+				current[key] = value
+			} else if storage.Crashed() {
+				crash(op, "insert", nil)
+			} else {
+				unchanged(op, "insert", key)
+			}
+		case r < 90:
+			err := tree.Delete([]byte(key))
+			if err == nil {
+				delete(current, key)
+			} else if storage.Crashed() {
+				crash(op, "delete", nil)
+			} else {
+				unchanged(op, "delete", key)
+			}
+		case r < 97:
+			if err := dbEngine.Sync(); err != nil {
+				crash(op, "sync", current)
+			} else {
+				durable = maps.Clone(current)
+			}
+		default:
+			crash(op, "power loss", nil)
+		}
+	}
+
+	storage.ClearSchedule()
+	if err := dbEngine.Close(); err != nil {
+		t.Fatal(err)
+	}
+	durable = current
+
+	open()
+	verifyCrashHarness(t, dbEngine, tree, "final close", durable, nil)
+
+	if crashes == 0 {
+		t.Fatal("Expected the harness to crash at least once")
+	}
+}
+
+// Returns the expected state the DB holds, committing is nil if only expected is allowed.
+func verifyCrashHarness(t *testing.T, dbEngine *db.DB, tree *db.BTree, when string, expected, committing map[string][]byte) map[string][]byte {
+	t.Helper()
+
+	if problems := dbEngine.Check(); len(problems) != 0 {
+		t.Fatalf("%s: unexpected problems: %v", when, problems)
+	}
+
+	stored := map[string][]byte{}
+	err := tree.Scan(nil, nil, func(i *db.Item) bool {
+		stored[string(i.Key())] = bytes.Clone(i.Value())
+		return true
+	})
+	if err != nil {
+		t.Fatalf("%s: scan failed: %v", when, err)
+	}
+
+	if maps.EqualFunc(stored, expected, bytes.Equal) {
+		return expected
+	}
+
+	if committing != nil && maps.EqualFunc(stored, committing, bytes.Equal) {
+		return maps.Clone(committing)
+	}
+
+	for key, value := range stored {
+		if expected, ok := expected[key]; !ok {
+			t.Fatalf("%s: unexpected key %s", when, key)
+		} else if !bytes.Equal(value, expected) {
+			t.Fatalf("%s: wrong value for %s", when, key)
+		}
+	}
+
+	t.Fatalf("%s: expected %d keys, got %d", when, len(expected), len(stored))
+	return nil
+}
@@ -1,31 +1,168 @@
 package db
 
 import (
-	"os"
+	"sync"
+	"sync/atomic"
 
 	"github.com/rettenwander/mellowdb/io"
 )
 
 type DB struct {
-	io *io.Engine
+	io      *io.Engine
+	options Options
+
+	// Guards the trees of the DB and the io engine.
+	mu sync.RWMutex
+
+	catalog       *BTree
+	collections   map[string]*BTree
+	collectionsMu sync.Mutex
+
+	compression   CompressionOptions
+	mergeOperator MergeOperator
+
+	sweeper  *sweeper
+	watchers watchers
+
+	// Set once a Follower applies commits to the DB, only it may write the
+	// collections then. Applying is set while it writes. Both are guarded by mu.
+	follower bool
+	applying bool
+
+	// Set while writes run that are applied together or not at all. Guarded by mu.
+	undo *undoLog
+
+	splits atomic.Uint64
 }
 
 func NewDB(fileName string) (*DB, error) {
-	options := io.EngineOptions{
-		PageSize: uint32(os.Getpagesize()),
-		FileName: fileName,
-	}
+	return NewDBWithOptions(fileName, Options{})
+}
 
+// Opens a DB with the options of the io engine and the default Options.
+func NewDBWithEngineOptions(options io.EngineOptions) (*DB, error) {
 	ioEngine, err := io.NewEngine(options)
 	if err != nil {
 		return nil, err
 	}
 
-	return &DB{io: ioEngine}, nil
+	return newDB(ioEngine, Options{})
+}
+
+// Opens a DB on storage instead of a file, see io.NewEngineWithStorage.
+// It uses the default Options, NewDBWithStorageAndOptions takes them.
+func NewDBWithStorage(storage io.Storage, options io.EngineOptions) (*DB, error) {
+	ioEngine, err := io.NewEngineWithStorage(storage, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDB(ioEngine, Options{})
+}
+
+// Closes the engine if the options can't be used with it.
+func newDB(ioEngine *io.Engine, options Options) (*DB, error) {
+	db := &DB{io: ioEngine, collections: make(map[string]*BTree)}
+
+	if err := db.applyLimits(options.withDefaults()); err != nil {
+		ioEngine.Close()
+		return nil, err
+	}
+
+	db.catalog = NewBTree(db, ioEngine.RootPageID)
+	if err := db.loadFollower(); err != nil {
+		ioEngine.Close()
+		return nil, err
+	}
+
+	return db, nil
 }
 
 func (e *DB) Close() error {
-	return e.io.Close()
+	e.StopExpirySweeper()
+
+	defer e.closeWatchers()
+
+	if e.io.ReadOnly() {
+		return e.io.Close()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.flushCollections(); err != nil {
+		e.io.Close()
+		return err
+	}
+
+	e.io.CommitSequence++
+	if err := e.io.Close(); err != nil {
+		return err
+	}
+
+	e.publishChanges(e.io.CommitSequence)
+	return nil
+}
+
+// Writes the roots of all collections and the metadata, and flushes the DB file to stable storage.
+// Returns ErrReadOnly if the DB is read-only.
+func (e *DB) Sync() error {
+	if e.io.ReadOnly() {
+		return ErrReadOnly
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.commit()
+}
+
+// Writes the roots of all collections and commits them with the changes
+// written so far. Flush and commit happen under the same lock, so no write
+// can slip in between. The caller must hold the lock of the DB.
+func (e *DB) commit() error {
+	if err := e.flushCollections(); err != nil {
+		return err
+	}
+
+	e.io.CommitSequence++
+	if err := e.syncMetadata(); err != nil {
+		return err
+	}
+
+	e.publishChanges(e.io.CommitSequence)
+	return nil
+}
+
+// Reports if the DB was opened with the ReadOnly option.
+func (e *DB) ReadOnly() bool {
+	return e.io.ReadOnly()
+}
+
+// Returns the sequence of the last commit. Commits happen on Sync and Close.
+func (e *DB) CommitSequence() uint64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.io.CommitSequence
+}
+
+// The caller must hold the lock of the DB.
+func (e *DB) syncMetadata() error {
+	e.io.RootPageID = e.catalog.Root
+	return e.io.Sync()
+}
+
+// Sets the compression options of all collections, the open ones and the ones
+// opened afterwards. Values already stored are left as they are.
+func (e *DB) SetCompression(options CompressionOptions) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.compression = options
+	for _, tree := range e.collections {
+		tree.Compression = options
+	}
 }
 
 func (e *DB) ReadNode(id io.PageID) (*Node, error) {
@@ -35,7 +172,9 @@ func (e *DB) ReadNode(id io.PageID) (*Node, error) {
 	}
 
 	node := NewEmptyNode(id)
-	node.ReadFromBuffer(page.Data)
+	if err := node.ReadFromBuffer(page.Data); err != nil {
+		return nil, err
+	}
 
 	return node, nil
 }
@@ -48,11 +187,40 @@ func (e *DB) WriteNode(n *Node) error {
 }
 
 func (e *DB) GetNewNode() *Node {
-	return NewEmptyNode(e.io.GetNextFreePageID())
+	id := e.io.GetNextFreePageID()
+	if e.undo != nil {
+		e.undo.allocated[id] = true
+	}
+
+	return NewEmptyNode(id)
+}
+
+func (e *DB) FreeNode(id io.PageID) {
+	if e.undo != nil {
+		e.undo.freed = append(e.undo.freed, id)
+		return
+	}
+
+	e.io.MarkPageAsFree(id)
 }
 
 func (e *DB) GetMaxNodeSize() int {
-	return int(e.io.PageSize)
+	return e.io.PageDataSize()
 }
 
-func (e *DB) GetColleactions() {}
+// Commits the pending writes and re-encrypts the DB file with newKey. No write
+// runs during the rotation. See io.Engine.RotateKey.
+func (e *DB) RotateKey(newKey []byte) error {
+	if e.io.ReadOnly() {
+		return ErrReadOnly
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.commit(); err != nil {
+		return err
+	}
+
+	return e.io.RotateKey(newKey)
+}
@@ -1,12 +1,16 @@
 package db_test
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
 	"strconv"
 	"testing"
 
 	"github.com/rettenwander/mellowdb/db"
+	"github.com/rettenwander/mellowdb/io"
 )
 
 func TestInsertUsingDB(t *testing.T) {
@@ -54,3 +58,209 @@ func TestInsertUsingDB(t *testing.T) {
 	dbEngine.Close()
 
 }
+
+func TestEncryptedDB(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+	options := io.EngineOptions{
+		PageSize:      uint32(os.Getpagesize()),
+		FileName:      file,
+		EncryptionKey: bytes.Repeat([]byte{7}, io.EncryptionKeySize),
+	}
+
+	dbEngine, err := db.NewDBWithEngineOptions(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := dbEngine.Collection("secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 5000 {
+		key := []byte(strconv.Itoa(i))
+		value := append([]byte("Value "), key...)
+		item, _ := db.NewItem(key, value)
+
+		if err := tree.Insert(item); err != nil {
+			t.Fatalf("Error inserting %d, %v", i, err)
+		}
+	}
+
+	newKey := bytes.Repeat([]byte{8}, io.EncryptionKeySize)
+	if err := dbEngine.RotateKey(newKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dbEngine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.NewDBWithEngineOptions(options); !errors.Is(err, io.ErrBadKey) {
+		t.Fatalf("Expected ErrBadKey, got %v", err)
+	}
+
+	options.EncryptionKey = newKey
+	dbEngine, err = db.NewDBWithEngineOptions(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	tree, err = dbEngine.Collection("secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 5000 {
+		key := []byte(strconv.Itoa(i))
+		if _, err := tree.Find(key); err != nil {
+			t.Fatalf("Inserted key not found %d, %v", i, err)
+		}
+	}
+}
+
+func TestDBWithMemoryStorage(t *testing.T) {
+	options := io.EngineOptions{PageSize: io.MetadataPageSize}
+	storage := io.NewMemoryStorage(nil)
+
+	dbEngine, err := db.NewDBWithStorage(storage, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := dbEngine.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 1000 {
+		key := []byte(strconv.Itoa(i))
+		item, _ := db.NewItem(key, append([]byte("Value "), key...))
+		if err := users.Insert(item); err != nil {
+			t.Fatalf("Error inserting %d, %v", i, err)
+		}
+	}
+
+	if err := dbEngine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dbEngine, err = db.NewDBWithStorage(io.NewMemoryStorage(storage.Bytes()), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	users, err = dbEngine.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := users.Find([]byte("999"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(item.Value()) != "Value 999" {
+		t.Fatalf("Expected 'Value 999', got %q", item.Value())
+	}
+}
+
+func TestReopenAfterDeletingLargeTree(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	dbEngine, err := db.NewDBWithOptions(file, db.Options{PageSize: io.MetadataPageSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := dbEngine.Collection("data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := range 20000 {
+		item, _ := db.NewItem([]byte(fmt.Sprintf("key-%05d", i)), value)
+		if err := tree.Insert(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := range 20000 {
+		if err := tree.Delete([]byte(fmt.Sprintf("key-%05d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := dbEngine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dbEngine, err = db.NewDBWithOptions(file, db.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	if problems := dbEngine.Check(); len(problems) != 0 {
+		t.Fatalf("Check found problems: %v", problems)
+	}
+
+	stats, err := dbEngine.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.FreePages < 1000 {
+		t.Fatalf("Expected the free pages of the deleted tree, got %d", stats.FreePages)
+	}
+}
+
+// The writes before a rotation are committed under the new key, without Close.
+func TestRotateKeyCommitsWrites(t *testing.T) {
+	storage := io.NewMemoryStorage(nil)
+	options := io.EngineOptions{
+		PageSize:      io.MetadataPageSize,
+		EncryptionKey: bytes.Repeat([]byte{7}, io.EncryptionKeySize),
+	}
+
+	dbEngine, err := db.NewDBWithStorage(storage, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := dbEngine.Collection("secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 500 {
+		key := []byte(strconv.Itoa(i))
+		item, _ := db.NewItem(key, append([]byte("Value "), key...))
+		if err := tree.Insert(item); err != nil {
+			t.Fatalf("Error inserting %d, %v", i, err)
+		}
+	}
+
+	options.EncryptionKey = bytes.Repeat([]byte{8}, io.EncryptionKeySize)
+	if err := dbEngine.RotateKey(options.EncryptionKey); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := db.NewDBWithStorage(storage, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tree, err = reopened.FindCollection("secrets"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 500 {
+		if _, err := tree.Find([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("Key %d written before the rotation not found: %v", i, err)
+		}
+	}
+}
@@ -3,11 +3,43 @@ package db
 import (
 	"errors"
 	"fmt"
+
+	"github.com/rettenwander/mellowdb/io"
 )
 
 var (
 	ErrKeyTooLong   = errors.New(fmt.Sprintf("Key exceeds maximum allowed length of %d bytes", MaxKeySize))
 	ErrValueTooLong = errors.New(fmt.Sprintf("Value exceeds maximum allowed length of %d bytes", MaxValueSize))
 
-	ErrNotFound = errors.New("Key not found")
+	ErrInvalidOptions = errors.New("Invalid DB options")
+	ErrReadOnly       = io.ErrReadOnly
+
+	ErrNotFound      = errors.New("Key not found")
+	ErrKeyExists     = errors.New("Key already exists")
+	ErrValueMismatch = errors.New("Value doesn't match the expected value")
+
+	ErrCorruptValue    = errors.New("Stored value is corrupt")
+	ErrCorruptNode     = errors.New("Stored node is corrupt")
+	ErrInvalidEncoding = errors.New("Stored bytes can't be decoded")
+
+	ErrInvalidCollectionName = errors.New(fmt.Sprintf("Collection name must be between 1 and %d bytes", MaxKeySize))
+	ErrCollectionNotFound    = errors.New("Collection not found")
+	ErrNotACollection        = errors.New("Tree is not a collection of a DB")
+
+	ErrNoMergeOperator = errors.New("No merge operator is set")
+	ErrInvalidOperand  = errors.New("Invalid merge operand")
+	ErrInvalidCap      = errors.New(fmt.Sprintf("Cap must be between 1 and %d bytes", MaxValueSize))
+
+	ErrInvalidIndex  = errors.New("Index needs a unique name and a function")
+	ErrIndexNotFound = errors.New("Index not found")
+	ErrIndexConflict = errors.New("Index key is already used by another item")
+
+	ErrUnknownFormat = errors.New("Unknown visualize format")
+	ErrInvalidImport = errors.New("Invalid import line")
+
+	ErrTxDone = errors.New("Transaction is already done")
+
+	ErrReplication = errors.New("Replication failed")
+	// A follower DB is read-only for everyone but the Follower.
+	ErrFollowerDB = fmt.Errorf("%w: only the replication follower writes to the DB", ErrReadOnly)
 )
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"sync"
+	"time"
+)
+
+// Number of expired items deleted while holding the lock.
+// Writers get a chance to run between batches.
+const purgeBatchSize = 64
+
+// Deletes the expired items of all collections. Returns the number of deleted items.
+func (e *DB) PurgeExpired() (int, error) {
+	names, err := e.Collections()
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, name := range names {
+		tree, err := e.Collection(name)
+		if err != nil {
+			return purged, err
+		}
+
+		n, err := tree.PurgeExpired()
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+	}
+
+	return purged, nil
+}
+
+// Deletes the expired items of the tree in small batches. Returns the number of deleted items.
+func (t *BTree) PurgeExpired() (int, error) {
+	purged, err := t.purgeExpired()
+	if purged > 0 && t.db != nil {
+		if syncErr := t.db.syncAlways(); err == nil {
+			err = syncErr
+		}
+	}
+
+	return purged, err
+}
+
+func (t *BTree) purgeExpired() (int, error) {
+	purged := 0
+
+	var start []byte
+	for {
+		now := time.Now()
+		keys := make([][]byte, 0, purgeBatchSize)
+
+		t.rlock()
+		err := t.scan(start, nil, func(i *Item) (bool, error) {
+			if i.isExpired(now) {
+				keys = append(keys, append([]byte(nil), i.key...))
+			}
+
+			return len(keys) < purgeBatchSize, nil
+		})
+		t.runlock()
+
+		if err != nil || len(keys) == 0 {
+			return purged, err
+		}
+
+		t.lock()
+		for _, key := range keys {
+			// The item could have been overwritten since the scan.
+			deleted, err := t.delete(key, func(i *Item) bool { return i.isExpired(now) })
+			if err != nil {
+				t.unlock()
+				return purged, err
+			}
+
+			if deleted {
+				purged++
+			}
+		}
+		t.unlock()
+
+		if len(keys) < purgeBatchSize {
+			return purged, nil
+		}
+
+		start = keys[len(keys)-1]
+	}
+}
+
+type sweeper struct {
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// Starts a goroutine that calls PurgeExpired every interval until
+// StopExpirySweeper or Close is called. A running sweeper is replaced.
+// Errors are ignored, the next run tries again.
+func (e *DB) StartExpirySweeper(interval time.Duration) {
+	e.StopExpirySweeper()
+
+	s := &sweeper{stop: make(chan struct{})}
+	s.done.Add(1)
+
+	go func() {
+		defer s.done.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				e.PurgeExpired()
+			}
+		}
+	}()
+
+	e.sweeper = s
+}
+
+// Stops the sweeper started by StartExpirySweeper and waits for it to finish.
+func (e *DB) StopExpirySweeper() {
+	if e.sweeper == nil {
+		return
+	}
+
+	close(e.sweeper.stop)
+	e.sweeper.done.Wait()
+	e.sweeper = nil
+}
@@ -0,0 +1,154 @@
+package db_test
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rettenwander/mellowdb/db"
+)
+
+func TestExpiringItems(t *testing.T) {
+	reader := &NodeReaderMOCK{
+		nodes:       make(map[int64]db.Node),
+		MaxNodeSize: 4096,
+	}
+
+	tree := db.NewBTree(reader, 0)
+	expiresAt := time.Now().Add(time.Hour).Truncate(0)
+
+	live, _ := db.NewItemWithExpiry([]byte("live"), []byte("value"), expiresAt)
+	expired, _ := db.NewItemWithExpiry([]byte("expired"), []byte("value"), time.Now().Add(-time.Second))
+	forever, _ := db.NewItem([]byte("forever"), []byte("value"))
+
+	for _, item := range []*db.Item{live, expired, forever} {
+		if err := tree.Insert(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	item, err := tree.Find([]byte("live"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if at, ok := item.ExpiresAt(); !ok || !at.Equal(expiresAt) {
+		t.Fatalf("Expiry was not stored: %v %v", at, ok)
+	}
+
+	if _, ok := forever.ExpiresAt(); ok {
+		t.Fatal("Item without expiry reports one")
+	}
+
+	if _, err := tree.Find([]byte("expired")); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("Expired item is found: %v", err)
+	}
+
+	keys := scanKeys(t, tree, nil, nil, 0)
+	if len(keys) != 2 || keys[0] != "forever" || keys[1] != "live" {
+		t.Fatalf("Scan returned expired items: %v", keys)
+	}
+
+	purged, err := tree.PurgeExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if purged != 1 {
+		t.Fatalf("Purged %d items, expected 1", purged)
+	}
+}
+
+func TestPurgeExpiredUsingDB(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	dbEngine, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	sessions, err := dbEngine.Collection("sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+
+	// More than one batch of expired items
+	for i := range 1000 {
+		key := []byte(strconv.Itoa(i))
+		expiresAt := future
+		if i%3 != 0 {
+			expiresAt = past
+		}
+
+		item, _ := db.NewItemWithExpiry(key, []byte("session"), expiresAt)
+		if err := sessions.Insert(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	purged, err := dbEngine.PurgeExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if purged != 666 {
+		t.Fatalf("Purged %d items, expected 666", purged)
+	}
+
+	for i := range 1000 {
+		if _, err := sessions.Find([]byte(strconv.Itoa(i))); (err == nil) != (i%3 == 0) {
+			t.Fatalf("Unexpected result for key %d: %v", i, err)
+		}
+	}
+}
+
+func TestExpirySweeper(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	dbEngine, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	cache, err := dbEngine.Collection("cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiresAt := time.Now().Add(50 * time.Millisecond)
+	for i := range 100 {
+		item, _ := db.NewItemWithExpiry([]byte(strconv.Itoa(i)), []byte("cached"), expiresAt)
+		if err := cache.Insert(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dbEngine.StartExpirySweeper(10 * time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats, err := cache.CompressionStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stats.Items == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Sweeper left %d items", stats.Items)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	dbEngine.StopExpirySweeper()
+}
@@ -0,0 +1,270 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	stdio "io"
+	"slices"
+	"time"
+)
+
+const (
+	// Lines of an import can't be longer than this.
+	maxImportLineSize = 1 << 20
+
+	// Number of items read under one lock of the DB by an export, and loaded
+	// under one lock by an import.
+	exportBatchSize = 1000
+	importBatchSize = 1000
+)
+
+type ExportOptions struct {
+	// Collections to export. Nil exports all collections.
+	Collections []string
+	// Only items whose key starts with Prefix are exported.
+	Prefix []byte
+}
+
+// One line of an export. Keys and values are base64 encoded by encoding/json.
+type exportRecord struct {
+	Collection string     `json:"collection"`
+	Key        []byte     `json:"key"`
+	Value      []byte     `json:"value"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+// Writes the items of the collections as JSON Lines, ordered by collection and key.
+// Expired items are left out. The items are read in batches under the read lock
+// of the DB, which is released while they are written. Writes between the
+// batches may be left out of the export.
+func (e *DB) Export(w stdio.Writer, options ExportOptions) error {
+	return e.ExportContext(context.Background(), w, options)
+}
+
+// Like Export, but stops with the error of ctx once it is done.
+func (e *DB) ExportContext(ctx context.Context, w stdio.Writer, options ExportOptions) error {
+	names, err := e.Collections()
+	if err != nil {
+		return err
+	}
+
+	if options.Collections != nil {
+		names = slices.DeleteFunc(names, func(name string) bool {
+			return !slices.Contains(options.Collections, name)
+		})
+	}
+
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+
+	for _, name := range names {
+		tree, err := e.Collection(name)
+		if err != nil {
+			return err
+		}
+
+		start, end := options.Prefix, PrefixEnd(options.Prefix)
+		for {
+			batch := make([]*Item, 0, exportBatchSize)
+			err := tree.ScanContext(ctx, start, end, func(i *Item) bool {
+				batch = append(batch, i)
+				return len(batch) < exportBatchSize
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, i := range batch {
+				record := exportRecord{Collection: name, Key: i.key, Value: i.value}
+				if expiresAt, ok := i.ExpiresAt(); ok {
+					record.ExpiresAt = &expiresAt
+				}
+
+				if err := encoder.Encode(record); err != nil {
+					return err
+				}
+			}
+
+			if len(batch) < exportBatchSize {
+				break
+			}
+
+			// The next batch starts right after the last key.
+			last := batch[len(batch)-1].key
+			start = append(last[:len(last):len(last)], 0)
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Loads items written by Export and returns how many were loaded. Runs of
+// ascending keys for an empty collection are bulk loaded bottom-up, other
+// items are inserted one by one. Existing keys are overwritten.
+//
+// The lines are read in batches without holding the lock of the DB, and each
+// batch is loaded under one lock. The loaded batches can be read and are
+// committed by a Sync while the import goes on.
+func (e *DB) Import(r stdio.Reader) (int, error) {
+	return e.ImportContext(context.Background(), r)
+}
+
+// Like Import, but stops with the error of ctx once it is done. The items
+// loaded before that are kept.
+func (e *DB) ImportContext(ctx context.Context, r stdio.Reader) (int, error) {
+	if e.io.ReadOnly() {
+		return 0, ErrReadOnly
+	}
+
+	// Bulk loads write the nodes of a collection directly.
+	e.mu.RLock()
+	follower := e.follower
+	e.mu.RUnlock()
+
+	if follower {
+		return 0, ErrFollowerDB
+	}
+
+	count, err := e.importRecords(ctx, r)
+	if count > 0 {
+		if syncErr := e.syncAlways(); err == nil {
+			err = syncErr
+		}
+	}
+
+	return count, err
+}
+
+// A line of an import, decoded.
+type importItem struct {
+	line       int
+	collection string
+	item       *Item
+}
+
+func (e *DB) importRecords(ctx context.Context, r stdio.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLineSize)
+
+	im := &importer{db: e}
+	count := 0
+	line := 0
+	for {
+		batch, done, readErr := readImportBatch(ctx, scanner, &line)
+
+		n, err := im.load(batch)
+		count += n
+		if err != nil {
+			return count, err
+		}
+
+		if readErr != nil || done {
+			return count, readErr
+		}
+	}
+}
+
+// Reads up to importBatchSize items. Done is set once the input is read.
+func readImportBatch(ctx context.Context, scanner *bufio.Scanner, line *int) ([]importItem, bool, error) {
+	batch := make([]importItem, 0, importBatchSize)
+	for len(batch) < importBatchSize {
+		if err := ctx.Err(); err != nil {
+			return batch, false, err
+		}
+
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return batch, false, fmt.Errorf("%w: line %d: %v", ErrInvalidImport, *line+1, err)
+			}
+
+			return batch, true, nil
+		}
+		*line++
+
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		record := exportRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return batch, false, fmt.Errorf("%w: line %d: %v", ErrInvalidImport, *line, err)
+		}
+
+		var item *Item
+		var err error
+		if record.ExpiresAt != nil {
+			item, err = NewItemWithExpiry(record.Key, record.Value, *record.ExpiresAt)
+		} else {
+			item, err = NewItem(record.Key, record.Value)
+		}
+		if err != nil {
+			return batch, false, fmt.Errorf("%w: line %d: %v", ErrInvalidImport, *line, err)
+		}
+
+		batch = append(batch, importItem{line: *line, collection: record.Collection, item: item})
+	}
+
+	return batch, false, nil
+}
+
+// Loads the batches of an import. The bulk load of a collection goes on
+// across the batches, see bulkLoader.pause.
+type importer struct {
+	db     *DB
+	loader *bulkLoader
+}
+
+// Loads the items with the lock of their collection held, and releases it
+// once the batch is loaded. Returns the number of loaded items.
+func (im *importer) load(batch []importItem) (int, error) {
+	if len(batch) == 0 {
+		return 0, nil
+	}
+
+	if im.loader != nil {
+		im.loader.tree.lock()
+		if err := im.loader.resume(); err != nil {
+			im.loader.tree.unlock()
+			return 0, err
+		}
+	}
+
+	count := 0
+	for _, record := range batch {
+		if im.loader == nil || im.loader.tree.name != record.collection {
+			if err := im.pause(); err != nil {
+				return count, err
+			}
+			im.loader = nil
+
+			tree, err := im.db.Collection(record.collection)
+			if err != nil {
+				return count, fmt.Errorf("%w: line %d: %v", ErrInvalidImport, record.line, err)
+			}
+
+			tree.lock()
+			im.loader = tree.newBulkLoader()
+		}
+
+		if err := im.loader.add(record.item); err != nil {
+			im.pause()
+			return count, err
+		}
+
+		count++
+	}
+
+	return count, im.pause()
+}
+
+// Finishes the tree of the current collection and releases its lock.
+func (im *importer) pause() error {
+	if im.loader == nil {
+		return nil
+	}
+
+	defer im.loader.tree.unlock()
+	return im.loader.pause()
+}
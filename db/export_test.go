@@ -0,0 +1,328 @@
+package db_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	stdio "io"
+	"math/rand/v2"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rettenwander/mellowdb/db"
+)
+
+func TestExportImport(t *testing.T) {
+	dir := t.TempDir()
+
+	source, err := db.NewDB(filepath.Join(dir, "source.mellow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	rnd := rand.New(rand.NewPCG(1, 2))
+	sizes := map[string]int{"empty": 0, "one": 1, "small": 20, "large": 20000}
+	expiresAt := time.Now().Add(time.Hour)
+
+	for name, size := range sizes {
+		tree, err := source.Collection(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range size {
+			key := fmt.Appendf(nil, "key-%06d", i)
+			// Binary values of different sizes exercise the merges at the right edge.
+			value := make([]byte, rnd.IntN(db.MaxValueSize))
+			for j := range value {
+				value[j] = byte(rnd.IntN(256))
+			}
+
+			var item *db.Item
+			if i%10 == 0 {
+				item, _ = db.NewItemWithExpiry(key, value, expiresAt)
+			} else {
+				item, _ = db.NewItem(key, value)
+			}
+
+			if err := tree.Insert(item); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := source.Export(&buf, db.ExportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for _, size := range sizes {
+		total += size
+	}
+
+	if lines := bytes.Count(buf.Bytes(), []byte("\n")); lines != total {
+		t.Fatalf("Expected %d lines, got %d", total, lines)
+	}
+
+	target, err := db.NewDB(filepath.Join(dir, "target.mellow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	count, err := target.Import(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != total {
+		t.Fatalf("Expected %d imported items, got %d", total, count)
+	}
+
+	if problems := target.Check(); len(problems) != 0 {
+		t.Fatalf("Expected no problems after the import, got %v", problems)
+	}
+
+	for name := range sizes {
+		sourceTree, _ := source.Collection(name)
+		targetTree, _ := target.Collection(name)
+
+		n := 0
+		err := sourceTree.Scan(nil, nil, func(want *db.Item) bool {
+			n++
+
+			got, err := targetTree.Find(want.Key())
+			if err != nil {
+				t.Fatalf("Key %q of %s: %v", want.Key(), name, err)
+			}
+
+			wantExpiry, _ := want.ExpiresAt()
+			gotExpiry, _ := got.ExpiresAt()
+			if !bytes.Equal(got.Value(), want.Value()) || !gotExpiry.Equal(wantExpiry) {
+				t.Fatalf("Key %q of %s differs", want.Key(), name)
+			}
+
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != sizes[name] {
+			t.Fatalf("Expected %d items in %s, got %d", sizes[name], name, n)
+		}
+	}
+
+	buf.Reset()
+	if err := source.Export(&buf, db.ExportOptions{Collections: []string{"large"}, Prefix: []byte("key-0001")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := bytes.Count(buf.Bytes(), []byte("\n")); lines != 100 {
+		t.Fatalf("Expected 100 lines with the prefix, got %d", lines)
+	}
+}
+
+func TestImportUnsorted(t *testing.T) {
+	dbEngine, err := db.NewDB(filepath.Join(t.TempDir(), "test.mellow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	// a2V5LTE= is "key-1", a2V5LTI= is "key-2", dmFsdWU= is "value" and bmV3 is "new".
+	input := strings.Join([]string{
+		`{"collection":"users","key":"a2V5LTI=","value":"dmFsdWU="}`,
+		`{"collection":"users","key":"a2V5LTE=","value":"dmFsdWU="}`,
+		``,
+		`{"collection":"orders","key":"a2V5LTE=","value":"dmFsdWU="}`,
+		`{"collection":"users","key":"a2V5LTI=","value":"bmV3"}`,
+	}, "\n")
+
+	count, err := dbEngine.Import(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 4 {
+		t.Fatalf("Expected 4 items, got %d", count)
+	}
+
+	users, _ := dbEngine.Collection("users")
+	if item, err := users.Find([]byte("key-2")); err != nil || string(item.Value()) != "new" {
+		t.Fatalf("Expected the later line to win, got %v", err)
+	}
+
+	if _, err := users.Find([]byte("key-1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if problems := dbEngine.Check(); len(problems) != 0 {
+		t.Fatalf("Expected no problems, got %v", problems)
+	}
+
+	_, err = dbEngine.Import(strings.NewReader(`{"collection":"users","key":"a2V5LTE="}` + "\nnot json\n"))
+	if !errors.Is(err, db.ErrInvalidImport) || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("Expected ErrInvalidImport on line 2, got %v", err)
+	}
+}
+
+// Calls fn once a write is done, or fails the test if it doesn't return in time.
+func writeWithin(t *testing.T, fn func() error) {
+	t.Helper()
+
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write blocked, the lock of the DB is held")
+	}
+}
+
+// Writes to the DB while the export writes its output.
+type writingWriter struct {
+	t    *testing.T
+	tree *db.BTree
+	bytes.Buffer
+	wrote bool
+}
+
+func (w *writingWriter) Write(p []byte) (int, error) {
+	if !w.wrote {
+		w.wrote = true
+		writeWithin(w.t, func() error {
+			item, _ := db.NewItem([]byte("written"), []byte("value"))
+			return w.tree.Insert(item)
+		})
+	}
+
+	return w.Buffer.Write(p)
+}
+
+func TestExportReleasesLock(t *testing.T) {
+	dbEngine, err := db.NewDB(filepath.Join(t.TempDir(), "test.mellow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	tree, err := dbEngine.Collection("items")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 5000 {
+		item, _ := db.NewItem(fmt.Appendf(nil, "key-%06d", i), []byte("value"))
+		if err := tree.Insert(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := &writingWriter{t: t, tree: tree}
+	if err := dbEngine.Export(w, db.ExportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The written key sorts after the exported ones, so a later batch reads it.
+	if lines := bytes.Count(w.Bytes(), []byte("\n")); lines != 5001 {
+		t.Fatalf("Expected 5001 lines, got %d", lines)
+	}
+}
+
+// Writes to the collection of the import while the import reads its input.
+type writingReader struct {
+	t        *testing.T
+	dbEngine *db.DB
+	input    []byte
+	reads    int
+}
+
+func (r *writingReader) Read(p []byte) (int, error) {
+	if len(r.input) == 0 {
+		return 0, stdio.EOF
+	}
+
+	r.reads++
+	switch r.reads {
+	case 10:
+		// Between the keys of the import.
+		r.insert("key-000100x")
+	case 20:
+		// After the keys of the import, so the rest is inserted one by one.
+		r.insert("zzz")
+	}
+
+	n := copy(p[:min(len(p), 4096)], r.input)
+	r.input = r.input[n:]
+	return n, nil
+}
+
+func (r *writingReader) insert(key string) {
+	writeWithin(r.t, func() error {
+		tree, err := r.dbEngine.Collection("items")
+		if err != nil {
+			return err
+		}
+
+		item, _ := db.NewItem([]byte(key), []byte("written"))
+		return tree.Insert(item)
+	})
+}
+
+func TestImportReleasesLock(t *testing.T) {
+	dbEngine, err := db.NewDB(filepath.Join(t.TempDir(), "test.mellow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	var input bytes.Buffer
+	for i := range 20000 {
+		fmt.Fprintf(&input, `{"collection":"items","key":%q,"value":"dmFsdWU="}`+"\n",
+			base64.StdEncoding.EncodeToString(fmt.Appendf(nil, "key-%06d", i)))
+	}
+
+	r := &writingReader{t: t, dbEngine: dbEngine, input: input.Bytes()}
+	count, err := dbEngine.Import(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 20000 || r.reads < 20 {
+		t.Fatalf("Expected 20000 items over at least 20 reads, got %d items and %d reads", count, r.reads)
+	}
+
+	if problems := dbEngine.Check(); len(problems) != 0 {
+		t.Fatalf("Expected no problems, got %v", problems)
+	}
+
+	tree, err := dbEngine.Collection("items")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	if err := tree.Scan(nil, nil, func(*db.Item) bool { n++; return true }); err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 20002 {
+		t.Fatalf("Expected the imported and the written items, got %d", n)
+	}
+
+	for _, key := range []string{"key-000100x", "zzz", "key-019999"} {
+		if _, err := tree.Find([]byte(key)); err != nil {
+			t.Fatalf("Key %q: %v", key, err)
+		}
+	}
+}
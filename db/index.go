@@ -0,0 +1,418 @@
+package db
+
+import (
+	"bytes"
+	"time"
+)
+
+// An IndexFunc returns the index keys of a value. It may return none.
+type IndexFunc func(value []byte) [][]byte
+
+type IndexOptions struct {
+	Name string
+	Func IndexFunc
+
+	// Rejects writes that would give two items the same index key.
+	Unique bool
+}
+
+// The entries of a non-unique index are keys made of the index key and the
+// primary key. A write fails with ErrKeyTooLong if both together are longer
+// than MaxKeySize-1 bytes. Unique indexes allow index keys up to MaxKeySize.
+
+// A secondary index is kept in an internal collection of the DB.
+//
+// Entries of a unique index map the index key to the primary key. Entries of
+// other indexes are keys made of the length of the index key, the index key
+// and the primary key, so all entries of an index key share a prefix.
+//
+// An index may hold stale entries, but never misses one: a write adds the new
+// entries before the item and removes the old ones after it, and a delete
+// removes the entries after the item. Lookups and the unique check only trust
+// an entry if the value of the item still has its index key.
+type index struct {
+	IndexOptions
+
+	tree *BTree
+}
+
+func indexCollectionName(collection string, index string) string {
+	return "\x00index\x00" + collection + "\x00" + index
+}
+
+func (idx *index) entryPrefix(indexKey []byte) []byte {
+	prefix := make([]byte, 0, len(indexKey)+1)
+	prefix = append(prefix, byte(len(indexKey)))
+	return append(prefix, indexKey...)
+}
+
+func (idx *index) entry(indexKey []byte, primaryKey []byte) (*Item, error) {
+	if idx.Unique {
+		return NewItem(indexKey, primaryKey)
+	}
+
+	if len(indexKey) > MaxKeySize {
+		return nil, ErrKeyTooLong
+	}
+
+	return NewItem(append(idx.entryPrefix(indexKey), primaryKey...), nil)
+}
+
+// Returns the distinct index keys of the item, none if the item is nil.
+func (idx *index) keys(i *Item) ([][]byte, error) {
+	if i == nil {
+		return nil, nil
+	}
+
+	i, err := decompressItem(i)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := [][]byte{}
+	seen := make(map[string]bool)
+	for _, key := range idx.Func(i.value) {
+		if !seen[string(key)] {
+			seen[string(key)] = true
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// Declares a secondary index on the collection. Every write to the collection
+// updates the index from then on.
+//
+// Indexes aren't stored in the DB file, declare them every time the DB is opened.
+// An index without entries is built from the items of the collection. Writes made
+// while the index isn't declared are not tracked: lookups skip the entries they
+// made stale, but miss the items they added until RebuildIndex is called.
+func (t *BTree) AddIndex(options IndexOptions) error {
+	if t.db == nil || t.name == "" {
+		return ErrNotACollection
+	}
+
+	if options.Name == "" || options.Func == nil {
+		return ErrInvalidIndex
+	}
+
+	tree, err := t.db.collection(indexCollectionName(t.name, options.Name), true)
+	if err != nil {
+		return err
+	}
+
+	t.lock()
+	defer t.unlock()
+
+	if t.findIndex(options.Name) != nil {
+		return ErrInvalidIndex
+	}
+
+	idx := &index{IndexOptions: options, tree: tree}
+	if tree.Root == 0 {
+		if err := t.buildIndex(idx); err != nil {
+			return err
+		}
+	}
+
+	t.indexes = append(t.indexes, idx)
+	return nil
+}
+
+// Drops all entries of the index and builds it again from the items of the collection.
+func (t *BTree) RebuildIndex(name string) error {
+	t.lock()
+	defer t.unlock()
+
+	idx := t.findIndex(name)
+	if idx == nil {
+		return ErrIndexNotFound
+	}
+
+	if err := idx.clear(); err != nil {
+		return err
+	}
+
+	return t.buildIndex(idx)
+}
+
+// Returns the items whose values have the index key. Expired items are left out.
+func (t *BTree) LookupByIndex(name string, key []byte) ([]*Item, error) {
+	t.rlock()
+	defer t.runlock()
+
+	idx := t.findIndex(name)
+	if idx == nil {
+		return nil, ErrIndexNotFound
+	}
+
+	primaryKeys := [][]byte{}
+	if idx.Unique {
+		entry, err := idx.tree.find(key)
+		if err == nil {
+			primaryKeys = append(primaryKeys, entry.value)
+		} else if err != ErrNotFound {
+			return nil, err
+		}
+	} else {
+		prefix := idx.entryPrefix(key)
+		err := idx.tree.scan(prefix, PrefixEnd(prefix), func(entry *Item) (bool, error) {
+			primaryKeys = append(primaryKeys, entry.key[len(prefix):])
+			return true, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	items := []*Item{}
+	for _, primaryKey := range primaryKeys {
+		item, err := t.find(primaryKey)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if item.isExpired(now) {
+			continue
+		}
+
+		item, err = decompressItem(item)
+		if err != nil {
+			return nil, err
+		}
+
+		// The entry is stale if the value changed while the index wasn't declared.
+		keys, err := idx.keys(item)
+		if err != nil {
+			return nil, err
+		}
+
+		if !containsKey(keys, key) {
+			continue
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func (t *BTree) findIndex(name string) *index {
+	for _, idx := range t.indexes {
+		if idx.Name == name {
+			return idx
+		}
+	}
+
+	return nil
+}
+
+func (t *BTree) buildIndex(idx *index) error {
+	err := t.forEachItem(func(i *Item) error {
+		keys, err := idx.keys(i)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := t.checkIndexKey(idx, key, i.key); err != nil {
+				return err
+			}
+
+			if err := idx.add(key, i.key); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	// A partly built index would not be built again by AddIndex.
+	if err != nil {
+		idx.clear()
+	}
+
+	return err
+}
+
+// Checks that the new item can be written without breaking an index.
+// Runs before anything is written.
+func (t *BTree) checkIndexes(stored *Item, i *Item) error {
+	for _, idx := range t.indexes {
+		oldKeys, err := idx.keys(stored)
+		if err != nil {
+			return err
+		}
+
+		newKeys, err := idx.keys(i)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range newKeys {
+			if containsKey(oldKeys, key) {
+				continue
+			}
+
+			if err := t.checkIndexKey(idx, key, i.key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (t *BTree) checkIndexKey(idx *index, key []byte, primaryKey []byte) error {
+	entry, err := idx.entry(key, primaryKey)
+	if err != nil {
+		return err
+	}
+
+	if !idx.Unique {
+		return nil
+	}
+
+	existing, err := idx.tree.find(entry.key)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if bytes.Equal(existing.value, primaryKey) {
+		return nil
+	}
+
+	// The key can be taken over from an item that expired or no longer has it.
+	owner, err := t.find(existing.value)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if owner.isExpired(time.Now()) {
+		return nil
+	}
+
+	ownerKeys, err := idx.keys(owner)
+	if err != nil {
+		return err
+	}
+
+	if !containsKey(ownerKeys, key) {
+		return nil
+	}
+
+	return ErrIndexConflict
+}
+
+// Writes the index entries the new item has and the stored item doesn't.
+// Either item can be nil.
+func (t *BTree) addIndexEntries(stored *Item, i *Item) error {
+	for _, idx := range t.indexes {
+		oldKeys, err := idx.keys(stored)
+		if err != nil {
+			return err
+		}
+
+		newKeys, err := idx.keys(i)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range newKeys {
+			if !containsKey(oldKeys, key) {
+				if err := idx.add(key, i.key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Removes the index entries the stored item has and the new item doesn't.
+// Either item can be nil.
+func (t *BTree) removeIndexEntries(stored *Item, i *Item) error {
+	for _, idx := range t.indexes {
+		oldKeys, err := idx.keys(stored)
+		if err != nil {
+			return err
+		}
+
+		newKeys, err := idx.keys(i)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range oldKeys {
+			if !containsKey(newKeys, key) {
+				if err := idx.remove(key, stored.key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (idx *index) add(key []byte, primaryKey []byte) error {
+	entry, err := idx.entry(key, primaryKey)
+	if err != nil {
+		return err
+	}
+
+	return idx.tree.put(entry.key, func(*Item) (*Item, error) {
+		return entry, nil
+	})
+}
+
+func (idx *index) remove(key []byte, primaryKey []byte) error {
+	entry, err := idx.entry(key, primaryKey)
+	if err != nil {
+		return err
+	}
+
+	// A unique key could have been taken over by another item.
+	_, err = idx.tree.remove(entry.key, func(i *Item) bool {
+		return bytes.Equal(i.value, entry.value)
+	})
+	return err
+}
+
+func (idx *index) clear() error {
+	keys := [][]byte{}
+	err := idx.tree.forEachItem(func(i *Item) error {
+		keys = append(keys, append([]byte(nil), i.key...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if _, err := idx.tree.remove(key, func(*Item) bool { return true }); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func containsKey(keys [][]byte, key []byte) bool {
+	for _, k := range keys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+
+	return false
+}
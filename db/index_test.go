@@ -0,0 +1,368 @@
+package db_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rettenwander/mellowdb/db"
+	"github.com/rettenwander/mellowdb/io"
+	"github.com/rettenwander/mellowdb/io/faultstorage"
+)
+
+// Values are "email,city"
+func emailIndex(value []byte) [][]byte {
+	email, _, _ := bytes.Cut(value, []byte(","))
+	return [][]byte{email}
+}
+
+func cityIndex(value []byte) [][]byte {
+	_, city, found := bytes.Cut(value, []byte(","))
+	if !found {
+		return nil
+	}
+
+	return [][]byte{city}
+}
+
+func addUserIndexes(t *testing.T, users *db.BTree) {
+	if err := users.AddIndex(db.IndexOptions{Name: "email", Func: emailIndex, Unique: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := users.AddIndex(db.IndexOptions{Name: "city", Func: cityIndex}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func putUser(t *testing.T, users *db.BTree, id string, value string) {
+	item, _ := db.NewItem([]byte(id), []byte(value))
+	if err := users.Insert(item); err != nil {
+		t.Fatalf("Error inserting %s: %v", id, err)
+	}
+}
+
+func lookupKeys(t *testing.T, users *db.BTree, index string, key string) []string {
+	items, err := users.LookupByIndex(index, []byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{}
+	for _, item := range items {
+		keys = append(keys, string(item.Key()))
+	}
+
+	slices.Sort(keys)
+	return keys
+}
+
+func TestSecondaryIndexes(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	dbEngine, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := dbEngine.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Existing items are indexed when the index is declared.
+	putUser(t, users, "1", "anna@example.com,Vienna")
+	addUserIndexes(t, users)
+
+	putUser(t, users, "2", "ben@example.com,Graz")
+	putUser(t, users, "3", "cleo@example.com,Vienna")
+
+	if keys := lookupKeys(t, users, "city", "Vienna"); !slices.Equal(keys, []string{"1", "3"}) {
+		t.Fatalf("Unexpected lookup result: %v", keys)
+	}
+
+	if keys := lookupKeys(t, users, "email", "ben@example.com"); !slices.Equal(keys, []string{"2"}) {
+		t.Fatalf("Unexpected lookup result: %v", keys)
+	}
+
+	// Overwrites move the index entries
+	putUser(t, users, "3", "cleo@example.com,Graz")
+	if keys := lookupKeys(t, users, "city", "Vienna"); !slices.Equal(keys, []string{"1"}) {
+		t.Fatalf("Stale index entry after overwrite: %v", keys)
+	}
+
+	if keys := lookupKeys(t, users, "city", "Graz"); !slices.Equal(keys, []string{"2", "3"}) {
+		t.Fatalf("Missing index entry after overwrite: %v", keys)
+	}
+
+	// A key that is a prefix of another key doesn't match it.
+	putUser(t, users, "4", "dora@example.com,Graz-Umgebung")
+	if keys := lookupKeys(t, users, "city", "Graz"); !slices.Equal(keys, []string{"2", "3"}) {
+		t.Fatalf("Lookup matched a longer key: %v", keys)
+	}
+
+	// Unique constraint
+	item, _ := db.NewItem([]byte("5"), []byte("anna@example.com,Linz"))
+	if err := users.Insert(item); !errors.Is(err, db.ErrIndexConflict) {
+		t.Fatalf("Expected ErrIndexConflict, got %v", err)
+	}
+
+	if _, err := users.Find([]byte("5")); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("Rejected item was written: %v", err)
+	}
+
+	if keys := lookupKeys(t, users, "city", "Linz"); len(keys) != 0 {
+		t.Fatalf("Rejected item was indexed: %v", keys)
+	}
+
+	// Deletes remove the index entries
+	if err := users.Delete([]byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := lookupKeys(t, users, "email", "anna@example.com"); len(keys) != 0 {
+		t.Fatalf("Stale index entry after delete: %v", keys)
+	}
+
+	putUser(t, users, "5", "anna@example.com,Linz")
+
+	if _, err := users.LookupByIndex("missing", []byte("x")); !errors.Is(err, db.ErrIndexNotFound) {
+		t.Fatalf("Expected ErrIndexNotFound, got %v", err)
+	}
+
+	if err := users.AddIndex(db.IndexOptions{Name: "city", Func: cityIndex}); !errors.Is(err, db.ErrInvalidIndex) {
+		t.Fatalf("Expected ErrInvalidIndex for duplicate index, got %v", err)
+	}
+
+	if err := dbEngine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dbEngine, err = db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	collections, err := dbEngine.Collections()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(collections, []string{"users"}) {
+		t.Fatalf("Index collections are listed: %q", collections)
+	}
+
+	users, err = dbEngine.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putUser(t, users, "6", "emil@example.com,Graz")
+	addUserIndexes(t, users)
+
+	if keys := lookupKeys(t, users, "city", "Graz"); !slices.Equal(keys, []string{"2", "3"}) {
+		t.Fatalf("Index was not persisted: %v", keys)
+	}
+
+	if keys := lookupKeys(t, users, "email", "anna@example.com"); !slices.Equal(keys, []string{"5"}) {
+		t.Fatalf("Index was not persisted: %v", keys)
+	}
+
+	// Writes without the index declared are picked up by a rebuild.
+	if err := users.RebuildIndex("city"); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := lookupKeys(t, users, "city", "Graz"); !slices.Equal(keys, []string{"2", "3", "6"}) {
+		t.Fatalf("Rebuilt index is wrong: %v", keys)
+	}
+}
+
+func TestUniqueIndexExpiredOwner(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	dbEngine, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	users, err := dbEngine.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addUserIndexes(t, users)
+
+	expired, _ := db.NewItemWithExpiry([]byte("1"), []byte("anna@example.com,Vienna"), time.Now().Add(-time.Second))
+	if err := users.Insert(expired); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := lookupKeys(t, users, "city", "Vienna"); len(keys) != 0 {
+		t.Fatalf("Lookup returned expired items: %v", keys)
+	}
+
+	putUser(t, users, "2", "anna@example.com,Graz")
+
+	if keys := lookupKeys(t, users, "email", "anna@example.com"); !slices.Equal(keys, []string{"2"}) {
+		t.Fatalf("Unique key was not taken over: %v", keys)
+	}
+
+	if _, err := users.PurgeExpired(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Purging the expired item must not remove the entry of the new owner.
+	if keys := lookupKeys(t, users, "email", "anna@example.com"); !slices.Equal(keys, []string{"2"}) {
+		t.Fatalf("Purge removed the entry of another item: %v", keys)
+	}
+}
+
+func TestIndexNeedsCollection(t *testing.T) {
+	reader := &NodeReaderMOCK{
+		nodes:       make(map[int64]db.Node),
+		MaxNodeSize: 4096,
+	}
+
+	tree := db.NewBTree(reader, 0)
+	if err := tree.AddIndex(db.IndexOptions{Name: "city", Func: cityIndex}); !errors.Is(err, db.ErrNotACollection) {
+		t.Fatalf("Expected ErrNotACollection, got %v", err)
+	}
+}
+
+func TestStaleIndexEntries(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	dbEngine, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := dbEngine.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addUserIndexes(t, users)
+	putUser(t, users, "1", "anna@example.com,Vienna")
+
+	if err := dbEngine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the indexes the entries of 1 become stale.
+	if dbEngine, err = db.NewDB(file); err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	if users, err = dbEngine.Collection("users"); err != nil {
+		t.Fatal(err)
+	}
+
+	putUser(t, users, "1", "anna@example.org,Graz")
+	addUserIndexes(t, users)
+
+	if keys := lookupKeys(t, users, "city", "Vienna"); len(keys) != 0 {
+		t.Fatalf("Lookup returned a stale entry: %v", keys)
+	}
+
+	if keys := lookupKeys(t, users, "email", "anna@example.com"); len(keys) != 0 {
+		t.Fatalf("Lookup returned a stale unique entry: %v", keys)
+	}
+
+	// A stale unique entry doesn't hold on to its key.
+	putUser(t, users, "2", "anna@example.com,Linz")
+
+	if keys := lookupKeys(t, users, "email", "anna@example.com"); !slices.Equal(keys, []string{"2"}) {
+		t.Fatalf("Expected 2 to take over the key, got %v", keys)
+	}
+}
+
+func TestIndexEntryTooLong(t *testing.T) {
+	dbEngine, err := db.NewDBWithStorage(io.NewMemoryStorage(nil), io.EngineOptions{PageSize: io.MetadataPageSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	users, err := dbEngine.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addUserIndexes(t, users)
+
+	// The entry holds the city and the primary key.
+	id := bytes.Repeat([]byte("i"), db.MaxKeySize/2)
+	city := bytes.Repeat([]byte("c"), db.MaxKeySize/2)
+	item, _ := db.NewItem(id, append([]byte("anna@example.com,"), city...))
+
+	if err := users.Insert(item); !errors.Is(err, db.ErrKeyTooLong) {
+		t.Fatalf("Expected ErrKeyTooLong, got %v", err)
+	}
+
+	if _, err := users.Find(id); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("Expected the item not to be written, got %v", err)
+	}
+}
+
+// A write that fails partway never leaves an item the index misses.
+func TestIndexAfterFailedWrites(t *testing.T) {
+	storage, err := faultstorage.New(io.NewMemoryStorage(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbEngine, err := db.NewDBWithStorage(storage, io.EngineOptions{PageSize: io.MetadataPageSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	users, err := dbEngine.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addUserIndexes(t, users)
+
+	failures := 0
+	for n := range 300 {
+		id := fmt.Sprint(n % 40)
+		value := fmt.Sprintf("user%d@example.com,city%d", n, n%7)
+
+		storage.Schedule(1+n%5, faultstorage.FailWrite)
+		item, _ := db.NewItem([]byte(id), []byte(value))
+		if err := users.Insert(item); err != nil {
+			failures++
+		}
+		storage.ClearSchedule()
+
+		stored, err := users.Find([]byte(id))
+		if errors.Is(err, db.ErrNotFound) {
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		email, city, _ := bytes.Cut(stored.Value(), []byte(","))
+		if keys := lookupKeys(t, users, "email", string(email)); !slices.Equal(keys, []string{id}) {
+			t.Fatalf("write %d: email lookup of %s returned %v", n, id, keys)
+		}
+
+		if keys := lookupKeys(t, users, "city", string(city)); !slices.Contains(keys, id) {
+			t.Fatalf("write %d: city lookup of %s returned %v", n, id, keys)
+		}
+	}
+
+	if failures == 0 {
+		t.Fatal("Expected some writes to fail")
+	}
+}
@@ -1,8 +1,25 @@
 package db
 
+import "time"
+
+const (
+	// The value is stored compressed with compress/flate.
+	itemFlagCompressed byte = 1 << iota
+	// The item carries an expiry timestamp.
+	itemFlagExpires
+)
+
+// Size of the expiry timestamp in the node encoding.
+const expirySize = 8
+
 type Item struct {
 	key   []byte
 	value []byte
+	flags byte
+
+	// Unix time in nanoseconds after which the item is treated as absent.
+	// Only valid if itemFlagExpires is set.
+	expiresAt int64
 }
 
 func NewItem(key []byte, value []byte) (*Item, error) {
@@ -18,15 +35,61 @@ func NewItem(key []byte, value []byte) (*Item, error) {
 	}, nil
 }
 
+// Creates an item that is treated as absent once expiresAt has passed.
+func NewItemWithExpiry(key []byte, value []byte, expiresAt time.Time) (*Item, error) {
+	item, err := NewItem(key, value)
+	if err != nil {
+		return nil, err
+	}
+
+	item.flags |= itemFlagExpires
+	item.expiresAt = expiresAt.UnixNano()
+	return item, nil
+}
+
+func (i *Item) Key() []byte {
+	return i.key
+}
+
+func (i *Item) Value() []byte {
+	return i.value
+}
+
+// Returns the expiry of the item. The boolean is false if the item doesn't expire.
+func (i *Item) ExpiresAt() (time.Time, bool) {
+	if !i.hasExpiry() {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, i.expiresAt), true
+}
+
+func (i *Item) isCompressed() bool {
+	return i.flags&itemFlagCompressed != 0
+}
+
+func (i *Item) hasExpiry() bool {
+	return i.flags&itemFlagExpires != 0
+}
+
+func (i *Item) isExpired(now time.Time) bool {
+	return i.hasExpiry() && i.expiresAt <= now.UnixNano()
+}
+
 func (i *Item) Size() int {
-	size := 2
+	size := 3
 	size += len(i.key)
 	size += len(i.value)
+
+	if i.hasExpiry() {
+		size += expirySize
+	}
+
 	return size
 }
 
 func (i *Item) Clone() *Item {
 	newKey := append([]byte(nil), i.key...)
 	newValue := append([]byte(nil), i.value...)
-	return &Item{key: newKey, value: newValue}
+	return &Item{key: newKey, value: newValue, flags: i.flags, expiresAt: i.expiresAt}
 }
@@ -0,0 +1,113 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The collection used by the DB level methods like Merge.
+const DefaultCollection = "default"
+
+// A MergeOperator combines an operand with the existing value of a key.
+// Existing is nil and exists false if the key is absent or expired.
+type MergeOperator func(key []byte, existing []byte, exists bool, operand []byte) ([]byte, error)
+
+// Combines the operand with the value of the key using the tree's merge operator,
+// in one descent. An existing expiry is kept.
+func (t *BTree) Merge(key []byte, operand []byte) error {
+	return t.Update(key, func(old []byte, exists bool) ([]byte, error) {
+		// Read under the lock, DB.SetMergeOperator changes it.
+		if t.MergeOperator == nil {
+			return nil, ErrNoMergeOperator
+		}
+
+		return t.MergeOperator(key, old, exists, operand)
+	})
+}
+
+// Merges the operand into the key of the default collection. See BTree.Merge.
+func (e *DB) Merge(key []byte, operand []byte) error {
+	tree, err := e.Collection(DefaultCollection)
+	if err != nil {
+		return err
+	}
+
+	return tree.Merge(key, operand)
+}
+
+// Sets the merge operator of all collections, the open ones and the ones opened afterwards.
+func (e *DB) SetMergeOperator(operator MergeOperator) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.mergeOperator = operator
+	for _, tree := range e.collections {
+		tree.MergeOperator = operator
+	}
+}
+
+// Encodes n the way the int64 merge operators expect it.
+func EncodeInt64(n int64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(n))
+}
+
+func DecodeInt64(value []byte) (int64, error) {
+	if len(value) != 8 {
+		return 0, fmt.Errorf("%w: int64 needs 8 bytes, got %d", ErrInvalidOperand, len(value))
+	}
+
+	return int64(binary.LittleEndian.Uint64(value)), nil
+}
+
+// Adds the operand to the value. Both are encoded with EncodeInt64. A missing value counts as zero.
+func MergeInt64Add(key []byte, existing []byte, exists bool, operand []byte) ([]byte, error) {
+	return mergeInt64(existing, exists, operand, func(a int64, b int64) int64 {
+		return a + b
+	})
+}
+
+// Keeps the larger of the value and the operand. Both are encoded with EncodeInt64.
+func MergeInt64Max(key []byte, existing []byte, exists bool, operand []byte) ([]byte, error) {
+	return mergeInt64(existing, exists, operand, func(a int64, b int64) int64 {
+		return max(a, b)
+	})
+}
+
+func mergeInt64(existing []byte, exists bool, operand []byte, combine func(int64, int64) int64) ([]byte, error) {
+	n, err := DecodeInt64(operand)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return operand, nil
+	}
+
+	current, err := DecodeInt64(existing)
+	if err != nil {
+		return nil, err
+	}
+
+	return EncodeInt64(combine(current, n)), nil
+}
+
+// Returns an operator that appends the operand to the value and drops the
+// oldest bytes once the value is longer than limit. Returns ErrInvalidCap
+// unless the limit is between 1 and MaxValueSize.
+func MergeAppendWithCap(limit int) (MergeOperator, error) {
+	if limit < 1 || limit > MaxValueSize {
+		return nil, fmt.Errorf("%w: got %d", ErrInvalidCap, limit)
+	}
+
+	return func(key []byte, existing []byte, exists bool, operand []byte) ([]byte, error) {
+		value := make([]byte, 0, len(existing)+len(operand))
+		value = append(value, existing...)
+		value = append(value, operand...)
+
+		if len(value) > limit {
+			value = value[len(value)-limit:]
+		}
+
+		return value, nil
+	}, nil
+}
@@ -0,0 +1,160 @@
+package db_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/db"
+	"github.com/rettenwander/mellowdb/io"
+)
+
+func TestMergeInt64(t *testing.T) {
+	reader := &NodeReaderMOCK{
+		nodes:       make(map[int64]db.Node),
+		MaxNodeSize: 512,
+	}
+
+	tree := db.NewBTree(reader, 0)
+	if err := tree.Merge([]byte("counter"), db.EncodeInt64(1)); !errors.Is(err, db.ErrNoMergeOperator) {
+		t.Fatalf("Expected ErrNoMergeOperator, got %v", err)
+	}
+
+	tree.MergeOperator = db.MergeInt64Add
+	for _, n := range []int64{5, -2, 10} {
+		if err := tree.Merge([]byte("counter"), db.EncodeInt64(n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertInt64(t, tree, "counter", 13)
+
+	if err := tree.Merge([]byte("counter"), []byte("bad")); !errors.Is(err, db.ErrInvalidOperand) {
+		t.Fatalf("Expected ErrInvalidOperand, got %v", err)
+	}
+
+	tree.MergeOperator = db.MergeInt64Max
+	for _, n := range []int64{-5, 7, 3} {
+		if err := tree.Merge([]byte("max"), db.EncodeInt64(n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertInt64(t, tree, "max", 7)
+}
+
+func assertInt64(t *testing.T, tree *db.BTree, key string, expected int64) {
+	item, err := tree.Find([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := db.DecodeInt64(item.Value())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != expected {
+		t.Fatalf("Value of %s is %d, expected %d", key, n, expected)
+	}
+}
+
+func TestMergeAppendWithCap(t *testing.T) {
+	reader := &NodeReaderMOCK{
+		nodes:       make(map[int64]db.Node),
+		MaxNodeSize: 512,
+	}
+
+	operator, err := db.MergeAppendWithCap(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := db.NewBTree(reader, 0)
+	tree.MergeOperator = operator
+
+	for _, operand := range []string{"abc", "def", "ghi"} {
+		if err := tree.Merge([]byte("log"), []byte(operand)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	item, err := tree.Find([]byte("log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(item.Value()) != "bcdefghi" {
+		t.Fatalf("Value is %q, expected the last 8 bytes", item.Value())
+	}
+}
+
+func TestMergeAppendWithInvalidCap(t *testing.T) {
+	for _, limit := range []int{-1, 0, db.MaxValueSize + 1} {
+		if _, err := db.MergeAppendWithCap(limit); !errors.Is(err, db.ErrInvalidCap) {
+			t.Fatalf("Expected ErrInvalidCap for %d, got %v", limit, err)
+		}
+	}
+
+	if _, err := db.MergeAppendWithCap(db.MaxValueSize); err != nil {
+		t.Fatalf("Expected MaxValueSize to be a valid cap, got %v", err)
+	}
+}
+
+func TestMergeUsingDB(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	dbEngine, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	dbEngine.SetMergeOperator(db.MergeInt64Add)
+
+	for range 100 {
+		if err := dbEngine.Merge([]byte("visits"), db.EncodeInt64(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tree, err := dbEngine.Collection(db.DefaultCollection)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertInt64(t, tree, "visits", 100)
+}
+
+func TestSetMergeOperatorOnOpenCollection(t *testing.T) {
+	dbEngine, err := db.NewDBWithStorage(io.NewMemoryStorage(nil), io.EngineOptions{PageSize: io.MetadataPageSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	tree, err := dbEngine.Collection("counters")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		for range 100 {
+			if err := tree.Merge([]byte("visits"), db.EncodeInt64(1)); err != nil && !errors.Is(err, db.ErrNoMergeOperator) {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	dbEngine.SetMergeOperator(db.MergeInt64Add)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Merge([]byte("visits"), db.EncodeInt64(1)); err != nil {
+		t.Fatalf("Expected the operator to apply to the open collection, got %v", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"slices"
 
 	"github.com/rettenwander/mellowdb/io"
@@ -52,22 +53,32 @@ func (n *Node) WriteToBuffer(buf []byte) {
 		vlen := len(item.value)
 
 		// Write item offset to start (lPos)
-		offset := rPos - klen - vlen - 2
+		offset := rPos - item.Size()
 		binary.LittleEndian.PutUint16(buf[lPos:], uint16(offset))
 		lPos += 2
 
 		// Write Key and Value to the end of buffer (rPos)
 		// Format
 		//
-		// -------------------------------------------
-		// | Key Length | Key | Value Length | Vlaue | rPos
-		// -------------------------------------------
+		// ----------------------------------------------------------------
+		// | Key Length | Key | Flags | [Expiry] | Value Length | Vlaue | rPos
+		// ----------------------------------------------------------------
+		//
+		// Expiry is only written if the item has itemFlagExpires set.
 		rPos -= vlen
 		copy(buf[rPos:], item.value)
 
 		rPos -= 1
 		buf[rPos] = byte(vlen)
 
+		if item.hasExpiry() {
+			rPos -= expirySize
+			binary.LittleEndian.PutUint64(buf[rPos:], uint64(item.expiresAt))
+		}
+
+		rPos -= 1
+		buf[rPos] = item.flags
+
 		rPos -= klen
 		copy(buf[rPos:], item.key)
 
@@ -82,57 +93,110 @@ func (n *Node) WriteToBuffer(buf []byte) {
 
 }
 
-// This func expects the buffer to be large enough for node serialization.
-func (n *Node) ReadFromBuffer(buf []byte) {
+// Decodes the node from a page. Offsets and lengths are checked against the
+// buffer, a corrupt page returns ErrCorruptNode.
+func (n *Node) ReadFromBuffer(buf []byte) error {
+	if len(buf) < 3 {
+		return fmt.Errorf("%w: page has %d bytes", ErrCorruptNode, len(buf))
+	}
+
 	lPos := 0
 
+	if buf[lPos] > 1 {
+		return fmt.Errorf("%w: invalid leaf flag %d", ErrCorruptNode, buf[lPos])
+	}
 	isLeaf := uint8(buf[lPos]) == 1
 	lPos += 1
 
 	itemCount := int(binary.LittleEndian.Uint16(buf[lPos:]))
 	lPos += 2
 
-	n.items = make([]*Item, 0, itemCount)
-	//n.children = make([]io.PageID, itemCount+1)
+	// The offsets and child pointers come before the items.
+	header := lPos + itemCount*2
+	if !isLeaf {
+		header += (itemCount + 1) * io.PageIDSize
+	}
+	if header > len(buf) {
+		return fmt.Errorf("%w: %d items don't fit into the page", ErrCorruptNode, itemCount)
+	}
+
+	items := make([]*Item, 0, itemCount)
+	var children []io.PageID
 
 	for i := 0; i < itemCount; i++ {
 		if !isLeaf {
 			pageID := io.PageID(binary.LittleEndian.Uint64(buf[lPos:]))
 			lPos += io.PageIDSize
 
-			n.children = append(n.children, pageID)
+			children = append(children, pageID)
 		}
 
-		//Write offset to the fix left side
-		offset := binary.LittleEndian.Uint16(buf[lPos:])
+		offset := int(binary.LittleEndian.Uint16(buf[lPos:]))
 		lPos += 2
 
-		// Write Key Value to the right side in this format
-		// -------------------------------------------
-		// | Value | Value Length | Key | Key Length |
-		// -------------------------------------------
+		// Read Key Value from the right side in this format
+		// ----------------------------------------------------------------
+		// | Value | Value Length | [Expiry] | Flags | Key | Key Length |
+		// ----------------------------------------------------------------
+		item, err := readItem(buf, offset, header)
+		if err != nil {
+			return fmt.Errorf("%w: item %d: %v", ErrCorruptNode, i, err)
+		}
+
+		items = append(items, item)
+	}
+
+	if !isLeaf {
+		pageID := io.PageID(binary.LittleEndian.Uint64(buf[lPos:]))
+		lPos += io.PageIDSize
 
-		klen := uint16(buf[offset])
-		offset += 1
+		children = append(children, pageID)
+	}
 
-		key := buf[offset : offset+klen]
-		offset += uint16(klen)
+	n.items = items
+	n.children = children
+	return nil
+}
 
-		vlen := uint16(buf[offset])
-		offset += 1
+// Reads the item at offset. Items are stored behind the header.
+func readItem(buf []byte, offset int, header int) (*Item, error) {
+	if offset < header || offset >= len(buf) {
+		return nil, fmt.Errorf("offset %d is outside the item area", offset)
+	}
 
-		value := buf[offset : offset+vlen]
-		offset += uint16(vlen)
+	klen := int(buf[offset])
+	offset += 1
 
-		n.items = append(n.items, &Item{key: key, value: value})
+	// The key is followed by the flags and the value length.
+	if offset+klen+2 > len(buf) {
+		return nil, fmt.Errorf("key of %d bytes doesn't fit into the page", klen)
 	}
 
-	if !isLeaf {
-		pageID := io.PageID(binary.LittleEndian.Uint64(buf[lPos:]))
-		lPos += io.PageIDSize
+	key := buf[offset : offset+klen]
+	offset += klen
+
+	flags := buf[offset]
+	offset += 1
+
+	item := &Item{key: key, flags: flags}
+	if item.hasExpiry() {
+		if offset+expirySize+1 > len(buf) {
+			return nil, errors.New("expiry doesn't fit into the page")
+		}
 
-		n.children = append(n.children, pageID)
+		item.expiresAt = int64(binary.LittleEndian.Uint64(buf[offset:]))
+		offset += expirySize
 	}
+
+	vlen := int(buf[offset])
+	offset += 1
+
+	if offset+vlen > len(buf) {
+		return nil, fmt.Errorf("value of %d bytes doesn't fit into the page", vlen)
+	}
+
+	item.value = buf[offset : offset+vlen]
+	return item, nil
 }
 
 func (n *Node) AddItem(i *Item, index int) {
@@ -1,9 +1,11 @@
 package db_test
 
 import (
+	"errors"
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/rettenwander/mellowdb/db"
 )
@@ -20,7 +22,9 @@ func TestNodeRW(t *testing.T) {
 	node.WriteToBuffer(buf)
 
 	node2 := db.NewEmptyNode(1)
-	node2.ReadFromBuffer(buf)
+	if err := node2.ReadFromBuffer(buf); err != nil {
+		t.Fatal(err)
+	}
 
 	if !reflect.DeepEqual(node, node2) {
 		t.Fatal("Node is not equal after RW")
@@ -40,3 +44,30 @@ func TestFindKeyInNode(t *testing.T) {
 		t.Fatal("key not found")
 	}
 }
+
+func FuzzNodeReadFromBuffer(f *testing.F) {
+	leaf := db.NewEmptyNode(1)
+	for i, key := range []string{"a", "b", "c"} {
+		item, _ := db.NewItemWithExpiry([]byte(key), []byte("value "+key), time.Now())
+		leaf.AddItem(item, i)
+	}
+
+	buf := make([]byte, 256)
+	leaf.WriteToBuffer(buf)
+	f.Add(buf)
+	f.Add(make([]byte, 256))
+	f.Add([]byte{0, 1, 0, 2})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		node := db.NewEmptyNode(1)
+		if err := node.ReadFromBuffer(data); err != nil {
+			if !errors.Is(err, db.ErrCorruptNode) {
+				t.Fatalf("Expected ErrCorruptNode, got %v", err)
+			}
+			return
+		}
+
+		node.Size()
+		node.FindKeyInNode([]byte("b"))
+	})
+}
@@ -0,0 +1,182 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/rettenwander/mellowdb/io"
+)
+
+type SyncMode int
+
+const (
+	// Writes are durable once Sync or Close returns.
+	SyncManual SyncMode = iota
+	// Every write to a tree of the DB syncs the DB before it returns.
+	SyncAlways
+)
+
+// Options of a DB. Zero values use the defaults.
+type Options struct {
+	// Page size of a new file, between io.MetadataPageSize and io.MaxPageSize.
+	// Zero uses the page size of an existing file, or os.Getpagesize() for a new one.
+	PageSize int
+
+	// A node is split once it fills more than MaxFill of its page and rebalanced
+	// once it fills less than MinFill. Default MinFillPercent and MaxFillPercent.
+	MinFill float64
+	MaxFill float64
+
+	// Limits of the keys and values written to collections, at most MaxKeySize
+	// and MaxValueSize. They are stored in the file; zero uses the stored limits,
+	// or the maximum for a new file.
+	MaxKeySize   int
+	MaxValueSize int
+
+	SyncMode SyncMode
+
+	// Encrypts the file, see io.EngineOptions.
+	EncryptionKey []byte
+
+	// Opens an existing file without ever writing it, see io.EngineOptions.
+	// Changes return ErrReadOnly.
+	ReadOnly bool
+}
+
+// Every node has to hold at least this many items of the maximum size.
+const minItemsPerNode = 4
+
+func (o Options) withDefaults() Options {
+	if o.MinFill == 0 {
+		o.MinFill = MinFillPercent
+	}
+	if o.MaxFill == 0 {
+		o.MaxFill = MaxFillPercent
+	}
+
+	return o
+}
+
+func (o Options) validate() error {
+	if o.PageSize != 0 && (o.PageSize < io.MetadataPageSize || o.PageSize > io.MaxPageSize) {
+		return io.ErrInvalidPageSize
+	}
+
+	if !(o.MinFill > 0 && o.MinFill < o.MaxFill && o.MaxFill <= 1) {
+		return fmt.Errorf("%w: fill bounds %v and %v must satisfy 0 < MinFill < MaxFill <= 1", ErrInvalidOptions, o.MinFill, o.MaxFill)
+	}
+
+	if o.MaxKeySize < 0 || o.MaxKeySize > MaxKeySize {
+		return fmt.Errorf("%w: key size limit %d must be between 1 and %d, or 0 for the default", ErrInvalidOptions, o.MaxKeySize, MaxKeySize)
+	}
+
+	if o.MaxValueSize < 0 || o.MaxValueSize > MaxValueSize {
+		return fmt.Errorf("%w: value size limit %d must be between 1 and %d, or 0 for the default", ErrInvalidOptions, o.MaxValueSize, MaxValueSize)
+	}
+
+	if o.SyncMode != SyncManual && o.SyncMode != SyncAlways {
+		return fmt.Errorf("%w: unknown sync mode %d", ErrInvalidOptions, o.SyncMode)
+	}
+
+	return nil
+}
+
+// Opens the DB file at path with the options.
+func NewDBWithOptions(path string, options Options) (*DB, error) {
+	options = options.withDefaults()
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+
+	engineOptions := options.engineOptions()
+	engineOptions.FileName = path
+
+	ioEngine, err := io.NewEngine(engineOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDB(ioEngine, options)
+}
+
+// Opens a DB on storage with the options, see io.NewEngineWithStorage.
+func NewDBWithStorageAndOptions(storage io.Storage, options Options) (*DB, error) {
+	options = options.withDefaults()
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+
+	ioEngine, err := io.NewEngineWithStorage(storage, options.engineOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	return newDB(ioEngine, options)
+}
+
+func (o Options) engineOptions() io.EngineOptions {
+	return io.EngineOptions{
+		PageSize:      uint32(o.PageSize),
+		EncryptionKey: o.EncryptionKey,
+		ReadOnly:      o.ReadOnly,
+	}
+}
+
+// Takes the size limits from the file, or records them for a new file.
+// Checks that a node holds enough items of the maximum size to be split.
+func (e *DB) applyLimits(options Options) error {
+	keySize, err := storedLimit("key", options.MaxKeySize, e.io.MaxKeySize, MaxKeySize)
+	if err != nil {
+		return err
+	}
+
+	valueSize, err := storedLimit("value", options.MaxValueSize, e.io.MaxValueSize, MaxValueSize)
+	if err != nil {
+		return err
+	}
+
+	// Key length, key, flags, expiry, value length and value, plus the offset and child pointer.
+	itemSize := 1 + keySize + 1 + expirySize + 1 + valueSize + 2 + io.PageIDSize
+	nodeSize := float64(e.io.PageDataSize()) * options.MaxFill
+	if float64(3+io.PageIDSize+minItemsPerNode*itemSize) > nodeSize {
+		return fmt.Errorf("%w: %d bytes of a page hold less than %d items of the maximum size", ErrInvalidOptions, int(nodeSize), minItemsPerNode)
+	}
+
+	options.MaxKeySize, options.MaxValueSize = keySize, valueSize
+	e.io.MaxKeySize, e.io.MaxValueSize = uint32(keySize), uint32(valueSize)
+	e.options = options
+
+	return nil
+}
+
+// Returns the options of the DB, with the defaults and the size limits of the
+// file filled in. The encryption key is left out.
+func (e *DB) Options() Options {
+	options := e.options
+	options.EncryptionKey = nil
+	return options
+}
+
+// Returns the limit of the file, or the requested limit for a new file.
+func storedLimit(name string, requested int, stored uint32, maximum int) (int, error) {
+	switch {
+	case stored == 0 && requested == 0:
+		return maximum, nil
+	case stored == 0:
+		return requested, nil
+	case stored > uint32(maximum):
+		return 0, fmt.Errorf("%w: %s size limit %d", io.ErrCorruptMetadata, name, stored)
+	case requested != 0 && requested != int(stored):
+		return 0, fmt.Errorf("%w: the file has a %s size limit of %d", ErrInvalidOptions, name, stored)
+	}
+
+	return int(stored), nil
+}
+
+// Syncs the DB if its SyncMode is SyncAlways. The caller must not hold the lock of the DB.
+func (e *DB) syncAlways() error {
+	if e.options.SyncMode != SyncAlways {
+		return nil
+	}
+
+	return e.Sync()
+}
@@ -0,0 +1,236 @@
+package db_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/db"
+	"github.com/rettenwander/mellowdb/io"
+)
+
+func TestInvalidOptions(t *testing.T) {
+	tests := map[string]db.Options{
+		"min fill above max":     {MinFill: 0.8, MaxFill: 0.6},
+		"max fill above one":     {MaxFill: 1.5},
+		"negative min fill":      {MinFill: -0.1},
+		"key limit too large":    {MaxKeySize: db.MaxKeySize + 1},
+		"value limit too large":  {MaxValueSize: db.MaxValueSize + 1},
+		"unknown sync mode":      {SyncMode: 7},
+		"page too small for max": {MinFill: 0.05, MaxFill: 0.1},
+	}
+
+	for name, options := range tests {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "test.mellow")
+
+			dbEngine, err := db.NewDBWithOptions(file, options)
+			if !errors.Is(err, db.ErrInvalidOptions) {
+				if err == nil {
+					dbEngine.Close()
+				}
+				t.Fatalf("Expected ErrInvalidOptions, got %v", err)
+			}
+		})
+	}
+
+	file := filepath.Join(t.TempDir(), "test.mellow")
+	if _, err := db.NewDBWithOptions(file, db.Options{PageSize: 1024}); !errors.Is(err, io.ErrInvalidPageSize) {
+		t.Fatalf("Expected ErrInvalidPageSize, got %v", err)
+	}
+
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("Invalid options created the file: %v", err)
+	}
+}
+
+func TestOptionsAreStored(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+	options := db.Options{PageSize: 8192, MaxKeySize: 16, MaxValueSize: 32}
+
+	dbEngine, err := db.NewDBWithOptions(file, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkLimits := func(dbEngine *db.DB) {
+		t.Helper()
+
+		tree, err := dbEngine.Collection(db.DefaultCollection)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		item, _ := db.NewItem(bytes.Repeat([]byte("k"), 17), []byte("value"))
+		if err := tree.Insert(item); !errors.Is(err, db.ErrKeyTooLong) {
+			t.Fatalf("Expected ErrKeyTooLong, got %v", err)
+		}
+
+		item, _ = db.NewItem([]byte("key"), bytes.Repeat([]byte("v"), 33))
+		if err := tree.Insert(item); !errors.Is(err, db.ErrValueTooLong) {
+			t.Fatalf("Expected ErrValueTooLong, got %v", err)
+		}
+
+		item, _ = db.NewItem(bytes.Repeat([]byte("k"), 16), bytes.Repeat([]byte("v"), 32))
+		if err := tree.Insert(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkLimits(dbEngine)
+	if err := dbEngine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Zero values use the stored page size and limits.
+	dbEngine, err = db.NewDBWithOptions(file, db.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkLimits(dbEngine)
+	if err := dbEngine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.NewDBWithOptions(file, db.Options{MaxKeySize: 20}); !errors.Is(err, db.ErrInvalidOptions) {
+		t.Fatalf("Expected ErrInvalidOptions for a different key limit, got %v", err)
+	}
+
+	if _, err := db.NewDBWithOptions(file, db.Options{PageSize: 4096}); !errors.Is(err, io.ErrPageSizeNotUsed) {
+		t.Fatalf("Expected ErrPageSizeNotUsed, got %v", err)
+	}
+}
+
+func TestFillOptions(t *testing.T) {
+	nodes := func(options db.Options) int {
+		dbEngine, err := db.NewDBWithOptions(filepath.Join(t.TempDir(), "test.mellow"), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dbEngine.Close()
+
+		tree, err := dbEngine.Collection(db.DefaultCollection)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range 2000 {
+			item, _ := db.NewItem([]byte(strconv.Itoa(i)), bytes.Repeat([]byte("v"), 40))
+			if err := tree.Insert(item); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if problems := dbEngine.Check(); len(problems) != 0 {
+			t.Fatalf("Check found problems: %v", problems)
+		}
+
+		stats, err := tree.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return stats.Nodes
+	}
+
+	full := nodes(db.Options{PageSize: 4096})
+	sparse := nodes(db.Options{PageSize: 4096, MinFill: 0.1, MaxFill: 0.3})
+
+	if sparse <= full {
+		t.Fatalf("Expected more nodes with a lower fill, got %d and %d", sparse, full)
+	}
+}
+
+func TestSyncAlways(t *testing.T) {
+	dbEngine, err := db.NewDBWithOptions(filepath.Join(t.TempDir(), "test.mellow"), db.Options{SyncMode: db.SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	tree, err := dbEngine.Collection(db.DefaultCollection)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := dbEngine.CommitSequence()
+
+	item, _ := db.NewItem([]byte("key"), []byte("value"))
+	if err := tree.Insert(item); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Delete([]byte("key")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := dbEngine.CommitSequence(); got != before+2 {
+		t.Fatalf("Expected a commit per write, got sequence %d after %d", got, before)
+	}
+}
+
+func TestStorageWithOptions(t *testing.T) {
+	storage := io.NewMemoryStorage(nil)
+	options := db.Options{PageSize: io.MetadataPageSize, MaxKeySize: 8}
+
+	dbEngine, err := db.NewDBWithStorageAndOptions(storage, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := dbEngine.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, _ := db.NewItem([]byte("too long key"), []byte("v"))
+	if err := tree.Insert(item); !errors.Is(err, db.ErrKeyTooLong) {
+		t.Fatalf("Expected ErrKeyTooLong, got %v", err)
+	}
+
+	item, _ = db.NewItem([]byte("key"), []byte("v"))
+	if err := tree.Insert(item); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dbEngine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.NewDBWithStorageAndOptions(storage, db.Options{MinFill: 0.8, MaxFill: 0.6}); !errors.Is(err, db.ErrInvalidOptions) {
+		t.Fatalf("Expected ErrInvalidOptions, got %v", err)
+	}
+
+	if dbEngine, err = db.NewDBWithStorageAndOptions(storage, db.Options{ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	if _, err := dbEngine.Collection("other"); !errors.Is(err, db.ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly, got %v", err)
+	}
+}
+
+func TestLimitsApplyToEveryTree(t *testing.T) {
+	dbEngine, err := db.NewDBWithOptions(filepath.Join(t.TempDir(), "test.mellow"), db.Options{MaxKeySize: 16, MaxValueSize: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	// Collection names are keys of the catalog, which isn't limited.
+	if _, err := dbEngine.Collection(strings.Repeat("c", 40)); err != nil {
+		t.Fatal(err)
+	}
+
+	tree := db.NewBTree(dbEngine, 0)
+	item, _ := db.NewItem(bytes.Repeat([]byte("k"), 17), []byte("value"))
+	if err := tree.Insert(item); !errors.Is(err, db.ErrKeyTooLong) {
+		t.Fatalf("Expected ErrKeyTooLong for a tree without a collection, got %v", err)
+	}
+}
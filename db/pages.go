@@ -0,0 +1,106 @@
+package db
+
+import (
+	"slices"
+	"sort"
+
+	"github.com/rettenwander/mellowdb/io"
+)
+
+type PageType string
+
+const (
+	PageMetadata PageType = "metadata"
+	PageLeaf     PageType = "leaf"
+	PageInternal PageType = "internal"
+	PageFree     PageType = "free"
+	// The page holds part of the list of free pages.
+	PageFreelist PageType = "freelist"
+	// The page is neither referenced by a tree nor released.
+	PageUnreachable PageType = "unreachable"
+)
+
+// PageInfo describes a page of the DB file.
+type PageInfo struct {
+	ID   io.PageID
+	Type PageType
+
+	// Name of the collection of a node page. Empty for the catalog.
+	Collection string
+	Depth      int
+	Items      int
+	// Size of the node relative to the page size.
+	Fill float64
+}
+
+// Returns every page of the DB file ordered by page ID.
+func (e *DB) Pages() ([]PageInfo, error) {
+	e.collectionsMu.Lock()
+	defer e.collectionsMu.Unlock()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	trees := map[string]*BTree{"": e.catalog}
+	err := e.catalog.forEachItem(func(i *Item) error {
+		record, err := decodeCollectionRecord(i.value)
+		if err != nil {
+			return err
+		}
+
+		trees[string(i.key)] = NewBTree(e, record.root)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for name, tree := range e.collections {
+		trees[name] = tree
+	}
+
+	pages := map[io.PageID]PageInfo{0: {ID: 0, Type: PageMetadata}}
+	for name, tree := range trees {
+		err := tree.walk(func(n *Node, depth int) error {
+			info := PageInfo{
+				ID:         n.pageId,
+				Type:       PageLeaf,
+				Collection: name,
+				Depth:      depth,
+				Items:      len(n.items),
+				Fill:       float64(n.Size()) / float64(e.GetMaxNodeSize()),
+			}
+			if !n.isLeaf() {
+				info.Type = PageInternal
+			}
+
+			pages[n.pageId] = info
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, id := range slices.Concat(e.io.ReleasedPages, e.io.PendingPages()) {
+		pages[id] = PageInfo{ID: id, Type: PageFree}
+	}
+
+	for _, id := range e.io.FreelistPages() {
+		pages[id] = PageInfo{ID: id, Type: PageFreelist}
+	}
+
+	for id := io.PageID(1); id <= e.io.MaxPageID; id++ {
+		if _, ok := pages[id]; !ok {
+			pages[id] = PageInfo{ID: id, Type: PageUnreachable}
+		}
+	}
+
+	infos := make([]PageInfo, 0, len(pages))
+	for _, info := range pages {
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos, nil
+}
@@ -0,0 +1,59 @@
+package db_test
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/db"
+)
+
+func TestPages(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	dbEngine, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	tree, err := dbEngine.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 2000 {
+		item, _ := db.NewItem([]byte(strconv.Itoa(i)), []byte("value"))
+		tree.Insert(item)
+	}
+
+	for i := range 1500 {
+		tree.Delete([]byte(strconv.Itoa(i)))
+	}
+
+	pages, err := dbEngine.Pages()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[db.PageType]int{}
+	for i, page := range pages {
+		if page.ID != int64(i) {
+			t.Fatalf("Expected page %d at position %d, got %d", i, i, page.ID)
+		}
+
+		counts[page.Type]++
+
+		if page.Type == db.PageLeaf && page.Collection == "users" && (page.Fill <= 0 || page.Fill > 1) {
+			t.Fatalf("Unexpected fill of page %+v", page)
+		}
+	}
+
+	if counts[db.PageMetadata] != 1 || counts[db.PageLeaf] == 0 || counts[db.PageInternal] == 0 || counts[db.PageFree] == 0 {
+		t.Fatalf("Unexpected page types %v", counts)
+	}
+
+	if counts[db.PageUnreachable] != 0 {
+		t.Fatalf("Expected no unreachable pages, got %d", counts[db.PageUnreachable])
+	}
+}
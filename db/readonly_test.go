@@ -0,0 +1,116 @@
+package db_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/db"
+	"github.com/rettenwander/mellowdb/io"
+)
+
+func TestReadOnly(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	if _, err := db.NewDBWithOptions(file, db.Options{ReadOnly: true}); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected ErrNotExist for a missing file, got %v", err)
+	}
+
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("Read-only open created the file: %v", err)
+	}
+
+	writer, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := writer.Collection(db.DefaultCollection)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, _ := db.NewItem([]byte("key"), []byte("value"))
+	if err := tree.Insert(item); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.NewDBWithOptions(file, db.Options{ReadOnly: true}); !errors.Is(err, io.ErrLocked) {
+		t.Fatalf("Expected ErrLocked while a writer has the file open, got %v", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := db.NewDBWithOptions(file, db.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers share the lock.
+	other, err := db.NewDBWithOptions(file, db.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+
+	if _, err := db.NewDB(file); !errors.Is(err, io.ErrLocked) {
+		t.Fatalf("Expected ErrLocked while a reader has the file open, got %v", err)
+	}
+
+	tree, err = reader.Collection(db.DefaultCollection)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found, err := tree.Find([]byte("key")); err != nil || !bytes.Equal(found.Value(), []byte("value")) {
+		t.Fatalf("Expected the stored value, got %v", err)
+	}
+
+	item, _ = db.NewItem([]byte("other"), []byte("value"))
+	changes := map[string]func() error{
+		"insert": func() error { return tree.Insert(item) },
+		"delete": func() error { return tree.Delete([]byte("key")) },
+		"update": func() error {
+			return tree.Update([]byte("key"), func([]byte, bool) ([]byte, error) { return []byte("new"), nil })
+		},
+		"sequence": func() error { _, err := tree.NextSequence(); return err },
+		"sync":     reader.Sync,
+		"collection": func() error {
+			_, err := reader.Collection("new")
+			return err
+		},
+		"import": func() error {
+			_, err := reader.Import(strings.NewReader(`{"collection":"default","key":"YQ==","value":"Yg=="}`))
+			return err
+		},
+	}
+
+	for name, change := range changes {
+		if err := change(); !errors.Is(err, db.ErrReadOnly) {
+			t.Fatalf("Expected ErrReadOnly from %s, got %v", name, err)
+		}
+	}
+
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(before, after) {
+		t.Fatal("Read-only DB changed the file")
+	}
+}
@@ -0,0 +1,630 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	stdio "io"
+	"sync"
+	"time"
+)
+
+// Replication ships the committed changes of a primary DB to followers as
+// JSON messages over any io.ReadWriter:
+//
+//	follower -> primary  hello     the last applied commit
+//	primary -> follower  snapshot  the follower drops its items, puts follow
+//	primary -> follower  put       store an item
+//	primary -> follower  delete    delete a key
+//	primary -> follower  commit    the changes up to the sequence are complete
+//	primary -> follower  heartbeat the last commit of the primary
+//
+// The primary keeps a backlog of recent commits. A follower that reconnects
+// resumes after its last applied commit if the backlog still has it, and
+// gets a snapshot of all collections otherwise.
+
+const (
+	replicationCollection = "\x00replication"
+	// Number of items read from a collection at once for snapshots.
+	replicationBatchSize = 1000
+)
+
+type ReplicationOptions struct {
+	// Number of changes kept for followers that reconnect, each commit counts
+	// as one more. Zero uses 100000.
+	Backlog int
+	// Interval of heartbeats that let idle followers compute their lag. Zero uses one second.
+	HeartbeatInterval time.Duration
+}
+
+type replicationMessage struct {
+	Type     string `json:"type"`
+	Sequence uint64 `json:"sequence,omitempty"`
+	// Last commit of the primary.
+	Latest uint64 `json:"latest,omitempty"`
+	// Set in a hello by followers that finished a snapshot.
+	Synced bool `json:"synced,omitempty"`
+
+	Collection string     `json:"collection,omitempty"`
+	Key        []byte     `json:"key,omitempty"`
+	Value      []byte     `json:"value,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+type replicationCommit struct {
+	sequence uint64
+	changes  []ChangeEvent
+}
+
+// Primary serves the commits of a DB to followers.
+type Primary struct {
+	db      *DB
+	options ReplicationOptions
+	hook    *commitHook
+
+	mu      sync.Mutex
+	backlog []replicationCommit
+	size    int
+	// Followers that applied this commit or a later one can resume from the backlog.
+	resumeFrom uint64
+	latest     uint64
+	// Closed and replaced on every commit.
+	notify chan struct{}
+}
+
+func NewPrimary(db *DB, options ReplicationOptions) *Primary {
+	if options.Backlog == 0 {
+		options.Backlog = 100000
+	}
+	if options.HeartbeatInterval == 0 {
+		options.HeartbeatInterval = time.Second
+	}
+
+	p := &Primary{db: db, options: options, notify: make(chan struct{})}
+	p.hook = &commitHook{fn: p.commit, lost: p.lost}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	p.latest = db.io.CommitSequence
+	p.resumeFrom = p.latest
+	db.addCommitHookAfterChanges(p.hook)
+
+	return p
+}
+
+// Stops recording commits. Running Serve calls return once their context is done.
+func (p *Primary) Close() {
+	p.db.removeCommitHook(p.hook)
+}
+
+func (p *Primary) commit(sequence uint64, changes []ChangeEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.latest = sequence
+
+	// Commits without changes are kept too, so followers know they're up to date.
+	p.backlog = append(p.backlog, replicationCommit{sequence: sequence, changes: changes})
+	p.size += len(changes) + 1
+
+	for p.size > p.options.Backlog {
+		p.resumeFrom = p.backlog[0].sequence
+		p.size -= len(p.backlog[0].changes) + 1
+		p.backlog = p.backlog[1:]
+	}
+
+	close(p.notify)
+	p.notify = make(chan struct{})
+}
+
+// Drops the backlog, so every follower takes a new snapshot.
+func (p *Primary) lost(sequence uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.latest = sequence
+	p.resumeFrom = sequence
+	p.backlog = nil
+	p.size = 0
+
+	close(p.notify)
+	p.notify = make(chan struct{})
+}
+
+// Streams commits to the follower on rw until ctx is done or the connection
+// fails. If rw is an io.Closer, it's closed when ctx is done.
+func (p *Primary) Serve(ctx context.Context, rw stdio.ReadWriter) error {
+	if closer, ok := rw.(stdio.Closer); ok {
+		stop := context.AfterFunc(ctx, func() { closer.Close() })
+		defer stop()
+	}
+
+	hello := replicationMessage{}
+	if err := json.NewDecoder(rw).Decode(&hello); err != nil {
+		return fmt.Errorf("%w: %v", ErrReplication, err)
+	}
+
+	if hello.Type != "hello" {
+		return fmt.Errorf("%w: expected hello, got %q", ErrReplication, hello.Type)
+	}
+
+	encoder := json.NewEncoder(rw)
+	sent := hello.Sequence
+
+	p.mu.Lock()
+	resume := hello.Synced && sent >= p.resumeFrom && sent <= p.latest
+	p.mu.Unlock()
+
+	if !resume {
+		var err error
+		if sent, err = p.sendSnapshot(encoder); err != nil {
+			return err
+		}
+	}
+
+	heartbeat := time.NewTicker(p.options.HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		p.mu.Lock()
+		if sent < p.resumeFrom {
+			p.mu.Unlock()
+			return fmt.Errorf("%w: the follower fell behind the backlog", ErrReplication)
+		}
+
+		var commits []replicationCommit
+		for i := len(p.backlog) - 1; i >= 0 && p.backlog[i].sequence > sent; i-- {
+			commits = p.backlog[i:]
+		}
+		latest := p.latest
+		notify := p.notify
+		p.mu.Unlock()
+
+		for _, c := range commits {
+			if err := p.sendCommit(encoder, c, latest); err != nil {
+				return err
+			}
+
+			sent = c.sequence
+		}
+
+		if len(commits) > 0 {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-notify:
+		case <-heartbeat.C:
+			if err := encoder.Encode(replicationMessage{Type: "heartbeat", Latest: latest}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *Primary) sendCommit(encoder *json.Encoder, c replicationCommit, latest uint64) error {
+	for _, change := range c.changes {
+		msg := replicationMessage{Type: "put", Collection: change.Collection, Key: change.Key, Value: change.NewValue}
+		if change.Type == ChangeDelete {
+			msg = replicationMessage{Type: "delete", Collection: change.Collection, Key: change.Key}
+		}
+
+		if !change.ExpiresAt.IsZero() {
+			msg.ExpiresAt = &change.ExpiresAt
+		}
+
+		if err := encoder.Encode(msg); err != nil {
+			return err
+		}
+	}
+
+	return encoder.Encode(replicationMessage{Type: "commit", Sequence: c.sequence, Latest: latest})
+}
+
+// Sends the items of the last commit and returns its sequence. The pages of
+// the commit are held until the snapshot is sent, so it's read from the
+// committed roots while writers go on.
+func (p *Primary) sendSnapshot(encoder *json.Encoder) (uint64, error) {
+	p.db.mu.Lock()
+	sequence := p.db.io.CommitSequence
+	catalog := NewBTree(p.db, p.db.io.RootPageID)
+	p.db.io.HoldFreedPages()
+	p.db.mu.Unlock()
+
+	defer func() {
+		p.db.mu.Lock()
+		p.db.io.ReleaseFreedPages()
+		p.db.mu.Unlock()
+	}()
+
+	if err := encoder.Encode(replicationMessage{Type: "snapshot", Sequence: sequence}); err != nil {
+		return 0, err
+	}
+
+	names := []string{}
+	records := []collectionRecord{}
+	var decodeErr error
+	err := catalog.Scan(nil, nil, func(i *Item) bool {
+		if isInternalCollection(string(i.key)) {
+			return true
+		}
+
+		record, err := decodeCollectionRecord(i.value)
+		if err != nil {
+			decodeErr = err
+			return false
+		}
+
+		names = append(names, string(i.key))
+		records = append(records, record)
+		return true
+	})
+	if err == nil {
+		err = decodeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for n, name := range names {
+		tree := NewBTree(p.db, records[n].root)
+
+		// Read in batches, so writers aren't blocked while the follower receives.
+		var start []byte
+		for more := true; more; {
+			more = false
+			msgs := make([]replicationMessage, 0, replicationBatchSize)
+			err := tree.Scan(start, nil, func(i *Item) bool {
+				if len(msgs) == replicationBatchSize {
+					start = append([]byte(nil), i.key...)
+					more = true
+					return false
+				}
+
+				msg := replicationMessage{Type: "put", Collection: name, Key: bytes.Clone(i.key), Value: bytes.Clone(i.value)}
+				if expiresAt, ok := i.ExpiresAt(); ok {
+					msg.ExpiresAt = &expiresAt
+				}
+
+				msgs = append(msgs, msg)
+				return true
+			})
+			if err != nil {
+				return 0, err
+			}
+
+			for _, msg := range msgs {
+				if err := encoder.Encode(msg); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+
+	p.mu.Lock()
+	latest := p.latest
+	p.mu.Unlock()
+
+	return sequence, encoder.Encode(replicationMessage{Type: "commit", Sequence: sequence, Latest: latest})
+}
+
+// ReplicationLag describes how far a follower is behind its primary.
+type ReplicationLag struct {
+	// Number of commits of the primary the follower hasn't applied.
+	Commits uint64
+	// Time since the follower last heard from the primary. Zero before the first message.
+	SinceContact time.Duration
+}
+
+// Follower applies the commits of a primary to its DB. Once a Follower is
+// created, other writes to the collections of the DB fail with ErrFollowerDB.
+// The DB stays a follower DB when it's reopened, until StopFollowing.
+type Follower struct {
+	db    *DB
+	state *BTree
+
+	mu          sync.Mutex
+	applied     uint64
+	synced      bool
+	latest      uint64
+	lastContact time.Time
+}
+
+func NewFollower(db *DB) (*Follower, error) {
+	state, err := db.collection(replicationCollection, true)
+	if err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	db.follower = true
+	db.mu.Unlock()
+
+	f := &Follower{db: db, state: state}
+
+	item, err := state.Find([]byte("follower"))
+	if err == nil && len(item.value) == 9 {
+		f.applied = binary.LittleEndian.Uint64(item.value)
+		f.synced = item.value[8] == 1
+		f.latest = f.applied
+	} else if errors.Is(err, ErrNotFound) {
+		// The state marks the DB as a follower DB, see loadFollower.
+		if err := f.writeState(0, false); err != nil {
+			return nil, err
+		}
+
+		if err := db.Sync(); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Marks the DB as a follower DB if it has the state of a Follower.
+func (e *DB) loadFollower() error {
+	state, err := e.collection(replicationCollection, false)
+	if errors.Is(err, ErrCollectionNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	_, err = state.Find([]byte("follower"))
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	e.follower = true
+	return nil
+}
+
+// Drops the state of the Follower, so the DB takes writes again, e.g. to
+// promote a follower DB once its primary is gone. The Run of the Follower
+// must have returned, and the Follower can't be used afterwards.
+func (e *DB) StopFollowing() error {
+	state, err := e.collection(replicationCollection, false)
+	if errors.Is(err, ErrCollectionNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := state.Delete([]byte("follower")); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	if err := e.Sync(); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	e.follower = false
+	e.mu.Unlock()
+
+	return nil
+}
+
+// Returns the last commit of the primary applied by the follower.
+func (f *Follower) Applied() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.applied
+}
+
+func (f *Follower) Lag() ReplicationLag {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	lag := ReplicationLag{}
+	if f.latest > f.applied {
+		lag.Commits = f.latest - f.applied
+	}
+	if !f.lastContact.IsZero() {
+		lag.SinceContact = time.Since(f.lastContact)
+	}
+
+	return lag
+}
+
+// Receives commits from the primary on rw until ctx is done or the connection
+// fails. Call Run again with a new connection to resume. If rw is an io.Closer,
+// it's closed when ctx is done.
+func (f *Follower) Run(ctx context.Context, rw stdio.ReadWriter) error {
+	if closer, ok := rw.(stdio.Closer); ok {
+		stop := context.AfterFunc(ctx, func() { closer.Close() })
+		defer stop()
+	}
+
+	f.mu.Lock()
+	hello := replicationMessage{Type: "hello", Sequence: f.applied, Synced: f.synced}
+	f.mu.Unlock()
+
+	if err := json.NewEncoder(rw).Encode(hello); err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(rw)
+	for {
+		msg := replicationMessage{}
+		if err := decoder.Decode(&msg); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return err
+		}
+
+		if err := f.apply(msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (f *Follower) apply(msg replicationMessage) error {
+	f.mu.Lock()
+	f.lastContact = time.Now()
+	if msg.Latest > f.latest {
+		f.latest = msg.Latest
+	}
+	f.mu.Unlock()
+
+	switch msg.Type {
+	case "heartbeat":
+		return nil
+	case "snapshot":
+		return f.startSnapshot()
+	case "put":
+		tree, err := f.collection(msg.Collection)
+		if err != nil {
+			return err
+		}
+
+		var item *Item
+		if msg.ExpiresAt != nil {
+			item, err = NewItemWithExpiry(msg.Key, msg.Value, *msg.ExpiresAt)
+		} else {
+			item, err = NewItem(msg.Key, msg.Value)
+		}
+		if err != nil {
+			return err
+		}
+
+		return f.write(func() error {
+			return tree.upsert(item.key, func(*Item) (*Item, error) {
+				return item, nil
+			})
+		})
+	case "delete":
+		tree, err := f.collection(msg.Collection)
+		if err != nil {
+			return err
+		}
+
+		return f.write(func() error {
+			_, err := tree.delete(msg.Key, nil)
+			return err
+		})
+	case "commit":
+		if err := f.writeState(msg.Sequence, true); err != nil {
+			return err
+		}
+
+		return f.db.Sync()
+	default:
+		return fmt.Errorf("%w: unknown message %q", ErrReplication, msg.Type)
+	}
+}
+
+// Drops all items. Until the snapshot is committed the follower isn't synced,
+// so an interrupted snapshot starts over.
+func (f *Follower) startSnapshot() error {
+	if err := f.writeState(0, false); err != nil {
+		return err
+	}
+
+	names, err := f.db.Collections()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		tree, err := f.collection(name)
+		if err != nil {
+			return err
+		}
+
+		for {
+			keys := [][]byte{}
+			err := tree.Scan(nil, nil, func(i *Item) bool {
+				keys = append(keys, bytes.Clone(i.key))
+				return len(keys) < replicationBatchSize
+			})
+			if err != nil {
+				return err
+			}
+
+			if len(keys) == 0 {
+				break
+			}
+
+			err = f.write(func() error {
+				for _, key := range keys {
+					if _, err := tree.delete(key, nil); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return f.db.Sync()
+}
+
+// Opens the collection, a missing one is created.
+func (f *Follower) collection(name string) (*BTree, error) {
+	if err := checkCollectionName(name); err != nil {
+		return nil, err
+	}
+
+	return f.db.collection(name, true)
+}
+
+// Runs fn with the lock of the DB held, as the only writer of the collections.
+func (f *Follower) write(fn func() error) error {
+	err := func() error {
+		f.db.mu.Lock()
+		defer f.db.mu.Unlock()
+
+		f.db.applying = true
+		defer func() { f.db.applying = false }()
+
+		return fn()
+	}()
+
+	if err != nil {
+		return err
+	}
+
+	return f.db.syncAlways()
+}
+
+func (f *Follower) writeState(applied uint64, synced bool) error {
+	value := make([]byte, 9)
+	binary.LittleEndian.PutUint64(value, applied)
+	if synced {
+		value[8] = 1
+	}
+
+	item, err := NewItem([]byte("follower"), value)
+	if err != nil {
+		return err
+	}
+
+	if err := f.state.Insert(item); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.applied = applied
+	f.synced = synced
+	f.mu.Unlock()
+
+	return nil
+}
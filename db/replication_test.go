@@ -0,0 +1,471 @@
+package db_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rettenwander/mellowdb/db"
+)
+
+type replica struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Connects the follower to the primary over net.Pipe.
+func connect(primary *db.Primary, follower *db.Follower) *replica {
+	ctx, cancel := context.WithCancel(context.Background())
+	primaryConn, followerConn := net.Pipe()
+
+	r := &replica{cancel: cancel, done: make(chan struct{})}
+	go primary.Serve(ctx, primaryConn)
+	go func() {
+		follower.Run(ctx, followerConn)
+		close(r.done)
+	}()
+
+	return r
+}
+
+func (r *replica) disconnect() {
+	r.cancel()
+	<-r.done
+}
+
+func waitForFollower(t *testing.T, primaryDB *db.DB, follower *db.Follower) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for follower.Applied() != primaryDB.CommitSequence() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Follower applied %d, primary is at %d", follower.Applied(), primaryDB.CommitSequence())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func writeItems(t *testing.T, d *db.DB, collection string, from, to int, value string) {
+	tree, err := d.Collection(collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := from; i < to; i++ {
+		item, _ := db.NewItem(fmt.Appendf(nil, "%05d", i), []byte(value))
+		if err := tree.Insert(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := d.Sync(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func compareDBs(t *testing.T, primaryDB, followerDB *db.DB) {
+	t.Helper()
+
+	var primary, follower bytes.Buffer
+	if err := primaryDB.Export(&primary, db.ExportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := followerDB.Export(&follower, db.ExportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(primary.Bytes(), follower.Bytes()) {
+		t.Fatalf("The follower differs from the primary:\n%.500s\n---\n%.500s", primary.String(), follower.String())
+	}
+}
+
+func TestReplication(t *testing.T) {
+	dir := t.TempDir()
+
+	primaryDB, err := db.NewDB(filepath.Join(dir, "primary.mellow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primaryDB.Close()
+
+	followerFile := filepath.Join(dir, "follower.mellow")
+	followerDB, err := db.NewDB(followerFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Items written before the primary exists reach the follower with a snapshot.
+	writeItems(t, primaryDB, "users", 0, 500, "a")
+
+	primary := db.NewPrimary(primaryDB, db.ReplicationOptions{Backlog: 1000, HeartbeatInterval: 10 * time.Millisecond})
+	defer primary.Close()
+
+	follower, err := db.NewFollower(followerDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := connect(primary, follower)
+	waitForFollower(t, primaryDB, follower)
+	compareDBs(t, primaryDB, followerDB)
+
+	// Live changes.
+	writeItems(t, primaryDB, "orders", 0, 100, "b")
+	users, _ := primaryDB.Collection("users")
+	users.Delete([]byte("00007"))
+	expiring, _ := db.NewItemWithExpiry([]byte("session"), []byte("s"), time.Now().Add(time.Hour))
+	users.Insert(expiring)
+	primaryDB.Sync()
+
+	waitForFollower(t, primaryDB, follower)
+	compareDBs(t, primaryDB, followerDB)
+
+	if lag := follower.Lag(); lag.Commits != 0 {
+		t.Fatalf("Expected no lag, got %+v", lag)
+	}
+
+	r.disconnect()
+
+	// The follower resumes from the backlog after a reconnect and a restart.
+	if err := followerDB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeItems(t, primaryDB, "users", 100, 200, "c")
+
+	followerDB, err = db.NewDB(followerFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer followerDB.Close()
+
+	follower, err = db.NewFollower(followerDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if follower.Applied() == 0 {
+		t.Fatal("Expected the applied commit to survive a restart")
+	}
+
+	events := followerDB.Watch(context.Background(), nil)
+
+	r = connect(primary, follower)
+	defer r.disconnect()
+
+	waitForFollower(t, primaryDB, follower)
+	compareDBs(t, primaryDB, followerDB)
+
+	for len(events) > 0 {
+		event := <-events
+		if event.Type != db.ChangePut || string(event.NewValue) != "c" {
+			t.Fatalf("Expected only the new changes after resuming, got %+v", event)
+		}
+	}
+
+	// Commits without changes reach the follower as well.
+	primaryDB.Sync()
+	waitForFollower(t, primaryDB, follower)
+
+	// Heartbeats keep the contact fresh while the primary is idle. Once the
+	// commit is applied, only a heartbeat makes contact after idle.
+	idle := time.Now()
+	deadline := idle.Add(5 * time.Second)
+	for {
+		since := time.Since(idle)
+		lag := follower.Lag()
+		if lag.SinceContact < since {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a heartbeat, got %+v", lag)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReplicationSnapshotIsCommitted(t *testing.T) {
+	dir := t.TempDir()
+
+	primaryDB, err := db.NewDB(filepath.Join(dir, "primary.mellow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primaryDB.Close()
+
+	followerDB, err := db.NewDB(filepath.Join(dir, "follower.mellow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer followerDB.Close()
+
+	writeItems(t, primaryDB, "users", 0, 2500, "a")
+
+	// Written after the last commit, so the snapshot leaves it out.
+	users, _ := primaryDB.Collection("users")
+	item, _ := db.NewItem([]byte("uncommitted"), []byte("b"))
+	if err := users.Insert(item); err != nil {
+		t.Fatal(err)
+	}
+
+	primary := db.NewPrimary(primaryDB, db.ReplicationOptions{})
+	defer primary.Close()
+
+	follower, err := db.NewFollower(followerDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := connect(primary, follower)
+	waitForFollower(t, primaryDB, follower)
+
+	followerUsers, err := followerDB.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := followerUsers.Find([]byte("uncommitted")); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("Expected the uncommitted item to be left out of the snapshot, got %v", err)
+	}
+
+	if _, err := followerUsers.Find([]byte("02499")); err != nil {
+		t.Fatalf("Expected the committed items in the snapshot, got %v", err)
+	}
+
+	// The item wasn't queued for the next commit, so the follower needs a new
+	// snapshot after it.
+	writeItems(t, primaryDB, "users", 0, 2500, "c")
+	r.disconnect()
+
+	r = connect(primary, follower)
+	defer r.disconnect()
+
+	waitForFollower(t, primaryDB, follower)
+	compareDBs(t, primaryDB, followerDB)
+}
+
+func TestReplicationBacklogOverflow(t *testing.T) {
+	dir := t.TempDir()
+
+	primaryDB, err := db.NewDB(filepath.Join(dir, "primary.mellow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primaryDB.Close()
+
+	followerDB, err := db.NewDB(filepath.Join(dir, "follower.mellow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer followerDB.Close()
+
+	primary := db.NewPrimary(primaryDB, db.ReplicationOptions{Backlog: 10})
+	defer primary.Close()
+
+	follower, err := db.NewFollower(followerDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := connect(primary, follower)
+	writeItems(t, primaryDB, "users", 0, 5, "a")
+	waitForFollower(t, primaryDB, follower)
+	r.disconnect()
+
+	// More changes than the backlog holds, including a delete the follower must see.
+	users, _ := primaryDB.Collection("users")
+	users.Delete([]byte("00001"))
+	for i := range 20 {
+		writeItems(t, primaryDB, "users", i*10, i*10+10, "b")
+	}
+	users.Delete([]byte("00002"))
+	primaryDB.Sync()
+
+	r = connect(primary, follower)
+	defer r.disconnect()
+
+	waitForFollower(t, primaryDB, follower)
+	compareDBs(t, primaryDB, followerDB)
+}
+
+func TestFollowerRejectsWrites(t *testing.T) {
+	dir := t.TempDir()
+
+	primaryDB, err := db.NewDB(filepath.Join(dir, "primary.mellow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primaryDB.Close()
+
+	followerDB, err := db.NewDB(filepath.Join(dir, "follower.mellow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer followerDB.Close()
+
+	primary := db.NewPrimary(primaryDB, db.ReplicationOptions{})
+	defer primary.Close()
+
+	follower, err := db.NewFollower(followerDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := connect(primary, follower)
+	defer r.disconnect()
+
+	writeItems(t, primaryDB, "users", 0, 100, "a")
+	if err := primaryDB.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	waitForFollower(t, primaryDB, follower)
+
+	users, err := followerDB.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, _ := db.NewItem([]byte("00001"), []byte("b"))
+	if err := users.Insert(item); !errors.Is(err, db.ErrFollowerDB) || !errors.Is(err, db.ErrReadOnly) {
+		t.Fatalf("Expected ErrFollowerDB for an insert, got %v", err)
+	}
+
+	if err := users.Delete([]byte("00001")); !errors.Is(err, db.ErrFollowerDB) {
+		t.Fatalf("Expected ErrFollowerDB for a delete, got %v", err)
+	}
+
+	if _, err := followerDB.Collection("other"); !errors.Is(err, db.ErrFollowerDB) {
+		t.Fatalf("Expected ErrFollowerDB for a new collection, got %v", err)
+	}
+
+	if _, err := followerDB.Import(strings.NewReader("")); !errors.Is(err, db.ErrFollowerDB) {
+		t.Fatalf("Expected ErrFollowerDB for an import, got %v", err)
+	}
+
+	// The follower still applies the commits of the primary.
+	writeItems(t, primaryDB, "users", 100, 200, "a")
+	writeItems(t, primaryDB, "other", 0, 10, "a")
+	if err := primaryDB.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	waitForFollower(t, primaryDB, follower)
+	compareDBs(t, primaryDB, followerDB)
+}
+
+func TestReplicationSnapshotWhileWriting(t *testing.T) {
+	primaryDB, err := db.NewDB(filepath.Join(t.TempDir(), "primary.mellow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primaryDB.Close()
+
+	writeItems(t, primaryDB, "users", 0, 3000, "a")
+
+	primary := db.NewPrimary(primaryDB, db.ReplicationOptions{})
+	defer primary.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	primaryConn, conn := net.Pipe()
+	go primary.Serve(ctx, primaryConn)
+
+	if _, err := conn.Write([]byte(`{"type":"hello"}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	type message struct {
+		Type     string `json:"type"`
+		Sequence uint64 `json:"sequence"`
+		Value    []byte `json:"value"`
+	}
+
+	decoder := json.NewDecoder(conn)
+	snapshot := message{}
+	if err := decoder.Decode(&snapshot); err != nil || snapshot.Type != "snapshot" {
+		t.Fatalf("Expected a snapshot, got %+v, %v", snapshot, err)
+	}
+
+	// The primary waits for the follower in the middle of the snapshot, while
+	// every item is overwritten over several commits.
+	for range 3 {
+		writeItems(t, primaryDB, "users", 0, 3000, "b")
+	}
+
+	puts := 0
+	for {
+		msg := message{}
+		if err := decoder.Decode(&msg); err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Type == "commit" {
+			if msg.Sequence != snapshot.Sequence {
+				t.Fatalf("Expected the snapshot to stand for commit %d, got %d", snapshot.Sequence, msg.Sequence)
+			}
+			break
+		}
+
+		if string(msg.Value) != "a" {
+			t.Fatalf("Expected the committed value of the snapshot, got %q", msg.Value)
+		}
+		puts++
+	}
+
+	if puts != 3000 {
+		t.Fatalf("Expected 3000 items in the snapshot, got %d", puts)
+	}
+}
+
+func TestFollowerDBStaysAFollower(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "follower.mellow")
+
+	followerDB, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.NewFollower(followerDB); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := followerDB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a Follower the reopened DB still rejects writes.
+	followerDB, err = db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := followerDB.Collection("users"); !errors.Is(err, db.ErrFollowerDB) {
+		t.Fatalf("Expected ErrFollowerDB after a reopen, got %v", err)
+	}
+
+	if err := followerDB.StopFollowing(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeItems(t, followerDB, "users", 0, 10, "a")
+
+	if err := followerDB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	writeItems(t, reopened, "users", 10, 20, "a")
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/rettenwander/mellowdb/io"
+)
+
+// Calls fn for every item with start <= key < end in key order until fn returns false.
+// A nil start or end leaves the range open on that side. Expired items are skipped.
+//
+// The tree is locked for reading while the scan runs, so fn must not write to the DB.
+func (t *BTree) Scan(start []byte, end []byte, fn func(i *Item) bool) error {
+	return t.ScanContext(context.Background(), start, end, fn)
+}
+
+// Like Scan, but stops with the error of ctx once it is done. No item is
+// passed to fn after that.
+func (t *BTree) ScanContext(ctx context.Context, start []byte, end []byte, fn func(i *Item) bool) error {
+	t.rlock()
+	defer t.runlock()
+
+	view, _ := t.withContext(ctx)
+
+	now := time.Now()
+	return view.scan(start, end, func(i *Item) (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+
+		if i.isExpired(now) {
+			return true, nil
+		}
+
+		item, err := decompressItem(i)
+		if err != nil {
+			return false, err
+		}
+
+		return fn(item), nil
+	})
+}
+
+// Calls fn for every item whose key starts with prefix. See Scan.
+func (t *BTree) ScanPrefix(prefix []byte, fn func(i *Item) bool) error {
+	return t.Scan(prefix, PrefixEnd(prefix), fn)
+}
+
+// Like ScanPrefix, see ScanContext.
+func (t *BTree) ScanPrefixContext(ctx context.Context, prefix []byte, fn func(i *Item) bool) error {
+	return t.ScanContext(ctx, prefix, PrefixEnd(prefix), fn)
+}
+
+// Returns the first key after all keys with the prefix, or nil if there is none.
+func PrefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	return nil
+}
+
+// Calls fn for the stored items in the range until fn returns false or an error.
+func (t *BTree) scan(start []byte, end []byte, fn func(i *Item) (bool, error)) error {
+	if t.Root == 0 {
+		return nil
+	}
+
+	_, err := t.scanHelper(t.Root, start, end, fn)
+	return err
+}
+
+// Returns false once the scan is done.
+func (t *BTree) scanHelper(id io.PageID, start []byte, end []byte, fn func(i *Item) (bool, error)) (bool, error) {
+	n, err := t.ReadNode(id)
+	if err != nil {
+		return false, err
+	}
+
+	index := 0
+	found := false
+	if start != nil {
+		found, index = n.FindKeyInNode(start)
+	}
+
+	for i := index; i < len(n.items); i++ {
+		// All keys left of an exact match are smaller than start.
+		if !n.isLeaf() && !(found && i == index) {
+			cont, err := t.scanHelper(n.children[i], start, end, fn)
+			if !cont || err != nil {
+				return false, err
+			}
+		}
+
+		item := n.items[i]
+		if end != nil && bytes.Compare(item.key, end) >= 0 {
+			return false, nil
+		}
+
+		cont, err := fn(item)
+		if !cont || err != nil {
+			return false, err
+		}
+	}
+
+	if !n.isLeaf() {
+		return t.scanHelper(n.children[len(n.items)], start, end, fn)
+	}
+
+	return true, nil
+}
+
+// Calls fn for every stored item of the tree in key order, including expired items.
+func (t *BTree) forEachItem(fn func(i *Item) error) error {
+	return t.scan(nil, nil, func(i *Item) (bool, error) {
+		return true, fn(i)
+	})
+}
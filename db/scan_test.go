@@ -0,0 +1,90 @@
+package db_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/db"
+)
+
+func scanKeys(t *testing.T, tree *db.BTree, start []byte, end []byte, limit int) []string {
+	keys := []string{}
+	err := tree.Scan(start, end, func(i *db.Item) bool {
+		keys = append(keys, string(i.Key()))
+		return limit == 0 || len(keys) < limit
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keys
+}
+
+func TestScan(t *testing.T) {
+	reader := &NodeReaderMOCK{
+		nodes:       make(map[int64]db.Node),
+		MaxNodeSize: 256,
+	}
+
+	tree := db.NewBTree(reader, 0)
+
+	for i := range 1000 {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		item, _ := db.NewItem(key, []byte("value"))
+		if err := tree.Insert(item); err != nil {
+			t.Fatalf("Error inserting %d, %v", i, err)
+		}
+	}
+
+	all := scanKeys(t, tree, nil, nil, 0)
+	if len(all) != 1000 {
+		t.Fatalf("Full scan returned %d items", len(all))
+	}
+
+	for i, key := range all {
+		if key != fmt.Sprintf("key%04d", i) {
+			t.Fatalf("Scan is not in key order at %d: %s", i, key)
+		}
+	}
+
+	keys := scanKeys(t, tree, []byte("key0100"), []byte("key0105"), 0)
+	expected := []string{"key0100", "key0101", "key0102", "key0103", "key0104"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Unexpected range: %v", keys)
+	}
+
+	// Bounds don't have to be existing keys.
+	keys = scanKeys(t, tree, []byte("key0100a"), []byte("key0102a"), 0)
+	if !reflect.DeepEqual(keys, []string{"key0101", "key0102"}) {
+		t.Fatalf("Unexpected range: %v", keys)
+	}
+
+	keys = scanKeys(t, tree, []byte("key0998"), nil, 0)
+	if !reflect.DeepEqual(keys, []string{"key0998", "key0999"}) {
+		t.Fatalf("Unexpected open range: %v", keys)
+	}
+
+	keys = scanKeys(t, tree, nil, nil, 3)
+	if !reflect.DeepEqual(keys, []string{"key0000", "key0001", "key0002"}) {
+		t.Fatalf("Scan didn't stop: %v", keys)
+	}
+
+	keys = []string{}
+	err := tree.ScanPrefix([]byte("key050"), func(i *db.Item) bool {
+		keys = append(keys, string(i.Key()))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 10 || keys[0] != "key0500" || keys[9] != "key0509" {
+		t.Fatalf("Unexpected prefix scan: %v", keys)
+	}
+
+	empty := db.NewBTree(reader, 0)
+	if keys := scanKeys(t, empty, nil, nil, 0); len(keys) != 0 {
+		t.Fatalf("Scan of empty tree returned %v", keys)
+	}
+}
@@ -0,0 +1,54 @@
+package db
+
+// Returns the next value of the sequence, starting at 1.
+//
+// The sequence is stored in the collection record with the next commit, like
+// the writes. A value is never handed out twice if the commit after it
+// succeeds. After a crash the values handed out since the last commit are
+// handed out again, while the writes that used them are lost as well.
+// Returns ErrNotACollection if the tree isn't a collection of a DB.
+func (t *BTree) NextSequence() (uint64, error) {
+	var next uint64
+	err := t.write(func() error {
+		if err := t.checkSequence(); err != nil {
+			return err
+		}
+
+		t.sequence++
+		next = t.sequence
+		return nil
+	})
+
+	return next, err
+}
+
+// Sets the sequence, so the next call to NextSequence returns n+1.
+// It's stored with the next commit, like NextSequence.
+func (t *BTree) SetSequence(n uint64) error {
+	return t.write(func() error {
+		if err := t.checkSequence(); err != nil {
+			return err
+		}
+
+		t.sequence = n
+		return nil
+	})
+}
+
+// Returns the last value handed out by NextSequence.
+func (t *BTree) Sequence() uint64 {
+	t.rlock()
+	defer t.runlock()
+
+	return t.sequence
+}
+
+// Only collections have a record to store the sequence in.
+// The caller must hold the lock of the tree.
+func (t *BTree) checkSequence() error {
+	if t.db == nil || t.name == "" {
+		return ErrNotACollection
+	}
+
+	return t.checkWritable()
+}
@@ -0,0 +1,163 @@
+package db_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/db"
+)
+
+func TestSequence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	dbEngine, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := dbEngine.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orders, err := dbEngine.Collection("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for want := uint64(1); want <= 100; want++ {
+		got, err := users.NextSequence()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != want {
+			t.Fatalf("Expected %d, got %d", want, got)
+		}
+	}
+
+	if got, _ := orders.NextSequence(); got != 1 {
+		t.Fatalf("Expected the orders sequence to start at 1, got %d", got)
+	}
+
+	if err := dbEngine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dbEngine, err = db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	users, err = dbEngine.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := users.NextSequence(); got != 101 {
+		t.Fatalf("Expected 101 after reopening, got %d", got)
+	}
+
+	if err := users.SetSequence(1000); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := users.NextSequence(); got != 1001 {
+		t.Fatalf("Expected 1001 after SetSequence, got %d", got)
+	}
+}
+
+func TestSequenceAfterCrash(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	dbEngine, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := dbEngine.Collection("events")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var committed uint64
+	for i := range 10 {
+		value, err := tree.NextSequence()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		item, _ := db.NewItem(fmt.Appendf(nil, "event-%d", value), []byte("value"))
+		if err := tree.Insert(item); err != nil {
+			t.Fatal(err)
+		}
+
+		// The values after the commit are lost with the items that use them.
+		if i == 4 {
+			if err := dbEngine.Sync(); err != nil {
+				t.Fatal(err)
+			}
+
+			committed = value
+		}
+	}
+
+	// Open a copy of the file without closing, as if the process had crashed.
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crashedFile := filepath.Join(t.TempDir(), "crashed.mellow")
+	if err := os.WriteFile(crashedFile, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	crashed, err := db.NewDB(crashedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer crashed.Close()
+
+	tree, err = crashed.Collection("events")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := tree.NextSequence()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if next != committed+1 {
+		t.Fatalf("Expected %d after the crash, got %d", committed+1, next)
+	}
+
+	if _, err := tree.Find(fmt.Appendf(nil, "event-%d", committed)); err != nil {
+		t.Fatalf("Expected the committed item, got %v", err)
+	}
+
+	if _, err := tree.Find(fmt.Appendf(nil, "event-%d", next)); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound for a lost item, got %v", err)
+	}
+}
+
+func TestSequenceInMemory(t *testing.T) {
+	reader := &NodeReaderMOCK{
+		nodes: make(map[int64]db.Node),
+	}
+
+	// Without a collection record the sequence couldn't be stored.
+	tree := db.NewBTree(reader, 0)
+	if _, err := tree.NextSequence(); !errors.Is(err, db.ErrNotACollection) {
+		t.Fatalf("Expected ErrNotACollection, got %v", err)
+	}
+
+	if err := tree.SetSequence(10); !errors.Is(err, db.ErrNotACollection) {
+		t.Fatalf("Expected ErrNotACollection, got %v", err)
+	}
+}
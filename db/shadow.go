@@ -0,0 +1,191 @@
+package db
+
+import "github.com/rettenwander/mellowdb/io"
+
+// A change of a tree that's written with copy-on-write.
+//
+// An operation changes the nodes in memory and apply writes them at once.
+// Changed nodes are written to new pages, so the tree only sees them once all
+// of them were written, and the pages of the last commit are never overwritten.
+// Only the highest changed node is written in place, as the last write, if the
+// last commit doesn't reference its page. Otherwise its parent changes as
+// well, up to a new root.
+type treeUpdate struct {
+	t *BTree
+
+	// The nodes from the root down to the deepest node the operation read.
+	// Every node is the parent of the next one.
+	path []*Node
+	// Root of the tree after the update, zero for an empty tree.
+	root io.PageID
+
+	changed   []*Node
+	isChanged map[*Node]bool
+	// Nodes on new pages, which the tree doesn't reference before the update.
+	created map[*Node]bool
+	freed   []*Node
+	isFreed map[*Node]bool
+
+	// Number of node splits, counted in the stats of the DB once applied.
+	splits int
+}
+
+func (t *BTree) newUpdate(path []*Node) *treeUpdate {
+	return &treeUpdate{
+		t:         t,
+		path:      path,
+		root:      t.Root,
+		isChanged: make(map[*Node]bool),
+		created:   make(map[*Node]bool),
+		isFreed:   make(map[*Node]bool),
+	}
+}
+
+func (u *treeUpdate) change(nodes ...*Node) {
+	for _, n := range nodes {
+		if !u.isChanged[n] {
+			u.isChanged[n] = true
+			u.changed = append(u.changed, n)
+		}
+	}
+}
+
+// Returns an empty node on a new page.
+func (u *treeUpdate) newNode() *Node {
+	n := u.t.GetNewNode()
+	u.created[n] = true
+	u.change(n)
+	return n
+}
+
+// Removes the node from the tree once the update is applied.
+func (u *treeUpdate) free(n *Node) {
+	if !u.isFreed[n] {
+		u.isFreed[n] = true
+		u.freed = append(u.freed, n)
+	}
+}
+
+// Releases the pages of the created nodes. The tree is left as it was.
+func (u *treeUpdate) abort() {
+	for _, n := range u.changed {
+		if u.created[n] {
+			u.t.FreeNode(n.pageId)
+		}
+	}
+}
+
+// Writes the changed nodes and sets the root of the tree. If a write fails
+// the tree is left as it was.
+func (u *treeUpdate) apply() error {
+	t := u.t
+	path := u.path
+
+	top := -1
+	for l, n := range path {
+		if u.isChanged[n] {
+			top = l
+			break
+		}
+	}
+
+	var inPlace *Node
+	if top >= 0 {
+		// Changed nodes below the highest one move to new pages, so their parents change too.
+		for l := len(path) - 1; l > top; l-- {
+			if u.isChanged[path[l]] && !u.isFreed[path[l-1]] {
+				u.change(path[l-1])
+			}
+		}
+
+		// A new root is set after the writes, nothing is written in place.
+		for u.root == t.Root {
+			if t.writableInPlace(path[top].pageId) {
+				inPlace = path[top]
+				break
+			}
+
+			if top == 0 {
+				break
+			}
+
+			top--
+			u.change(path[top])
+		}
+	}
+
+	moved := map[io.PageID]io.PageID{}
+	oldIDs := []io.PageID{}
+	newIDs := []io.PageID{}
+	writes := []*Node{}
+
+	for _, n := range u.changed {
+		if u.isFreed[n] || n == inPlace {
+			continue
+		}
+
+		if !u.created[n] {
+			id := t.GetNewNode().pageId
+			moved[n.pageId] = id
+			oldIDs = append(oldIDs, n.pageId)
+			newIDs = append(newIDs, id)
+			n.pageId = id
+		}
+
+		writes = append(writes, n)
+	}
+
+	if inPlace != nil {
+		writes = append(writes, inPlace)
+	}
+
+	for _, n := range writes {
+		for i, child := range n.children {
+			if id, ok := moved[child]; ok {
+				n.children[i] = id
+			}
+		}
+	}
+
+	for _, n := range writes {
+		if err := t.WriteNode(n); err != nil {
+			for _, id := range newIDs {
+				t.FreeNode(id)
+			}
+			u.abort()
+
+			return err
+		}
+	}
+
+	for _, id := range oldIDs {
+		t.FreeNode(id)
+	}
+
+	for _, n := range u.freed {
+		t.FreeNode(n.pageId)
+	}
+
+	if id, ok := moved[u.root]; ok {
+		u.root = id
+	}
+
+	t.Root = u.root
+	t.countSplits(u.splits)
+	return nil
+}
+
+// Reports if the page can be overwritten in place because the last commit
+// doesn't reference it. Trees without a DB have no commits. Writes that may be
+// taken back only overwrite the pages they allocated.
+func (t *BTree) writableInPlace(id io.PageID) bool {
+	if t.db == nil {
+		return true
+	}
+
+	if t.db.undo != nil {
+		return t.db.undo.allocated[id]
+	}
+
+	return t.db.io.IsFresh(id)
+}
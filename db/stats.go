@@ -0,0 +1,139 @@
+package db
+
+import (
+	"github.com/rettenwander/mellowdb/io"
+)
+
+// Stats reports the activity of a DB since it was opened.
+type Stats struct {
+	io.EngineStats
+
+	// Number of node splits in all trees, counting only the writes that succeeded.
+	Splits uint64
+
+	// Node reads served from a node cache and the ones that weren't. The DB
+	// has no node cache yet, so both stay zero until one is added.
+	CacheHits   uint64
+	CacheMisses uint64
+}
+
+// Returns the share of node reads served from the cache, zero if there were none.
+func (s Stats) CacheHitRate() float64 {
+	total := s.CacheHits + s.CacheMisses
+	if total == 0 {
+		return 0
+	}
+
+	return float64(s.CacheHits) / float64(total)
+}
+
+func (e *DB) Stats() (Stats, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	engineStats, err := e.io.Stats()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	return Stats{
+		EngineStats: engineStats,
+		Splits:      e.splits.Load(),
+	}, nil
+}
+
+// Adds the splits of an applied update to the stats of the DB. Writes that may
+// still be taken back count them once they succeeded, see atomically.
+func (t *BTree) countSplits(n int) {
+	if t.db == nil || n == 0 {
+		return
+	}
+
+	if t.db.undo != nil {
+		t.db.undo.splits += n
+		return
+	}
+
+	t.db.splits.Add(uint64(n))
+}
+
+// TreeStats describes the shape of a tree.
+type TreeStats struct {
+	// Number of levels, zero for an empty tree.
+	Height int
+	Nodes  int
+	// Number of nodes on each level, starting with the root.
+	NodesPerLevel []int
+
+	Items int
+	// Sizes of the keys and of the values as they are stored, including expired items.
+	KeyBytes   int
+	ValueBytes int
+
+	// Average size of the nodes relative to the maximum fill of the node size.
+	// The root is included, so small trees have a low fill.
+	AverageFill float64
+}
+
+func (t *BTree) Stats() (TreeStats, error) {
+	t.rlock()
+	defer t.runlock()
+
+	stats := TreeStats{}
+	usedBytes := 0
+
+	err := t.walk(func(n *Node, depth int) error {
+		if depth == len(stats.NodesPerLevel) {
+			stats.NodesPerLevel = append(stats.NodesPerLevel, 0)
+		}
+		stats.NodesPerLevel[depth]++
+		stats.Nodes++
+
+		usedBytes += n.Size()
+		for _, item := range n.items {
+			stats.Items++
+			stats.KeyBytes += len(item.key)
+			stats.ValueBytes += len(item.value)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return TreeStats{}, err
+	}
+
+	stats.Height = len(stats.NodesPerLevel)
+	if stats.Nodes > 0 {
+		stats.AverageFill = float64(usedBytes) / float64(stats.Nodes) / t.maxNodeSize()
+	}
+
+	return stats, nil
+}
+
+// Calls fn for every node of the tree in depth-first order. The root has depth zero.
+func (t *BTree) walk(fn func(n *Node, depth int) error) error {
+	if t.Root == 0 {
+		return nil
+	}
+
+	return t.walkHelper(t.Root, 0, fn)
+}
+
+func (t *BTree) walkHelper(id io.PageID, depth int, fn func(n *Node, depth int) error) error {
+	n, err := t.ReadNode(id)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(n, depth); err != nil {
+		return err
+	}
+
+	for _, child := range n.children {
+		if err := t.walkHelper(child, depth+1, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package db_test
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/db"
+	"github.com/rettenwander/mellowdb/io"
+	"github.com/rettenwander/mellowdb/io/faultstorage"
+)
+
+func TestDBStats(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	dbEngine, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	tree, err := dbEngine.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 2000 {
+		item, _ := db.NewItem([]byte(strconv.Itoa(i)), []byte("value"))
+		if err := tree.Insert(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := range 1000 {
+		if err := tree.Delete([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := dbEngine.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.PageReads == 0 || stats.PageWrites == 0 || stats.Allocations == 0 {
+		t.Fatalf("Expected page activity, got %+v", stats)
+	}
+
+	if stats.Splits == 0 {
+		t.Fatal("Expected splits")
+	}
+
+	if stats.FreePages == 0 {
+		t.Fatal("Expected free pages after deleting half of the items")
+	}
+
+	if stats.FileSize == 0 {
+		t.Fatal("Expected a file size")
+	}
+
+	// There is no node cache, so nothing counts as a hit or a miss.
+	if stats.CacheHits != 0 || stats.CacheMisses != 0 || stats.CacheHitRate() != 0 {
+		t.Fatalf("Expected no cache activity, got %+v", stats)
+	}
+}
+
+func TestTreeStats(t *testing.T) {
+	reader := &NodeReaderMOCK{
+		nodes:       make(map[int64]db.Node),
+		MaxNodeSize: 512,
+	}
+
+	tree := db.NewBTree(reader, 0)
+
+	stats, err := tree.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Height != 0 || stats.Nodes != 0 {
+		t.Fatalf("Expected an empty tree, got %+v", stats)
+	}
+
+	numOfItems := 1000
+	for i := range numOfItems {
+		key := []byte(strconv.Itoa(i))
+		item, _ := db.NewItem(key, []byte("value"))
+		if err := tree.Insert(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err = tree.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Items != numOfItems || stats.ValueBytes != numOfItems*len("value") {
+		t.Fatalf("Expected %d items, got %+v", numOfItems, stats)
+	}
+
+	if stats.Height < 2 || len(stats.NodesPerLevel) != stats.Height || stats.NodesPerLevel[0] != 1 {
+		t.Fatalf("Unexpected levels %+v", stats)
+	}
+
+	nodes := 0
+	for _, n := range stats.NodesPerLevel {
+		nodes += n
+	}
+
+	if nodes != stats.Nodes || nodes != len(reader.nodes) {
+		t.Fatalf("Expected %d nodes, got %d", len(reader.nodes), stats.Nodes)
+	}
+
+	if stats.AverageFill <= 0 || stats.AverageFill > 1 {
+		t.Fatalf("Expected the average fill within (0, 1], got %f", stats.AverageFill)
+	}
+}
+
+// Inserts that fail to write their nodes don't count their splits.
+func TestDBStatsFailedSplits(t *testing.T) {
+	splits := func(fail bool) uint64 {
+		storage, err := faultstorage.New(io.NewMemoryStorage(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dbEngine, err := db.NewDBWithStorage(storage, io.EngineOptions{PageSize: io.MetadataPageSize})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dbEngine.Close()
+
+		tree, err := dbEngine.Collection("users")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range 500 {
+			item, _ := db.NewItem([]byte(strconv.Itoa(i)), []byte("value"))
+
+			if fail {
+				storage.Schedule(1, faultstorage.FailWrite)
+				if err := tree.Insert(item); err == nil {
+					t.Fatal("Expected the insert to fail")
+				}
+				storage.ClearSchedule()
+			}
+
+			if err := tree.Insert(item); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		stats, err := dbEngine.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return stats.Splits
+	}
+
+	expected := splits(false)
+	if expected == 0 {
+		t.Fatal("Expected splits")
+	}
+
+	if got := splits(true); got != expected {
+		t.Fatalf("Expected %d splits, got %d", expected, got)
+	}
+}
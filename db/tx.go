@@ -0,0 +1,170 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A Tx collects writes to the collections of a DB. They are applied together
+// once the function passed to Transaction returns nil, or not at all.
+//
+// Nothing is locked while the function runs. Find sees the writes of the
+// transaction and the items of the DB as they are at the time of the call.
+type Tx struct {
+	db     *DB
+	ctx    context.Context
+	writes []txWrite
+	// Index of the last write of every key.
+	latest map[txKey]int
+	done   bool
+}
+
+type txWrite struct {
+	collection string
+	key        []byte
+	// Nil deletes the key.
+	item *Item
+}
+
+type txKey struct {
+	collection string
+	key        string
+}
+
+// Runs fn and applies the writes it made to tx. If fn returns an error,
+// nothing is written and the error is returned. Missing collections are
+// created by the first insert.
+func (e *DB) Transaction(fn func(tx *Tx) error) error {
+	return e.TransactionContext(context.Background(), fn)
+}
+
+// Like Transaction, but stops with the error of ctx once it is done, between
+// page reads. A cancelled transaction writes nothing.
+func (e *DB) TransactionContext(ctx context.Context, fn func(tx *Tx) error) error {
+	tx := &Tx{db: e, ctx: ctx, latest: make(map[txKey]int)}
+	defer func() { tx.done = true }()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if len(tx.writes) == 0 {
+		return nil
+	}
+
+	if err := tx.apply(); err != nil {
+		return err
+	}
+
+	return e.syncAlways()
+}
+
+// Returns the item of the key, see BTree.Find.
+func (tx *Tx) Find(collection string, key []byte) (*Item, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+
+	if n, ok := tx.latest[txKey{collection, string(key)}]; ok {
+		item := tx.writes[n].item
+		if item == nil || item.isExpired(time.Now()) {
+			return nil, ErrNotFound
+		}
+
+		return item, nil
+	}
+
+	tree, err := tx.db.FindCollection(collection)
+	if errors.Is(err, ErrCollectionNotFound) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return tree.FindContext(tx.ctx, key)
+}
+
+// Stores the item in the collection once the transaction is applied.
+func (tx *Tx) Insert(collection string, i *Item) error {
+	return tx.add(collection, i.key, i)
+}
+
+// Removes the key from the collection once the transaction is applied.
+// Removing a missing key is not an error.
+func (tx *Tx) Delete(collection string, key []byte) error {
+	return tx.add(collection, key, nil)
+}
+
+func (tx *Tx) add(collection string, key []byte, i *Item) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	if err := checkCollectionName(collection); err != nil {
+		return err
+	}
+
+	tx.latest[txKey{collection, string(key)}] = len(tx.writes)
+	tx.writes = append(tx.writes, txWrite{collection: collection, key: bytes.Clone(key), item: i})
+	return nil
+}
+
+func (tx *Tx) apply() error {
+	e := tx.db
+	if e.io.ReadOnly() {
+		return ErrReadOnly
+	}
+
+	e.collectionsMu.Lock()
+	defer e.collectionsMu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.atomically(func() error {
+		for _, w := range tx.writes {
+			if err := tx.ctx.Err(); err != nil {
+				return err
+			}
+
+			tree, ok := e.collections[w.collection]
+			if !ok {
+				var err error
+				tree, err = e.loadCollection(w.collection, w.item != nil && !e.follower)
+				if errors.Is(err, ErrCollectionNotFound) {
+					if w.item != nil {
+						return fmt.Errorf("%w: collection %q doesn't exist", ErrFollowerDB, w.collection)
+					}
+
+					// Nothing to delete.
+					continue
+				} else if err != nil {
+					return err
+				}
+			}
+
+			if err := tx.write(tree, w); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (tx *Tx) write(tree *BTree, w txWrite) error {
+	view, _ := tree.withContext(tx.ctx)
+	defer func() { tree.Root = view.Root }()
+
+	if w.item == nil {
+		_, err := view.delete(w.key, nil)
+		return err
+	}
+
+	return view.upsert(w.key, func(*Item) (*Item, error) {
+		return w.item, nil
+	})
+}
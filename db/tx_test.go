@@ -0,0 +1,221 @@
+package db_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/db"
+)
+
+// Values starting with "tag:" are indexed by the rest of the value.
+func tagIndex(value []byte) [][]byte {
+	if tag, ok := bytes.CutPrefix(value, []byte("tag:")); ok {
+		return [][]byte{tag}
+	}
+
+	return nil
+}
+
+func newTxTestDB(t *testing.T) *db.DB {
+	dbEngine, err := db.NewDB(filepath.Join(t.TempDir(), "test.mellow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbEngine.Close() })
+
+	tree, err := dbEngine.Collection("items")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.AddIndex(db.IndexOptions{Name: "tag", Func: tagIndex, Unique: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 500 {
+		item, _ := db.NewItem(fmt.Appendf(nil, "key-%04d", i), []byte("value"))
+		if err := tree.Insert(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dbEngine
+}
+
+func TestTransaction(t *testing.T) {
+	dbEngine := newTxTestDB(t)
+
+	err := dbEngine.Transaction(func(tx *db.Tx) error {
+		for i := range 500 {
+			item, _ := db.NewItem(fmt.Appendf(nil, "key-%04d", i), []byte("changed"))
+			if err := tx.Insert("items", item); err != nil {
+				return err
+			}
+		}
+
+		item, _ := db.NewItem([]byte("moved"), []byte("value"))
+		if err := tx.Insert("other", item); err != nil {
+			return err
+		}
+
+		if err := tx.Delete("items", []byte("key-0000")); err != nil {
+			return err
+		}
+
+		if _, err := tx.Find("items", []byte("key-0000")); !errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("expected the deleted key to be missing, got %v", err)
+		}
+
+		found, err := tx.Find("items", []byte("key-0001"))
+		if err != nil || string(found.Value()) != "changed" {
+			return fmt.Errorf("expected the written value, got %v, %v", found, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, _ := dbEngine.Collection("items")
+	if _, err := tree.Find([]byte("key-0000")); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("Expected key-0000 to be deleted, got %v", err)
+	}
+
+	for i := 1; i < 500; i++ {
+		item, err := tree.Find(fmt.Appendf(nil, "key-%04d", i))
+		if err != nil || string(item.Value()) != "changed" {
+			t.Fatalf("Expected key %d to be changed, got %v, %v", i, item, err)
+		}
+	}
+
+	other, err := dbEngine.Collection("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Find([]byte("moved")); err != nil {
+		t.Fatal(err)
+	}
+
+	if problems := dbEngine.Check(); len(problems) != 0 {
+		t.Fatalf("Unexpected problems: %v", problems)
+	}
+}
+
+func TestTransactionFailedWrite(t *testing.T) {
+	dbEngine := newTxTestDB(t)
+
+	err := dbEngine.Transaction(func(tx *db.Tx) error {
+		for i := range 500 {
+			item, _ := db.NewItem(fmt.Appendf(nil, "key-%04d", i), []byte("changed"))
+			tx.Insert("items", item)
+		}
+
+		item, _ := db.NewItem([]byte("moved"), []byte("value"))
+		tx.Insert("other", item)
+
+		// The second item takes the tag of the first one.
+		item, _ = db.NewItem([]byte("tagged-1"), []byte("tag:a"))
+		tx.Insert("items", item)
+		item, _ = db.NewItem([]byte("tagged-2"), []byte("tag:a"))
+		return tx.Insert("items", item)
+	})
+	if !errors.Is(err, db.ErrIndexConflict) {
+		t.Fatalf("Expected ErrIndexConflict, got %v", err)
+	}
+
+	verifyUnchanged(t, dbEngine)
+}
+
+func TestTransactionAbandoned(t *testing.T) {
+	dbEngine := newTxTestDB(t)
+
+	errAbandon := errors.New("abandon")
+	err := dbEngine.Transaction(func(tx *db.Tx) error {
+		item, _ := db.NewItem([]byte("key-0000"), []byte("changed"))
+		tx.Insert("items", item)
+		return errAbandon
+	})
+	if !errors.Is(err, errAbandon) {
+		t.Fatalf("Expected the error of the function, got %v", err)
+	}
+
+	verifyUnchanged(t, dbEngine)
+
+	var escaped *db.Tx
+	dbEngine.Transaction(func(tx *db.Tx) error {
+		escaped = tx
+		return nil
+	})
+
+	item, _ := db.NewItem([]byte("key-0000"), []byte("changed"))
+	if err := escaped.Insert("items", item); !errors.Is(err, db.ErrTxDone) {
+		t.Fatalf("Expected ErrTxDone, got %v", err)
+	}
+}
+
+func TestTransactionCancelled(t *testing.T) {
+	dbEngine := newTxTestDB(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	err := dbEngine.TransactionContext(ctx, func(tx *db.Tx) error {
+		for i := range 500 {
+			item, _ := db.NewItem(fmt.Appendf(nil, "key-%04d", i), []byte("changed"))
+			tx.Insert("items", item)
+		}
+
+		item, _ := db.NewItem([]byte("moved"), []byte("value"))
+		tx.Insert("other", item)
+
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	verifyUnchanged(t, dbEngine)
+}
+
+// Checks the items of newTxTestDB weren't changed and no collection was added.
+func verifyUnchanged(t *testing.T, dbEngine *db.DB) {
+	t.Helper()
+
+	tree, _ := dbEngine.Collection("items")
+	for i := range 500 {
+		item, err := tree.Find(fmt.Appendf(nil, "key-%04d", i))
+		if err != nil || string(item.Value()) != "value" {
+			t.Fatalf("Expected key %d to be unchanged, got %v, %v", i, item, err)
+		}
+	}
+
+	if items, err := tree.LookupByIndex("tag", []byte("a")); err != nil || len(items) != 0 {
+		t.Fatalf("Expected no tagged items, got %v, %v", items, err)
+	}
+
+	names, err := dbEngine.Collections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(names, []string{"items"}) {
+		t.Fatalf("Expected only the items collection, got %v", names)
+	}
+
+	if problems := dbEngine.Check(); len(problems) != 0 {
+		t.Fatalf("Unexpected problems: %v", problems)
+	}
+
+	// The pages of the abandoned writes are free again.
+	if err := dbEngine.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if problems := dbEngine.Check(); len(problems) != 0 {
+		t.Fatalf("Unexpected problems after a commit: %v", problems)
+	}
+}
@@ -0,0 +1,172 @@
+package db
+
+import (
+	"iter"
+)
+
+// Number of items a typed iterator reads under one lock of the DB.
+const typedScanBatchSize = 256
+
+// Collection is a collection of a DB with typed keys and values.
+type Collection[K, V any] struct {
+	tree   *BTree
+	keys   Codec[K]
+	values Codec[V]
+}
+
+// Entry is a key and value returned by the iterators of a Collection.
+type Entry[K, V any] struct {
+	Key   K
+	Value V
+}
+
+// Returns the named collection of the DB with typed keys and values.
+// The key codec must keep the order of the keys, see Codec.
+func NewCollection[K, V any](d *DB, name string, keys Codec[K], values Codec[V]) (*Collection[K, V], error) {
+	tree, err := d.Collection(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Collection[K, V]{tree: tree, keys: keys, values: values}, nil
+}
+
+// Returns the tree of the collection, for example to add indexes.
+func (c *Collection[K, V]) Tree() *BTree {
+	return c.tree
+}
+
+// Returns the value of the key. Missing and expired keys are reported as ErrNotFound.
+func (c *Collection[K, V]) Get(key K) (V, error) {
+	var value V
+
+	k, err := c.keys.Encode(key)
+	if err != nil {
+		return value, err
+	}
+
+	item, err := c.tree.Find(k)
+	if err != nil {
+		return value, err
+	}
+
+	return c.values.Decode(item.value)
+}
+
+func (c *Collection[K, V]) Put(key K, value V) error {
+	item, err := c.item(key, value)
+	if err != nil {
+		return err
+	}
+
+	return c.tree.Insert(item)
+}
+
+// Removes the key. Removing a missing key is not an error.
+func (c *Collection[K, V]) Delete(key K) error {
+	k, err := c.keys.Encode(key)
+	if err != nil {
+		return err
+	}
+
+	return c.tree.Delete(k)
+}
+
+func (c *Collection[K, V]) item(key K, value V) (*Item, error) {
+	k, err := c.keys.Encode(key)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := c.values.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewItem(k, v)
+}
+
+// Iterates over all entries in key order. See Range.
+func (c *Collection[K, V]) All() iter.Seq2[Entry[K, V], error] {
+	return c.scan(nil, nil)
+}
+
+// Iterates over the entries with start <= key < end in key order.
+//
+// The items are read in batches, so the loop body may write to the DB. Writes
+// to keys the iterator hasn't reached yet can show up in later batches.
+// An error ends the iteration.
+func (c *Collection[K, V]) Range(start K, end K) iter.Seq2[Entry[K, V], error] {
+	s, err := c.keys.Encode(start)
+	if err != nil {
+		return failedScan[K, V](err)
+	}
+
+	e, err := c.keys.Encode(end)
+	if err != nil {
+		return failedScan[K, V](err)
+	}
+
+	return c.scan(s, e)
+}
+
+// Iterates over the entries with start <= key in key order. See Range.
+func (c *Collection[K, V]) From(start K) iter.Seq2[Entry[K, V], error] {
+	s, err := c.keys.Encode(start)
+	if err != nil {
+		return failedScan[K, V](err)
+	}
+
+	return c.scan(s, nil)
+}
+
+func (c *Collection[K, V]) scan(start []byte, end []byte) iter.Seq2[Entry[K, V], error] {
+	return func(yield func(Entry[K, V], error) bool) {
+		for {
+			batch := make([]*Item, 0, typedScanBatchSize)
+			err := c.tree.Scan(start, end, func(i *Item) bool {
+				batch = append(batch, i)
+				return len(batch) < typedScanBatchSize
+			})
+			if err != nil {
+				yield(Entry[K, V]{}, err)
+				return
+			}
+
+			for _, i := range batch {
+				entry, err := c.entry(i)
+				if !yield(entry, err) || err != nil {
+					return
+				}
+			}
+
+			if len(batch) < typedScanBatchSize {
+				return
+			}
+
+			// The next batch starts right after the last key.
+			last := batch[len(batch)-1].key
+			start = append(last[:len(last):len(last)], 0)
+		}
+	}
+}
+
+func (c *Collection[K, V]) entry(i *Item) (Entry[K, V], error) {
+	key, err := c.keys.Decode(i.key)
+	if err != nil {
+		return Entry[K, V]{}, err
+	}
+
+	value, err := c.values.Decode(i.value)
+	if err != nil {
+		return Entry[K, V]{}, err
+	}
+
+	return Entry[K, V]{Key: key, Value: value}, nil
+}
+
+func failedScan[K, V any](err error) iter.Seq2[Entry[K, V], error] {
+	return func(yield func(Entry[K, V], error) bool) {
+		yield(Entry[K, V]{}, err)
+	}
+}
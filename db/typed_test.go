@@ -0,0 +1,136 @@
+package db_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/db"
+)
+
+type account struct {
+	Name    string
+	Balance int
+}
+
+func TestTypedCollection(t *testing.T) {
+	dbEngine, err := db.NewDB(filepath.Join(t.TempDir(), "test.mellow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	accounts, err := db.NewCollection(dbEngine, "accounts", db.IntCodec[int64]{}, db.JSONCodec[account]{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(-500); i < 500; i++ {
+		if err := accounts.Put(i, account{Name: fmt.Sprint("account ", i), Balance: int(i) * 10}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := accounts.Get(-42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Name != "account -42" || got.Balance != -420 {
+		t.Fatalf("Unexpected account %+v", got)
+	}
+
+	if err := accounts.Delete(-42); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := accounts.Get(-42); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+
+	// Negative keys sort before positive ones.
+	keys := []int64{}
+	for entry, err := range accounts.All() {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys = append(keys, entry.Key)
+	}
+
+	if len(keys) != 999 || !slices.IsSorted(keys) || keys[0] != -500 {
+		t.Fatalf("Expected 999 sorted keys from -500, got %d keys starting with %v", len(keys), keys[:1])
+	}
+
+	keys = keys[:0]
+	for entry, err := range accounts.Range(-45, 5) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys = append(keys, entry.Key)
+	}
+
+	if len(keys) != 49 || keys[0] != -45 || keys[len(keys)-1] != 4 {
+		t.Fatalf("Unexpected range %v", keys)
+	}
+
+	// The loop body can write to the collection.
+	count := 0
+	for entry, err := range accounts.From(400) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := accounts.Delete(entry.Key); err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+
+	if count != 100 {
+		t.Fatalf("Expected 100 entries from 400, got %d", count)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	ints := db.IntCodec[int32]{}
+	for _, pair := range [][2]int32{{-2, -1}, {-1, 0}, {0, 1}, {-1 << 31, 1<<31 - 1}} {
+		a, _ := ints.Encode(pair[0])
+		b, _ := ints.Encode(pair[1])
+		if string(a) >= string(b) {
+			t.Fatalf("Expected %d to sort before %d", pair[0], pair[1])
+		}
+
+		if v, err := ints.Decode(a); err != nil || v != pair[0] {
+			t.Fatalf("Expected %d, got %d, %v", pair[0], v, err)
+		}
+	}
+
+	uints := db.UintCodec[uint16]{}
+	a, _ := uints.Encode(255)
+	b, _ := uints.Encode(256)
+	if string(a) >= string(b) {
+		t.Fatal("Expected 255 to sort before 256")
+	}
+
+	if _, err := uints.Decode([]byte{1}); !errors.Is(err, db.ErrInvalidEncoding) {
+		t.Fatalf("Expected ErrInvalidEncoding, got %v", err)
+	}
+
+	gob := db.GobCodec[account]{}
+	data, err := gob.Encode(account{Name: "gob", Balance: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := gob.Decode(data); err != nil || v.Name != "gob" || v.Balance != 7 {
+		t.Fatalf("Unexpected account %+v, %v", v, err)
+	}
+
+	if _, err := (db.JSONCodec[account]{}).Decode([]byte("{")); !errors.Is(err, db.ErrInvalidEncoding) {
+		t.Fatalf("Expected ErrInvalidEncoding, got %v", err)
+	}
+}
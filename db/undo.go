@@ -0,0 +1,62 @@
+package db
+
+import "github.com/rettenwander/mellowdb/io"
+
+// Records what's needed to take back writes that are applied together or
+// not at all, see atomically.
+//
+// The pages the writes allocate are written in place, but no page from before
+// is, and the freed pages are only released once the writes succeeded. So the
+// old roots of the trees still point to unchanged pages.
+type undoLog struct {
+	roots     map[*BTree]io.PageID
+	allocated map[io.PageID]bool
+	freed     []io.PageID
+	changes   int
+	splits    int
+}
+
+// Runs fn, which applies writes to the trees of the DB. If fn fails, the trees
+// are left as they were before. The caller must hold the lock of the
+// collections and the lock of the DB.
+func (e *DB) atomically(fn func() error) error {
+	undo := &undoLog{
+		roots:     map[*BTree]io.PageID{e.catalog: e.catalog.Root},
+		allocated: make(map[io.PageID]bool),
+		changes:   e.queuedChanges(),
+	}
+	for _, tree := range e.collections {
+		undo.roots[tree] = tree.Root
+	}
+
+	e.undo = undo
+	err := fn()
+	e.undo = nil
+
+	if err == nil {
+		for _, id := range undo.freed {
+			e.io.MarkPageAsFree(id)
+		}
+		e.splits.Add(uint64(undo.splits))
+
+		return nil
+	}
+
+	for tree, root := range undo.roots {
+		tree.Root = root
+	}
+
+	// Collections opened by fn may have been created by it.
+	for name, tree := range e.collections {
+		if _, ok := undo.roots[tree]; !ok {
+			delete(e.collections, name)
+		}
+	}
+
+	for id := range undo.allocated {
+		e.io.MarkPageAsFree(id)
+	}
+
+	e.dropChanges(undo.changes)
+	return err
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"bytes"
+	"time"
+)
+
+// Calls fn with the current value of the key and stores the value fn returns,
+// all in one descent. Exists is false if the key is absent or expired.
+// If fn returns an error nothing is written and the error is returned.
+// An existing expiry is kept.
+func (t *BTree) Update(key []byte, fn func(old []byte, exists bool) ([]byte, error)) error {
+	return t.write(func() error {
+		return t.update(key, fn)
+	})
+}
+
+func (t *BTree) update(key []byte, fn func(old []byte, exists bool) ([]byte, error)) error {
+	return t.upsert(key, func(old *Item) (*Item, error) {
+		var value []byte
+		var err error
+
+		if old == nil {
+			value, err = fn(nil, false)
+		} else {
+			value, err = fn(old.value, true)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		item, err := NewItem(key, value)
+		if err != nil {
+			return nil, err
+		}
+
+		if old != nil && old.hasExpiry() {
+			item.flags |= itemFlagExpires
+			item.expiresAt = old.expiresAt
+		}
+
+		return item, nil
+	})
+}
+
+// Replaces the value of the key with newValue if it currently is oldValue.
+// Returns ErrNotFound if the key doesn't exist and ErrValueMismatch if the value differs.
+func (t *BTree) CompareAndSwap(key []byte, oldValue []byte, newValue []byte) error {
+	return t.Update(key, func(current []byte, exists bool) ([]byte, error) {
+		if !exists {
+			return nil, ErrNotFound
+		}
+
+		if !bytes.Equal(current, oldValue) {
+			return nil, ErrValueMismatch
+		}
+
+		return newValue, nil
+	})
+}
+
+// Inserts the item unless its key exists. Returns ErrKeyExists otherwise.
+func (t *BTree) PutIfAbsent(i *Item) error {
+	return t.write(func() error {
+		return t.upsert(i.key, func(old *Item) (*Item, error) {
+			if old != nil {
+				return nil, ErrKeyExists
+			}
+
+			return i, nil
+		})
+	})
+}
+
+// Removes the key like Delete and reports whether it existed. An expired item
+// is removed as well, but counts as absent.
+func (t *BTree) Remove(key []byte) (bool, error) {
+	existed := false
+	err := t.write(func() error {
+		now := time.Now()
+		_, err := t.delete(key, func(i *Item) bool {
+			existed = !i.isExpired(now)
+			return true
+		})
+		return err
+	})
+
+	return existed, err
+}
@@ -0,0 +1,251 @@
+package db_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rettenwander/mellowdb/db"
+)
+
+func TestUpdate(t *testing.T) {
+	reader := &NodeReaderMOCK{
+		nodes:       make(map[int64]db.Node),
+		MaxNodeSize: 512,
+	}
+
+	tree := db.NewBTree(reader, 0)
+	key := []byte("counter")
+
+	increment := func(old []byte, exists bool) ([]byte, error) {
+		n := uint64(0)
+		if exists {
+			n = binary.LittleEndian.Uint64(old)
+		}
+
+		return binary.LittleEndian.AppendUint64(nil, n+1), nil
+	}
+
+	for range 10 {
+		if err := tree.Update(key, increment); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	item, err := tree.Find(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := binary.LittleEndian.Uint64(item.Value()); n != 10 {
+		t.Fatalf("Counter is %d, expected 10", n)
+	}
+
+	errAbort := errors.New("abort")
+	err = tree.Update(key, func([]byte, bool) ([]byte, error) {
+		return nil, errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("Expected the error of fn, got %v", err)
+	}
+
+	err = tree.Update([]byte("other"), func([]byte, bool) ([]byte, error) {
+		return nil, errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("Expected the error of fn, got %v", err)
+	}
+
+	if _, err := tree.Find([]byte("other")); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("Aborted update was written: %v", err)
+	}
+
+	err = tree.Update(key, func([]byte, bool) ([]byte, error) {
+		return make([]byte, db.MaxValueSize+1), nil
+	})
+	if !errors.Is(err, db.ErrValueTooLong) {
+		t.Fatalf("Expected ErrValueTooLong, got %v", err)
+	}
+}
+
+func TestUpdateKeepsExpiry(t *testing.T) {
+	reader := &NodeReaderMOCK{
+		nodes:       make(map[int64]db.Node),
+		MaxNodeSize: 512,
+	}
+
+	tree := db.NewBTree(reader, 0)
+	expiresAt := time.Now().Add(time.Hour).Truncate(0)
+
+	item, _ := db.NewItemWithExpiry([]byte("session"), []byte("a"), expiresAt)
+	if err := tree.Insert(item); err != nil {
+		t.Fatal(err)
+	}
+
+	err := tree.Update([]byte("session"), func(old []byte, exists bool) ([]byte, error) {
+		return append(old, 'b'), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, err = tree.Find([]byte("session"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if at, ok := item.ExpiresAt(); !ok || !at.Equal(expiresAt) || string(item.Value()) != "ab" {
+		t.Fatalf("Unexpected item after update: %s %v %v", item.Value(), at, ok)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	reader := &NodeReaderMOCK{
+		nodes:       make(map[int64]db.Node),
+		MaxNodeSize: 512,
+	}
+
+	tree := db.NewBTree(reader, 0)
+	key := []byte("state")
+
+	if err := tree.CompareAndSwap(key, nil, []byte("new")); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+
+	item, _ := db.NewItem(key, []byte("pending"))
+	if err := tree.Insert(item); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.CompareAndSwap(key, []byte("done"), []byte("failed")); !errors.Is(err, db.ErrValueMismatch) {
+		t.Fatalf("Expected ErrValueMismatch, got %v", err)
+	}
+
+	if err := tree.CompareAndSwap(key, []byte("pending"), []byte("done")); err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := tree.Find(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(item.Value()) != "done" {
+		t.Fatalf("Value is %s, expected done", item.Value())
+	}
+}
+
+func TestPutIfAbsent(t *testing.T) {
+	reader := &NodeReaderMOCK{
+		nodes:       make(map[int64]db.Node),
+		MaxNodeSize: 512,
+	}
+
+	tree := db.NewBTree(reader, 0)
+
+	first, _ := db.NewItem([]byte("key"), []byte("first"))
+	second, _ := db.NewItem([]byte("key"), []byte("second"))
+
+	if err := tree.PutIfAbsent(first); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.PutIfAbsent(second); !errors.Is(err, db.ErrKeyExists) {
+		t.Fatalf("Expected ErrKeyExists, got %v", err)
+	}
+
+	item, err := tree.Find([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(item.Value()) != "first" {
+		t.Fatalf("Value was overwritten: %s", item.Value())
+	}
+
+	// An expired key counts as absent.
+	expired, _ := db.NewItemWithExpiry([]byte("expired"), []byte("old"), time.Now().Add(-time.Second))
+	if err := tree.Insert(expired); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh, _ := db.NewItem([]byte("expired"), []byte("new"))
+	if err := tree.PutIfAbsent(fresh); err != nil {
+		t.Fatalf("PutIfAbsent on expired key failed: %v", err)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	reader := &NodeReaderMOCK{
+		nodes:       make(map[int64]db.Node),
+		MaxNodeSize: 512,
+	}
+
+	tree := db.NewBTree(reader, 0)
+
+	item, _ := db.NewItem([]byte("key"), []byte("value"))
+	expired, _ := db.NewItemWithExpiry([]byte("expired"), []byte("old"), time.Now().Add(-time.Second))
+	for _, i := range []*db.Item{item, expired} {
+		if err := tree.Insert(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		key     string
+		existed bool
+	}{{"key", true}, {"key", false}, {"missing", false}, {"expired", false}} {
+		existed, err := tree.Remove([]byte(c.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if existed != c.existed {
+			t.Fatalf("Expected Remove(%q) to report %v, got %v", c.key, c.existed, existed)
+		}
+	}
+
+	if stats, _ := tree.Stats(); stats.Items != 0 {
+		t.Fatalf("Expected the expired item to be removed, %d items are left", stats.Items)
+	}
+}
+
+func TestOverwriteWithLargerValues(t *testing.T) {
+	reader := &NodeReaderMOCK{
+		nodes:       make(map[int64]db.Node),
+		MaxNodeSize: 512,
+	}
+
+	tree := db.NewBTree(reader, 0)
+
+	for _, size := range []int{1, db.MaxValueSize} {
+		for i := range 1000 {
+			key := []byte(strconv.Itoa(i))
+			item, _ := db.NewItem(key, bytes.Repeat([]byte{'v'}, size))
+
+			if err := tree.Insert(item); err != nil {
+				t.Fatalf("Error inserting %d, %v", i, err)
+			}
+		}
+	}
+
+	for i := range 1000 {
+		item, err := tree.Find([]byte(strconv.Itoa(i)))
+		if err != nil {
+			t.Fatalf("Key %d not found: %v", i, err)
+		}
+
+		if len(item.Value()) != db.MaxValueSize {
+			t.Fatalf("Key %d was not overwritten", i)
+		}
+	}
+
+	for id, node := range reader.nodes {
+		if float32(node.Size()) > float32(reader.MaxNodeSize)*db.MaxFillPercent {
+			t.Fatalf("A node is too big: %d, %d", node.Size(), id)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package db
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	stdio "io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rettenwander/mellowdb/io"
+)
+
+type VisualizeFormat int
+
+const (
+	// One node per line, indented by depth.
+	VisualizeText VisualizeFormat = iota
+	// A Graphviz digraph with one box per node and an edge per child.
+	VisualizeDOT
+	// Nested objects with the page, the keys and the children of every node.
+	VisualizeJSON
+)
+
+type VisualizeOptions struct {
+	Format VisualizeFormat
+	// Number of levels shown, starting with the root. Zero shows all levels.
+	MaxDepth int
+	// Keys longer than MaxKeyLength bytes are cut off, at the last whole rune.
+	// Zero shows whole keys.
+	MaxKeyLength int
+}
+
+type visualNode struct {
+	Page io.PageID
+	// Keys that aren't printable UTF-8 are hex encoded, like 0x00ff.
+	Keys []string
+	// Page IDs of all children, even if they are left out.
+	ChildPages []io.PageID
+	Children   []*visualNode `json:",omitempty"`
+}
+
+// Writes the tree to w in the format of the options.
+func (t *BTree) Visualize(w stdio.Writer, options VisualizeOptions) error {
+	t.rlock()
+	defer t.runlock()
+
+	var root *visualNode
+	if t.Root != 0 {
+		var err error
+		if root, err = t.visualNode(t.Root, 0, options); err != nil {
+			return err
+		}
+	}
+
+	switch options.Format {
+	case VisualizeText:
+		if root == nil {
+			return nil
+		}
+		return writeVisualText(w, root, 0)
+	case VisualizeDOT:
+		return writeVisualDOT(w, root)
+	case VisualizeJSON:
+		return json.NewEncoder(w).Encode(root)
+	default:
+		return fmt.Errorf("%w: %d", ErrUnknownFormat, options.Format)
+	}
+}
+
+func (t *BTree) visualNode(id io.PageID, depth int, options VisualizeOptions) (*visualNode, error) {
+	n, err := t.ReadNode(id)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &visualNode{Page: id, Keys: make([]string, len(n.items)), ChildPages: n.children}
+	for i, item := range n.items {
+		v.Keys[i] = visualKey(item.key, options.MaxKeyLength)
+	}
+
+	if options.MaxDepth > 0 && depth+1 >= options.MaxDepth {
+		return v, nil
+	}
+
+	for _, child := range n.children {
+		c, err := t.visualNode(child, depth+1, options)
+		if err != nil {
+			return nil, err
+		}
+
+		v.Children = append(v.Children, c)
+	}
+
+	return v, nil
+}
+
+// Returns the key as text, or hex encoded if it isn't printable UTF-8. A key
+// longer than max bytes is cut off, text keys at the last whole rune.
+func visualKey(key []byte, max int) string {
+	printable := utf8.Valid(key)
+	for _, r := range string(key) {
+		if !unicode.IsPrint(r) {
+			printable = false
+			break
+		}
+	}
+
+	cut := max > 0 && len(key) > max
+	if cut {
+		end := max
+		for printable && end > 0 && !utf8.RuneStart(key[end]) {
+			end--
+		}
+		key = key[:end]
+	}
+
+	text := string(key)
+	if !printable {
+		text = "0x" + hex.EncodeToString(key)
+	}
+
+	if cut {
+		text += "..."
+	}
+
+	return text
+}
+
+func writeVisualText(w stdio.Writer, v *visualNode, depth int) error {
+	_, err := fmt.Fprintf(w, "%*snode %d keys=%v children=%v\n", depth*2, "", v.Page, v.Keys, v.ChildPages)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range v.Children {
+		if err := writeVisualText(w, c, depth+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeVisualDOT(w stdio.Writer, root *visualNode) error {
+	var b strings.Builder
+	b.WriteString("digraph btree {\n\tnode [shape=box];\n")
+
+	var write func(v *visualNode)
+	write = func(v *visualNode) {
+		// \n in a label is a line break.
+		label := fmt.Sprintf("page %d\\n%s", v.Page, dotEscape(strings.Join(v.Keys, " | ")))
+		fmt.Fprintf(&b, "\tp%d [label=\"%s\"];\n", v.Page, label)
+
+		for _, c := range v.Children {
+			fmt.Fprintf(&b, "\tp%d -> p%d;\n", v.Page, c.Page)
+			write(c)
+		}
+	}
+
+	if root != nil {
+		write(root)
+	}
+
+	b.WriteString("}\n")
+	_, err := stdio.WriteString(w, b.String())
+	return err
+}
+
+// Escapes s for a quoted DOT string. The keys are printable, so only quotes
+// and backslashes need escaping.
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
@@ -0,0 +1,144 @@
+package db_test
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/db"
+)
+
+func TestVisualize(t *testing.T) {
+	reader := &NodeReaderMOCK{
+		nodes:       make(map[int64]db.Node),
+		MaxNodeSize: 512,
+	}
+
+	tree := db.NewBTree(reader, 0)
+	for i := range 500 {
+		key := []byte("key-" + strconv.Itoa(1000+i))
+		item, _ := db.NewItem(key, []byte("value"))
+		tree.Insert(item)
+	}
+
+	var buf strings.Builder
+	if err := tree.Visualize(&buf, db.VisualizeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Count(buf.String(), "\n"); lines != len(reader.nodes) {
+		t.Fatalf("Expected %d lines, got %d", len(reader.nodes), lines)
+	}
+
+	if !strings.Contains(buf.String(), "\n  node ") {
+		t.Fatalf("Expected indented children, got:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := tree.Visualize(&buf, db.VisualizeOptions{MaxDepth: 1, MaxKeyLength: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Count(buf.String(), "\n") != 1 || !strings.Contains(buf.String(), "key-...") {
+		t.Fatalf("Expected only the root with cut off keys, got:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := tree.Visualize(&buf, db.VisualizeOptions{Format: db.VisualizeDOT}); err != nil {
+		t.Fatal(err)
+	}
+
+	dot := buf.String()
+	if !strings.HasPrefix(dot, "digraph btree {") || strings.Count(dot, " -> ") != len(reader.nodes)-1 {
+		t.Fatalf("Unexpected DOT output:\n%s", dot)
+	}
+
+	buf.Reset()
+	if err := tree.Visualize(&buf, db.VisualizeOptions{Format: db.VisualizeJSON, MaxDepth: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	var root struct {
+		Page       int64
+		Keys       []string
+		ChildPages []int64
+		Children   []struct {
+			Page     int64
+			Children []any
+		}
+	}
+	if err := json.Unmarshal([]byte(buf.String()), &root); err != nil {
+		t.Fatal(err)
+	}
+
+	if root.Page != tree.Root || len(root.Children) != len(root.ChildPages) || len(root.Keys)+1 != len(root.Children) {
+		t.Fatalf("Unexpected root %+v", root)
+	}
+
+	for _, child := range root.Children {
+		if len(child.Children) != 0 {
+			t.Fatal("Expected the depth limit to leave out the grandchildren")
+		}
+	}
+
+	if err := tree.Visualize(&buf, db.VisualizeOptions{Format: 42}); !errors.Is(err, db.ErrUnknownFormat) {
+		t.Fatalf("Expected ErrUnknownFormat, got %v", err)
+	}
+}
+
+func TestVisualizeKeys(t *testing.T) {
+	reader := &NodeReaderMOCK{
+		nodes:       make(map[int64]db.Node),
+		MaxNodeSize: 512,
+	}
+
+	tree := db.NewBTree(reader, 0)
+	for _, key := range []string{"\x00\xff", `say "hi" \o/`, "grüße"} {
+		item, _ := db.NewItem([]byte(key), []byte("value"))
+		if err := tree.Insert(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf strings.Builder
+	if err := tree.Visualize(&buf, db.VisualizeOptions{Format: db.VisualizeJSON}); err != nil {
+		t.Fatal(err)
+	}
+
+	var root struct{ Keys []string }
+	if err := json.Unmarshal([]byte(buf.String()), &root); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"0x00ff", "grüße", `say "hi" \o/`}; !slices.Equal(root.Keys, want) {
+		t.Fatalf("Expected keys %q, got %q", want, root.Keys)
+	}
+
+	// The ü takes the third and fourth byte, a cut after the third drops it.
+	buf.Reset()
+	if err := tree.Visualize(&buf, db.VisualizeOptions{Format: db.VisualizeJSON, MaxKeyLength: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := json.Unmarshal([]byte(buf.String()), &root); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"0x00ff", "gr...", "say..."}; !slices.Equal(root.Keys, want) {
+		t.Fatalf("Expected keys %q, got %q", want, root.Keys)
+	}
+
+	buf.Reset()
+	if err := tree.Visualize(&buf, db.VisualizeOptions{Format: db.VisualizeDOT}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), `grüße | say \"hi\" \\o/"]`) {
+		t.Fatalf("Expected an escaped DOT label, got:\n%s", buf.String())
+	}
+
+	tree.DumpTree(t, tree.Root, "")
+}
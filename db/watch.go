@@ -0,0 +1,270 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+)
+
+// Number of events buffered for a watcher before it overflows.
+const watchBufferSize = 256
+
+// Number of changes queued until the next commit. Beyond it the changes of
+// the commit are dropped, and watchers and commit hooks are told they lost them.
+const maxQueuedChanges = 65536
+
+type ChangeType int
+
+const (
+	ChangePut ChangeType = iota + 1
+	ChangeDelete
+	// Events were dropped because the watcher didn't keep up. The watcher
+	// should reload its state; events resume once its channel is drained.
+	ChangeOverflow
+)
+
+// ChangeEvent describes a durable change of a key in a collection.
+type ChangeEvent struct {
+	Type       ChangeType
+	Collection string
+	Key        []byte
+
+	// Nil if the key didn't exist before the change.
+	OldValue []byte
+	// Nil for deletes.
+	NewValue []byte
+	// Zero if the new item doesn't expire.
+	ExpiresAt time.Time
+
+	// Sequence of the commit that made the change durable. Commits happen on Sync and Close.
+	Sequence uint64
+}
+
+type watcher struct {
+	prefix     []byte
+	events     chan ChangeEvent
+	overflowed bool
+	// Stops waiting for the context of the watcher.
+	stop func() bool
+}
+
+// Gets all changes of every commit, called with the lock of the DB held.
+// lost is called instead of fn for commits whose changes were dropped.
+type commitHook struct {
+	fn   func(sequence uint64, changes []ChangeEvent)
+	lost func(sequence uint64)
+}
+
+type watchers struct {
+	mu     sync.Mutex
+	all    map[*watcher]struct{}
+	hooks  map[*commitHook]struct{}
+	next   []ChangeEvent
+	lost   bool
+	closed bool
+}
+
+// Returns a channel that receives the changes of keys starting with prefix in
+// all collections. Events are sent once the change is durable. The channel is
+// closed when ctx is done or the DB is closed. Watching a closed DB returns a
+// closed channel.
+//
+// Writers never wait for a watcher. If its buffer fills up the watcher gets a
+// ChangeOverflow event and misses the following events until it drained the channel.
+func (e *DB) Watch(ctx context.Context, prefix []byte) <-chan ChangeEvent {
+	w := &watcher{
+		prefix: append([]byte(nil), prefix...),
+		events: make(chan ChangeEvent, watchBufferSize),
+	}
+
+	e.watchers.mu.Lock()
+	defer e.watchers.mu.Unlock()
+
+	if e.watchers.closed {
+		close(w.events)
+		return w.events
+	}
+
+	if e.watchers.all == nil {
+		e.watchers.all = make(map[*watcher]struct{})
+	}
+	e.watchers.all[w] = struct{}{}
+	w.stop = context.AfterFunc(ctx, func() { e.removeWatcher(w) })
+
+	return w.events
+}
+
+func (e *DB) removeWatcher(w *watcher) {
+	e.watchers.mu.Lock()
+	defer e.watchers.mu.Unlock()
+
+	if _, ok := e.watchers.all[w]; ok {
+		delete(e.watchers.all, w)
+		close(w.events)
+	}
+}
+
+func (e *DB) closeWatchers() {
+	e.watchers.mu.Lock()
+	defer e.watchers.mu.Unlock()
+
+	for w := range e.watchers.all {
+		delete(e.watchers.all, w)
+		w.stop()
+		close(w.events)
+	}
+	e.watchers.next = nil
+	e.watchers.lost = false
+	e.watchers.closed = true
+}
+
+// The caller must hold the lock of the DB.
+func (e *DB) addCommitHook(hook *commitHook) {
+	e.watchers.mu.Lock()
+	defer e.watchers.mu.Unlock()
+
+	if e.watchers.hooks == nil {
+		e.watchers.hooks = make(map[*commitHook]struct{})
+	}
+	e.watchers.hooks[hook] = struct{}{}
+}
+
+// Changes written while nobody watched weren't queued. If there are any, the
+// next commit is published as lost, so a new hook doesn't miss them.
+// The caller must hold the lock of the DB.
+func (e *DB) addCommitHookAfterChanges(hook *commitHook) {
+	e.watchers.mu.Lock()
+	if len(e.watchers.all) == 0 && len(e.watchers.hooks) == 0 && e.io.HasChanges() {
+		e.watchers.lost = true
+	}
+	e.watchers.mu.Unlock()
+
+	e.addCommitHook(hook)
+}
+
+func (e *DB) removeCommitHook(hook *commitHook) {
+	e.watchers.mu.Lock()
+	defer e.watchers.mu.Unlock()
+
+	delete(e.watchers.hooks, hook)
+}
+
+// Queues a change until the next commit. Nothing is queued if nobody watches.
+func (t *BTree) recordChange(typ ChangeType, key []byte, old, new *Item) {
+	if t.db == nil || t.name == "" || isInternalCollection(t.name) {
+		return
+	}
+
+	w := &t.db.watchers
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.all) == 0 && len(w.hooks) == 0 || w.lost {
+		return
+	}
+
+	if len(w.next) >= maxQueuedChanges {
+		w.next = nil
+		w.lost = true
+		return
+	}
+
+	event := ChangeEvent{Type: typ, Collection: t.name, Key: bytes.Clone(key)}
+	if old != nil {
+		event.OldValue = bytes.Clone(old.value)
+	}
+	if new != nil {
+		event.NewValue = bytes.Clone(new.value)
+
+		if expiresAt, ok := new.ExpiresAt(); ok {
+			event.ExpiresAt = expiresAt
+		}
+	}
+
+	w.next = append(w.next, event)
+}
+
+// Returns the number of changes queued for the next commit.
+func (e *DB) queuedChanges() int {
+	e.watchers.mu.Lock()
+	defer e.watchers.mu.Unlock()
+
+	return len(e.watchers.next)
+}
+
+// Drops the changes queued after the first n, because their writes were taken back.
+func (e *DB) dropChanges(n int) {
+	e.watchers.mu.Lock()
+	defer e.watchers.mu.Unlock()
+
+	if len(e.watchers.next) > n {
+		e.watchers.next = e.watchers.next[:n]
+	}
+}
+
+// Sends the queued changes to the watchers. The caller must hold the lock of
+// the DB, which keeps the commits in order.
+func (e *DB) publishChanges(sequence uint64) {
+	e.watchers.mu.Lock()
+	defer e.watchers.mu.Unlock()
+
+	changes := e.watchers.next
+	e.watchers.next = nil
+
+	if e.watchers.lost {
+		e.watchers.lost = false
+
+		for w := range e.watchers.all {
+			w.overflow(sequence)
+		}
+
+		for hook := range e.watchers.hooks {
+			hook.lost(sequence)
+		}
+
+		return
+	}
+
+	for i := range changes {
+		changes[i].Sequence = sequence
+
+		for w := range e.watchers.all {
+			if bytes.HasPrefix(changes[i].Key, w.prefix) {
+				w.send(changes[i])
+			}
+		}
+	}
+
+	for hook := range e.watchers.hooks {
+		hook.fn(sequence, changes)
+	}
+}
+
+// Sends without blocking. The last free slot is kept for the overflow event.
+func (w *watcher) send(event ChangeEvent) {
+	if w.overflowed {
+		if len(w.events) > 0 {
+			return
+		}
+
+		w.overflowed = false
+	}
+
+	if len(w.events) < cap(w.events)-1 {
+		w.events <- event
+		return
+	}
+
+	w.overflow(event.Sequence)
+}
+
+// Sends the overflow event unless the watcher already missed events.
+func (w *watcher) overflow(sequence uint64) {
+	if w.overflowed {
+		return
+	}
+
+	w.overflowed = true
+	w.events <- ChangeEvent{Type: ChangeOverflow, Sequence: sequence}
+}
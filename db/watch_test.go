@@ -0,0 +1,243 @@
+package db_test
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/db"
+	"github.com/rettenwander/mellowdb/io"
+)
+
+func TestWatch(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	dbEngine, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	tree, err := dbEngine.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := dbEngine.Watch(ctx, []byte("user:"))
+
+	item, _ := db.NewItem([]byte("user:1"), []byte("alice"))
+	tree.Insert(item)
+	item, _ = db.NewItem([]byte("user:1"), []byte("bob"))
+	tree.Insert(item)
+	item, _ = db.NewItem([]byte("other"), []byte("ignored"))
+	tree.Insert(item)
+	tree.Delete([]byte("user:1"))
+
+	select {
+	case event := <-events:
+		t.Fatalf("Expected no event before the commit, got %+v", event)
+	default:
+	}
+
+	if err := dbEngine.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []db.ChangeEvent{
+		{Type: db.ChangePut, Key: []byte("user:1"), NewValue: []byte("alice")},
+		{Type: db.ChangePut, Key: []byte("user:1"), OldValue: []byte("alice"), NewValue: []byte("bob")},
+		{Type: db.ChangeDelete, Key: []byte("user:1"), OldValue: []byte("bob")},
+	}
+
+	var sequence uint64
+	for n, want := range expected {
+		got := <-events
+		if got.Type != want.Type || got.Collection != "users" || string(got.Key) != string(want.Key) ||
+			string(got.OldValue) != string(want.OldValue) || string(got.NewValue) != string(want.NewValue) {
+			t.Fatalf("Event %d: expected %+v, got %+v", n, want, got)
+		}
+
+		if want.OldValue == nil && got.OldValue != nil {
+			t.Fatalf("Event %d: expected no old value, got %q", n, got.OldValue)
+		}
+
+		if sequence != 0 && got.Sequence != sequence {
+			t.Fatalf("Expected all events of a commit to share the sequence %d, got %d", sequence, got.Sequence)
+		}
+		sequence = got.Sequence
+	}
+
+	select {
+	case event := <-events:
+		t.Fatalf("Expected no further events, got %+v", event)
+	default:
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestWatchOverflow(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	dbEngine, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := dbEngine.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := dbEngine.Watch(context.Background(), nil)
+
+	for i := range 1000 {
+		item, _ := db.NewItem([]byte(strconv.Itoa(i)), []byte("value"))
+		if err := tree.Insert(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Writers aren't blocked by the watcher that doesn't read.
+	if err := dbEngine.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	received := 0
+	var last db.ChangeEvent
+	for len(events) > 0 {
+		last = <-events
+		received++
+	}
+
+	if last.Type != db.ChangeOverflow {
+		t.Fatalf("Expected the last event to be an overflow, got %+v", last)
+	}
+
+	if received >= 1000 {
+		t.Fatalf("Expected events to be dropped, got %d", received)
+	}
+
+	// After draining, the watcher receives events again.
+	item, _ := db.NewItem([]byte("after"), []byte("value"))
+	tree.Insert(item)
+
+	if err := dbEngine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	event, ok := <-events
+	if !ok || event.Type != db.ChangePut || string(event.Key) != "after" {
+		t.Fatalf("Expected the put of after, got %+v", event)
+	}
+
+	if _, ok := <-events; ok {
+		t.Fatal("Expected the channel to be closed with the DB")
+	}
+}
+
+func TestWatchClosedDB(t *testing.T) {
+	dbEngine, err := db.NewDBWithStorage(io.NewMemoryStorage(nil), io.EngineOptions{PageSize: io.MetadataPageSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The context is never cancelled, Close must release the watcher.
+	events := dbEngine.Watch(context.Background(), nil)
+
+	if err := dbEngine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := <-events; ok {
+		t.Fatal("Expected the channel to be closed with the DB")
+	}
+
+	if _, ok := <-dbEngine.Watch(context.Background(), nil); ok {
+		t.Fatal("Expected a closed channel when watching a closed DB")
+	}
+}
+
+func TestWatchQueueLimit(t *testing.T) {
+	dbEngine, err := db.NewDBWithStorage(io.NewMemoryStorage(nil), io.EngineOptions{PageSize: io.MetadataPageSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	tree, err := dbEngine.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := dbEngine.Watch(context.Background(), nil)
+
+	// More changes than are queued until the commit.
+	for i := range 70000 {
+		item, _ := db.NewItem([]byte(strconv.Itoa(i)), nil)
+		if err := tree.Insert(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := dbEngine.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("Expected only the overflow event, got %d events", len(events))
+	}
+
+	if event := <-events; event.Type != db.ChangeOverflow {
+		t.Fatalf("Expected an overflow, got %+v", event)
+	}
+
+	// The next commit is delivered again.
+	item, _ := db.NewItem([]byte("after"), []byte("value"))
+	tree.Insert(item)
+
+	if err := dbEngine.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if event := <-events; event.Type != db.ChangePut || string(event.Key) != "after" {
+		t.Fatalf("Expected the put of after, got %+v", event)
+	}
+}
+
+func TestCommitSequencePersists(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	dbEngine, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, _ := dbEngine.Collection("users")
+	events := dbEngine.Watch(context.Background(), nil)
+
+	item, _ := db.NewItem([]byte("a"), []byte("1"))
+	tree.Insert(item)
+	dbEngine.Close()
+	first := <-events
+
+	dbEngine, err = db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	tree, _ = dbEngine.Collection("users")
+	events = dbEngine.Watch(context.Background(), nil)
+
+	tree.Insert(item)
+	dbEngine.Sync()
+
+	if second := <-events; second.Sequence <= first.Sequence {
+		t.Fatalf("Expected the sequence to grow across reopen, got %d after %d", second.Sequence, first.Sequence)
+	}
+}
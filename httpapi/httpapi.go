@@ -0,0 +1,397 @@
+// Package httpapi serves a DB over HTTP with JSON bodies.
+//
+//	GET    /kv/{collection}/{key}    read an item
+//	PUT    /kv/{collection}/{key}    store {"value": ..., "expires_at": ...}
+//	DELETE /kv/{collection}/{key}    delete an item
+//	GET    /kv/{collection}          scan with prefix, start, end, limit and cursor
+//	POST   /batch                    apply {"writes": [...]} in one transaction
+//	GET    /stats                    DB statistics, with collections=true per collection
+//
+// Keys and values are base64 encoded in JSON bodies, like in db.DB.Export.
+// Writes are durable once the DB is synced, like all writes to a DB.
+// Only PUT and batch inserts create a missing collection, the other requests
+// answer 404 for it.
+package httpapi
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rettenwander/mellowdb/db"
+)
+
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 10000
+	maxBodySize      = 16 << 20
+)
+
+type Handler struct {
+	db  *db.DB
+	mux *http.ServeMux
+}
+
+func New(d *db.DB) *Handler {
+	h := &Handler{db: d, mux: http.NewServeMux()}
+
+	h.mux.HandleFunc("GET /kv/{collection}/{key...}", h.get)
+	h.mux.HandleFunc("PUT /kv/{collection}/{key...}", h.put)
+	h.mux.HandleFunc("DELETE /kv/{collection}/{key...}", h.delete)
+	h.mux.HandleFunc("GET /kv/{collection}", h.scan)
+	h.mux.HandleFunc("POST /batch", h.batch)
+	h.mux.HandleFunc("GET /stats", h.stats)
+
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+type Item struct {
+	Key       []byte     `json:"key"`
+	Value     []byte     `json:"value"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func newItem(i *db.Item) Item {
+	item := Item{Key: i.Key(), Value: i.Value()}
+	if expiresAt, ok := i.ExpiresAt(); ok {
+		item.ExpiresAt = &expiresAt
+	}
+
+	return item
+}
+
+// Body of PUT /kv/{collection}/{key}.
+type PutRequest struct {
+	Value     []byte     `json:"value"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type ScanResponse struct {
+	Items []Item `json:"items"`
+	// Pass as cursor to get the next page. Empty on the last page.
+	NextCursor []byte `json:"next_cursor,omitempty"`
+}
+
+type Write struct {
+	Collection string     `json:"collection"`
+	Key        []byte     `json:"key"`
+	Value      []byte     `json:"value,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Delete     bool       `json:"delete,omitempty"`
+}
+
+// Body of POST /batch.
+type BatchRequest struct {
+	Writes []Write `json:"writes"`
+}
+
+type BatchResponse struct {
+	Applied int `json:"applied"`
+}
+
+type StatsResponse struct {
+	DB db.Stats `json:"db"`
+	// Only set if requested, it reads every page of the collections.
+	Collections map[string]db.TreeStats `json:"collections,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+var (
+	errBadRequest  = errors.New("Bad request")
+	errBodyTooLong = errors.New("Request body too long")
+)
+
+func statusCode(err error) int {
+	switch {
+	case errors.Is(err, db.ErrNotFound), errors.Is(err, db.ErrCollectionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrValueTooLong), errors.Is(err, errBodyTooLong):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, db.ErrKeyTooLong),
+		errors.Is(err, db.ErrInvalidCollectionName),
+		errors.Is(err, errBadRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, db.ErrKeyExists), errors.Is(err, db.ErrIndexConflict):
+		return http.StatusConflict
+	case errors.Is(err, db.ErrReadOnly):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, statusCode(err), errorResponse{Error: err.Error()})
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return errBodyTooLong
+		}
+
+		return fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+
+	return nil
+}
+
+func newDBItem(key, value []byte, expiresAt *time.Time) (*db.Item, error) {
+	if expiresAt != nil {
+		return db.NewItemWithExpiry(key, value, *expiresAt)
+	}
+
+	return db.NewItem(key, value)
+}
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request) {
+	tree, err := h.db.FindCollection(r.PathValue("collection"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	item, err := tree.FindContext(r.Context(), []byte(r.PathValue("key")))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newItem(item))
+}
+
+func (h *Handler) put(w http.ResponseWriter, r *http.Request) {
+	request := PutRequest{}
+	if err := decodeBody(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	item, err := newDBItem([]byte(r.PathValue("key")), request.Value, request.ExpiresAt)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	tree, err := h.db.Collection(r.PathValue("collection"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := tree.Insert(item); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) delete(w http.ResponseWriter, r *http.Request) {
+	tree, err := h.db.FindCollection(r.PathValue("collection"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := tree.Delete([]byte(r.PathValue("key"))); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Query parameters: prefix, or start and end (exclusive), limit, and the
+// cursor of the previous page.
+func (h *Handler) scan(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := defaultScanLimit
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > maxScanLimit {
+			writeError(w, fmt.Errorf("%w: limit must be between 1 and %d", errBadRequest, maxScanLimit))
+			return
+		}
+	}
+
+	var start, end []byte
+	if query.Has("prefix") {
+		if query.Has("start") || query.Has("end") {
+			writeError(w, fmt.Errorf("%w: prefix can't be combined with start or end", errBadRequest))
+			return
+		}
+
+		start = []byte(query.Get("prefix"))
+		end = db.PrefixEnd(start)
+	} else {
+		if query.Has("start") {
+			start = []byte(query.Get("start"))
+		}
+		if query.Has("end") {
+			end = []byte(query.Get("end"))
+		}
+	}
+
+	// The cursor is the first key of the next page, base64 encoded like in the response.
+	if s := query.Get("cursor"); s != "" {
+		cursor, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			writeError(w, fmt.Errorf("%w: invalid cursor", errBadRequest))
+			return
+		}
+
+		start = cursor
+	}
+
+	tree, err := h.db.FindCollection(r.PathValue("collection"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := ScanResponse{Items: []Item{}}
+	err = tree.ScanContext(r.Context(), start, end, func(i *db.Item) bool {
+		if len(response.Items) == limit {
+			response.NextCursor = append([]byte(nil), i.Key()...)
+			return false
+		}
+
+		item := newItem(i)
+		item.Key = append([]byte(nil), item.Key...)
+		item.Value = append([]byte(nil), item.Value...)
+		response.Items = append(response.Items, item)
+		return true
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// All writes are validated against the limits of the DB, then they are
+// applied in one transaction, all of them or none.
+func (h *Handler) batch(w http.ResponseWriter, r *http.Request) {
+	request := BatchRequest{}
+	if err := decodeBody(w, r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	options := h.db.Options()
+	items := make([]*db.Item, len(request.Writes))
+	// Only inserts create a missing collection, once the batch is applied.
+	inserted := map[string]bool{}
+
+	for n, write := range request.Writes {
+		var err error
+		switch {
+		case len(write.Key) > options.MaxKeySize:
+			err = fmt.Errorf("%w: the DB allows %d bytes", db.ErrKeyTooLong, options.MaxKeySize)
+		case write.Delete:
+			if !inserted[write.Collection] {
+				_, err = h.db.FindCollection(write.Collection)
+			}
+		case len(write.Value) > options.MaxValueSize:
+			err = fmt.Errorf("%w: the DB allows %d bytes", db.ErrValueTooLong, options.MaxValueSize)
+		default:
+			items[n], err = newDBItem(write.Key, write.Value, write.ExpiresAt)
+			inserted[write.Collection] = true
+		}
+
+		if err != nil {
+			writeError(w, fmt.Errorf("write %d: %w", n, err))
+			return
+		}
+	}
+
+	err := h.db.TransactionContext(r.Context(), func(tx *db.Tx) error {
+		for n, write := range request.Writes {
+			var err error
+			if write.Delete {
+				err = tx.Delete(write.Collection, write.Key)
+			} else {
+				err = tx.Insert(write.Collection, items[n])
+			}
+
+			if err != nil {
+				return fmt.Errorf("write %d: %w", n, err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, BatchResponse{Applied: len(request.Writes)})
+}
+
+// Query parameter: collections=true adds the statistics of every collection.
+func (h *Handler) stats(w http.ResponseWriter, r *http.Request) {
+	withCollections := false
+	if s := r.URL.Query().Get("collections"); s != "" {
+		var err error
+		if withCollections, err = strconv.ParseBool(s); err != nil {
+			writeError(w, fmt.Errorf("%w: collections must be true or false", errBadRequest))
+			return
+		}
+	}
+
+	response := StatsResponse{}
+	if withCollections {
+		names, err := h.db.Collections()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		response.Collections = map[string]db.TreeStats{}
+		for _, name := range names {
+			tree, err := h.db.FindCollection(name)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+
+			if response.Collections[name], err = tree.Stats(); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+	}
+
+	var err error
+	if response.DB, err = h.db.Stats(); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,314 @@
+package httpapi_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/db"
+	"github.com/rettenwander/mellowdb/httpapi"
+)
+
+func newServer(t *testing.T) *httptest.Server {
+	dbEngine, err := db.NewDB(filepath.Join(t.TempDir(), "test.mellow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbEngine.Close() })
+
+	srv := httptest.NewServer(httpapi.New(dbEngine))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func request(t *testing.T, srv *httptest.Server, method, path string, body any, response any) int {
+	t.Helper()
+
+	var reader *bytes.Reader
+	if s, ok := body.(string); ok {
+		reader = bytes.NewReader([]byte(s))
+	} else if body != nil {
+		buf, _ := json.Marshal(body)
+		reader = bytes.NewReader(buf)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, srv.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if response != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+func TestKV(t *testing.T) {
+	srv := newServer(t)
+
+	if code := request(t, srv, "GET", "/kv/users/alice", nil, nil); code != http.StatusNotFound {
+		t.Fatalf("Expected 404, got %d", code)
+	}
+
+	if code := request(t, srv, "PUT", "/kv/users/alice", httpapi.PutRequest{Value: []byte("admin")}, nil); code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", code)
+	}
+
+	// Keys can contain slashes and escaped bytes.
+	if code := request(t, srv, "PUT", "/kv/users/a%2Fb/c%00", httpapi.PutRequest{Value: []byte{0, 1}}, nil); code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", code)
+	}
+
+	item := httpapi.Item{}
+	if code := request(t, srv, "GET", "/kv/users/alice", nil, &item); code != http.StatusOK || string(item.Value) != "admin" {
+		t.Fatalf("Expected admin, got %d %+v", code, item)
+	}
+
+	if code := request(t, srv, "GET", "/kv/users/a%2Fb/c%00", nil, &item); code != http.StatusOK || string(item.Key) != "a/b/c\x00" {
+		t.Fatalf("Expected the key a/b/c\\x00, got %d %q", code, item.Key)
+	}
+
+	if code := request(t, srv, "DELETE", "/kv/users/alice", nil, nil); code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", code)
+	}
+
+	if code := request(t, srv, "GET", "/kv/users/alice", nil, nil); code != http.StatusNotFound {
+		t.Fatalf("Expected 404 after the delete, got %d", code)
+	}
+
+	longKey := strings.Repeat("k", db.MaxKeySize+1)
+	if code := request(t, srv, "PUT", "/kv/users/"+longKey, httpapi.PutRequest{}, nil); code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a long key, got %d", code)
+	}
+
+	longValue := bytes.Repeat([]byte("v"), db.MaxValueSize+1)
+	if code := request(t, srv, "PUT", "/kv/users/bob", httpapi.PutRequest{Value: longValue}, nil); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected 413 for a long value, got %d", code)
+	}
+
+	if code := request(t, srv, "PUT", "/kv/users/bob", "not json", nil); code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a bad body, got %d", code)
+	}
+
+	if code := request(t, srv, "GET", "/kv/%00internal/key", nil, nil); code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an internal collection, got %d", code)
+	}
+}
+
+func TestScanAndBatch(t *testing.T) {
+	srv := newServer(t)
+
+	batch := httpapi.BatchRequest{}
+	for i := range 250 {
+		batch.Writes = append(batch.Writes, httpapi.Write{
+			Collection: "users",
+			Key:        fmt.Appendf(nil, "user:%03d", i),
+			Value:      []byte("v"),
+		})
+	}
+	batch.Writes = append(batch.Writes, httpapi.Write{Collection: "users", Key: []byte("user:000"), Delete: true})
+
+	response := httpapi.BatchResponse{}
+	if code := request(t, srv, "POST", "/batch", batch, &response); code != http.StatusOK || response.Applied != 251 {
+		t.Fatalf("Expected 251 applied writes, got %d %+v", code, response)
+	}
+
+	invalid := httpapi.BatchRequest{Writes: []httpapi.Write{
+		{Collection: "users", Key: []byte("new"), Value: []byte("v")},
+		{Collection: "users", Key: []byte("too-long"), Value: bytes.Repeat([]byte("v"), db.MaxValueSize+1)},
+	}}
+	if code := request(t, srv, "POST", "/batch", invalid, nil); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected 413, got %d", code)
+	}
+
+	if code := request(t, srv, "GET", "/kv/users/new", nil, nil); code != http.StatusNotFound {
+		t.Fatalf("Expected an invalid batch to write nothing, got %d", code)
+	}
+
+	keys := []string{}
+	cursor := ""
+	for {
+		query := url.Values{"prefix": {"user:"}, "limit": {"100"}}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+
+		page := httpapi.ScanResponse{}
+		if code := request(t, srv, "GET", "/kv/users?"+query.Encode(), nil, &page); code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", code)
+		}
+
+		for _, item := range page.Items {
+			keys = append(keys, string(item.Key))
+		}
+
+		if page.NextCursor == nil {
+			break
+		}
+		cursor = base64.StdEncoding.EncodeToString(page.NextCursor)
+	}
+
+	if len(keys) != 249 || keys[0] != "user:001" || keys[248] != "user:249" {
+		t.Fatalf("Unexpected scan of %d keys", len(keys))
+	}
+
+	page := httpapi.ScanResponse{}
+	request(t, srv, "GET", "/kv/users?start=user:010&end=user:020", nil, &page)
+	if len(page.Items) != 10 || page.NextCursor != nil {
+		t.Fatalf("Expected 10 items in the range, got %d", len(page.Items))
+	}
+
+	if code := request(t, srv, "GET", "/kv/users?prefix=a&start=b", nil, nil); code != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %d", code)
+	}
+
+	stats := httpapi.StatsResponse{}
+	if code := request(t, srv, "GET", "/stats", nil, &stats); code != http.StatusOK || stats.Collections != nil {
+		t.Fatalf("Expected no collection stats unless requested, got %d %+v", code, stats.Collections)
+	}
+
+	if code := request(t, srv, "GET", "/stats?collections=true", nil, &stats); code != http.StatusOK || stats.Collections["users"].Items != 249 {
+		t.Fatalf("Unexpected stats %d %+v", code, stats.Collections)
+	}
+
+	if code := request(t, srv, "GET", "/stats?collections=maybe", nil, nil); code != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %d", code)
+	}
+}
+
+func newServerWithDB(t *testing.T, options db.Options) (*httptest.Server, *db.DB) {
+	dbEngine, err := db.NewDBWithOptions(filepath.Join(t.TempDir(), "test.mellow"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbEngine.Close() })
+
+	srv := httptest.NewServer(httpapi.New(dbEngine))
+	t.Cleanup(srv.Close)
+
+	return srv, dbEngine
+}
+
+func TestBatchLimits(t *testing.T) {
+	srv, _ := newServerWithDB(t, db.Options{MaxKeySize: 16, MaxValueSize: 16})
+
+	for _, write := range []httpapi.Write{
+		{Collection: "users", Key: []byte("key"), Value: bytes.Repeat([]byte("v"), 17)},
+		{Collection: "users", Key: bytes.Repeat([]byte("k"), 17), Value: []byte("v")},
+		{Collection: "users", Key: bytes.Repeat([]byte("k"), 17), Delete: true},
+	} {
+		batch := httpapi.BatchRequest{Writes: []httpapi.Write{write}}
+		if code := request(t, srv, "POST", "/batch", batch, nil); code != http.StatusRequestEntityTooLarge && code != http.StatusBadRequest {
+			t.Fatalf("Expected the limits of the DB to reject %+v, got %d", write, code)
+		}
+	}
+
+	stats := httpapi.StatsResponse{}
+	if code := request(t, srv, "GET", "/stats?collections=true", nil, &stats); code != http.StatusOK || len(stats.Collections) != 0 {
+		t.Fatalf("Expected no collections to be created, got %d %+v", code, stats.Collections)
+	}
+}
+
+// A write that fails while the batch is applied takes back the earlier ones.
+func TestBatchIsAtomic(t *testing.T) {
+	srv, dbEngine := newServerWithDB(t, db.Options{})
+
+	tree, err := dbEngine.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	email := func(value []byte) [][]byte { return [][]byte{value} }
+	if err := tree.AddIndex(db.IndexOptions{Name: "email", Func: email, Unique: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := httpapi.BatchRequest{Writes: []httpapi.Write{
+		{Collection: "other", Key: []byte("key"), Value: []byte("v")},
+		{Collection: "users", Key: []byte("a"), Value: []byte("a@example.com")},
+		{Collection: "users", Key: []byte("b"), Value: []byte("a@example.com")},
+	}}
+	if code := request(t, srv, "POST", "/batch", batch, nil); code != http.StatusConflict {
+		t.Fatalf("Expected 409, got %d", code)
+	}
+
+	if code := request(t, srv, "GET", "/kv/users/a", nil, nil); code != http.StatusNotFound {
+		t.Fatalf("Expected the failed batch to write nothing, got %d", code)
+	}
+
+	if _, err := dbEngine.FindCollection("other"); !errors.Is(err, db.ErrCollectionNotFound) {
+		t.Fatalf("Expected the failed batch to create no collection, got %v", err)
+	}
+}
+
+func TestMissingCollection(t *testing.T) {
+	srv := newServer(t)
+
+	for _, r := range []struct{ method, path string }{
+		{"GET", "/kv/missing/key"},
+		{"GET", "/kv/missing"},
+		{"DELETE", "/kv/missing/key"},
+	} {
+		if code := request(t, srv, r.method, r.path, nil, nil); code != http.StatusNotFound {
+			t.Fatalf("Expected 404 for %s %s, got %d", r.method, r.path, code)
+		}
+	}
+
+	batch := httpapi.BatchRequest{Writes: []httpapi.Write{{Collection: "missing", Key: []byte("key"), Delete: true}}}
+	if code := request(t, srv, "POST", "/batch", batch, nil); code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a batch delete, got %d", code)
+	}
+
+	stats := httpapi.StatsResponse{}
+	if code := request(t, srv, "GET", "/stats?collections=true", nil, &stats); code != http.StatusOK || len(stats.Collections) != 0 {
+		t.Fatalf("Expected no collections to be created, got %d %+v", code, stats.Collections)
+	}
+}
+
+func TestReadOnlyMissingCollection(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	dbEngine, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dbEngine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if dbEngine, err = db.NewDBWithOptions(file, db.Options{ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbEngine.Close() })
+
+	srv := httptest.NewServer(httpapi.New(dbEngine))
+	t.Cleanup(srv.Close)
+
+	if code := request(t, srv, "GET", "/kv/missing/key", nil, nil); code != http.StatusNotFound {
+		t.Fatalf("Expected 404, got %d", code)
+	}
+
+	if code := request(t, srv, "PUT", "/kv/missing/key", httpapi.PutRequest{Value: []byte("v")}, nil); code != http.StatusForbidden {
+		t.Fatalf("Expected 403 for a write, got %d", code)
+	}
+}
@@ -5,4 +5,7 @@ const (
 	PageIDSize = 8
 
 	MetadataPageSize = 4096
+
+	// Offsets inside a page are 16 bits.
+	MaxPageSize = 1 << 16
 )
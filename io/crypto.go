@@ -0,0 +1,112 @@
+package io
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// Size of the encryption key in bytes. Pages are encrypted with AES-256-GCM.
+	EncryptionKeySize = 32
+
+	// Size of the plaintext header at the start of the metadata page of an encrypted file.
+	EncryptionHeaderSize = 16
+)
+
+// Marks the metadata page of an encrypted file.
+var encryptionMagic = []byte("MELLOWE1")
+
+// Encrypted pages are stored as
+//
+// ----------------------------------
+// | Nonce | Encrypted Data | Tag |
+// ----------------------------------
+//
+// with the PageID bound in as associated data, so pages can't be swapped.
+// The metadata page starts with a plaintext header that marks the file as encrypted.
+func newPageCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != EncryptionKeySize {
+		return nil, ErrInvalidKeySize
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func pageAssociatedData(id PageID) []byte {
+	ad := make([]byte, PageIDSize)
+	binary.LittleEndian.PutUint64(ad, uint64(id))
+	return ad
+}
+
+func pageHeaderSize(id PageID) int {
+	if id == 0 {
+		return EncryptionHeaderSize
+	}
+
+	return 0
+}
+
+// Returns the number of bytes encryption takes from a page.
+func encryptionOverhead(aead cipher.AEAD, id PageID) int {
+	return pageHeaderSize(id) + aead.NonceSize() + aead.Overhead()
+}
+
+// Encrypts data into raw. Raw must be exactly encryptionOverhead bytes larger than data.
+func sealPage(aead cipher.AEAD, id PageID, data []byte, raw []byte) error {
+	header := pageHeaderSize(id)
+	if header > 0 {
+		copy(raw, encryptionMagic)
+	}
+
+	nonce := raw[header : header+aead.NonceSize()]
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	aead.Seal(raw[header+aead.NonceSize():header+aead.NonceSize()], nonce, data, pageAssociatedData(id))
+	return nil
+}
+
+// Decrypts a raw page. Every page has to authenticate, an all-zero page as well.
+func openPage(aead cipher.AEAD, id PageID, raw []byte) ([]byte, error) {
+	dataSize := len(raw) - encryptionOverhead(aead, id)
+	if dataSize < 0 {
+		return nil, fmt.Errorf("%w: page %d is too small", ErrReadPage, id)
+	}
+
+	header := pageHeaderSize(id)
+	if header > 0 && !bytes.Equal(raw[:len(encryptionMagic)], encryptionMagic) {
+		return nil, ErrBadKey
+	}
+
+	nonce := raw[header : header+aead.NonceSize()]
+	data, err := aead.Open(make([]byte, 0, dataSize), nonce, raw[header+aead.NonceSize():], pageAssociatedData(id))
+	if err != nil {
+		return nil, fmt.Errorf("%w: page %d", ErrBadKey, id)
+	}
+
+	return data, nil
+}
+
+func isEncryptedMetadataPage(raw []byte) bool {
+	return len(raw) >= len(encryptionMagic) && bytes.Equal(raw[:len(encryptionMagic)], encryptionMagic)
+}
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
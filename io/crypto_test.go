@@ -0,0 +1,253 @@
+package io_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/io"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, io.EncryptionKeySize)
+}
+
+func TestEncryptedEngineRW(t *testing.T) {
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "test.mellow")
+
+	options := io.EngineOptions{
+		PageSize:      uint32(os.Getpagesize()),
+		FileName:      file,
+		EncryptionKey: testKey(1),
+	}
+	e, err := io.NewEngine(options)
+	if err != nil {
+		t.Fatalf("io.Engine - open file failed: %v", err)
+	}
+
+	if e.PageDataSize() >= int(options.PageSize) {
+		t.Fatalf("Page data size %d doesn't leave room for nonce and tag", e.PageDataSize())
+	}
+
+	data := []byte("This is secret test data")
+
+	pageW := e.AllocateEmptyPageWithFreeID()
+	copy(pageW.Data, data)
+
+	if err := e.WritePage(pageW); err != nil {
+		t.Fatalf("Failed to write page: %v", err)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatalf("io.Engine - close file failed: %v", err)
+	}
+
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(raw, data) {
+		t.Fatal("Plaintext found in encrypted file")
+	}
+
+	e, err = io.NewEngine(options)
+	if err != nil {
+		t.Fatalf("io.Engine - reopen file failed: %v", err)
+	}
+	defer e.Close()
+
+	pageR, err := e.ReadPage(pageW.GetID())
+	if err != nil {
+		t.Fatalf("Failed to read page: %v", err)
+	}
+
+	if !bytes.Equal(pageR.Data, pageW.Data) {
+		t.Fatalf("The read data is different from the written data.")
+	}
+}
+
+func TestEncryptedEngineBadKey(t *testing.T) {
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "test.mellow")
+	plainFile := filepath.Join(tmpDir, "plain.mellow")
+
+	options := io.EngineOptions{
+		PageSize:      uint32(os.Getpagesize()),
+		FileName:      file,
+		EncryptionKey: testKey(1),
+	}
+	e, err := io.NewEngine(options)
+	if err != nil {
+		t.Fatalf("io.Engine - open file failed: %v", err)
+	}
+	e.Close()
+
+	options.EncryptionKey = testKey(2)
+	if _, err := io.NewEngine(options); !errors.Is(err, io.ErrBadKey) {
+		t.Fatalf("Expected ErrBadKey for wrong key, got %v", err)
+	}
+
+	options.EncryptionKey = nil
+	if _, err := io.NewEngine(options); !errors.Is(err, io.ErrBadKey) {
+		t.Fatalf("Expected ErrBadKey for missing key, got %v", err)
+	}
+
+	options.EncryptionKey = []byte("short")
+	if _, err := io.NewEngine(options); !errors.Is(err, io.ErrInvalidKeySize) {
+		t.Fatalf("Expected ErrInvalidKeySize, got %v", err)
+	}
+
+	plain, err := io.NewEngine(io.EngineOptions{PageSize: uint32(os.Getpagesize()), FileName: plainFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.Close()
+
+	options = io.EngineOptions{PageSize: uint32(os.Getpagesize()), FileName: plainFile, EncryptionKey: testKey(1)}
+	if _, err := io.NewEngine(options); !errors.Is(err, io.ErrBadKey) {
+		t.Fatalf("Expected ErrBadKey for plaintext file, got %v", err)
+	}
+}
+
+func TestEncryptedPageTampering(t *testing.T) {
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "test.mellow")
+
+	options := io.EngineOptions{
+		PageSize:      uint32(os.Getpagesize()),
+		FileName:      file,
+		EncryptionKey: testKey(1),
+	}
+	e, err := io.NewEngine(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	first := e.AllocateEmptyPageWithFreeID()
+	second := e.AllocateEmptyPageWithFreeID()
+	copy(first.Data, "first")
+	copy(second.Data, "second")
+
+	if err := e.WritePage(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.WritePage(second); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(file, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Copying a page to another PageID must be detected.
+	raw := make([]byte, options.PageSize)
+	if _, err := f.ReadAt(raw, int64(second.GetID())*int64(options.PageSize)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(raw, int64(first.GetID())*int64(options.PageSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.ReadPage(first.GetID()); !errors.Is(err, io.ErrBadKey) {
+		t.Fatalf("Expected ErrBadKey for swapped page, got %v", err)
+	}
+
+	// And so must a flipped bit.
+	raw[100] ^= 1
+	if _, err := f.WriteAt(raw, int64(second.GetID())*int64(options.PageSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.ReadPage(second.GetID()); !errors.Is(err, io.ErrBadKey) {
+		t.Fatalf("Expected ErrBadKey for modified page, got %v", err)
+	}
+
+	// A zeroed page inside the file doesn't authenticate either.
+	if _, err := f.WriteAt(make([]byte, options.PageSize), int64(first.GetID())*int64(options.PageSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.ReadPage(first.GetID()); !errors.Is(err, io.ErrBadKey) {
+		t.Fatalf("Expected ErrBadKey for zeroed page, got %v", err)
+	}
+
+	// Only a page beyond the end of the file reads as zeros.
+	page, err := e.ReadPage(e.GetNextFreePageID())
+	if err != nil || !bytes.Equal(page.Data, make([]byte, len(page.Data))) {
+		t.Fatalf("Expected an unwritten page to read as zeros, got %v", err)
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "test.mellow")
+
+	options := io.EngineOptions{
+		PageSize:      uint32(os.Getpagesize()),
+		FileName:      file,
+		EncryptionKey: testKey(1),
+	}
+	e, err := io.NewEngine(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages := make([]*io.Page, 5)
+	for i := range pages {
+		pages[i] = e.AllocateEmptyPageWithFreeID()
+		copy(pages[i].Data, bytes.Repeat([]byte{byte(i + 1)}, 64))
+
+		if err := e.WritePage(pages[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Allocated but never written
+	e.GetNextFreePageID()
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err = io.NewEngine(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.RotateKey(testKey(2)); err != nil {
+		t.Fatalf("Failed to rotate key: %v", err)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.NewEngine(options); !errors.Is(err, io.ErrBadKey) {
+		t.Fatalf("Old key still opens the file: %v", err)
+	}
+
+	options.EncryptionKey = testKey(2)
+	e, err = io.NewEngine(options)
+	if err != nil {
+		t.Fatalf("New key doesn't open the file: %v", err)
+	}
+	defer e.Close()
+
+	for _, page := range pages {
+		pageR, err := e.ReadPage(page.GetID())
+		if err != nil {
+			t.Fatalf("Failed to read page %d: %v", page.GetID(), err)
+		}
+
+		if !bytes.Equal(pageR.Data, page.Data) {
+			t.Fatalf("Page %d changed during key rotation", page.GetID())
+		}
+	}
+}
@@ -1,99 +1,398 @@
 package io
 
 import (
+	"cmp"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	stdio "io"
 	"os"
+	"slices"
 )
 
 type EngineOptions struct {
 	FileName string
+	// Page size of a new file, between MetadataPageSize and MaxPageSize. Zero uses
+	// the page size of an existing file, or os.Getpagesize() for a new one.
 	PageSize uint32
+
+	// Encrypts every page with AES-256-GCM if set. The key must be EncryptionKeySize bytes.
+	EncryptionKey []byte
+
+	// Opens an existing file with a shared lock and never writes it. Changes
+	// return ErrReadOnly. Writers hold an exclusive lock, so the file can't be
+	// opened read-only and writable at the same time.
+	ReadOnly bool
 }
 
 type Engine struct {
 	Metadata
 
-	file *os.File
+	storage  Storage
+	aead     cipher.AEAD
+	readOnly bool
+
+	// Pages of the free list chain the metadata on disk points to.
+	freelistPages []PageID
+
+	// Pages allocated since the last commit. The committed state doesn't
+	// reference them, so they can be overwritten in place and are reused
+	// right away once they are freed.
+	fresh map[PageID]struct{}
+	// Pages freed since the last commit. The committed state may still
+	// reference them, so they are reused after the next commit.
+	pending []PageID
+	// While readers hold the freed pages, the pending pages aren't reused
+	// after a commit, see HoldFreedPages.
+	holds int
+	// Generation of the current metadata slot.
+	generation uint64
+
+	counters engineCounters
 }
 
 func NewEngine(optoins EngineOptions) (*Engine, error) {
-	e := &Engine{Metadata: *NewMetadata(), file: nil}
+	flag := os.O_RDWR | os.O_CREATE
+	if optoins.ReadOnly {
+		flag = os.O_RDONLY
+	}
 
-	err := e.open(optoins)
+	file, err := os.OpenFile(optoins.FileName, flag, 0666)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := lockFile(file, optoins.ReadOnly); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	e, err := NewEngineWithStorage(fileStorage{file}, optoins)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
 	return e, nil
 }
 
-// If the ErrPageSizeNotUsed error is returned, the engine is still operational.
-func (e *Engine) open(options EngineOptions) error {
-	if e.file != nil {
+// Opens the engine on storage, for example a section of a larger file or a
+// MemoryStorage. Empty storage gets a new DB unless the engine is read-only;
+// the FileName option is ignored.
+// The storage is closed with the engine if it implements io.Closer.
+func NewEngineWithStorage(storage Storage, options EngineOptions) (*Engine, error) {
+	e := &Engine{Metadata: *NewMetadata(), fresh: make(map[PageID]struct{})}
+
+	err := e.open(storage, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (e *Engine) open(storage Storage, options EngineOptions) error {
+	if e.storage != nil {
 		return nil
 	}
 
-	if _, err := os.Stat(options.FileName); err == nil {
-		e.file, err = os.OpenFile(options.FileName, os.O_RDWR|os.O_CREATE, 0666)
-		if err != nil {
-			return err
-		}
+	if options.PageSize != 0 && (options.PageSize < MetadataPageSize || options.PageSize > MaxPageSize) {
+		return ErrInvalidPageSize
+	}
 
-		metadataPage, err := e.ReadPage(PageID(0))
+	if options.EncryptionKey != nil {
+		aead, err := newPageCipher(options.EncryptionKey)
 		if err != nil {
 			return err
 		}
 
-		e.Metadata.ReadFromBuffer(metadataPage.Data)
+		e.aead = aead
+	}
 
-		if e.PageSize != options.PageSize {
-			return ErrPageSizeNotUsed
+	size, err := storage.Size()
+	if err != nil {
+		return err
+	}
+
+	e.storage = storage
+	e.readOnly = options.ReadOnly
+	if size == 0 {
+		if e.readOnly {
+			return fmt.Errorf("%w: the file is empty", ErrReadOnly)
 		}
-	} else {
-		e.file, err = os.OpenFile(options.FileName, os.O_RDWR|os.O_CREATE, 0666)
-		if err != nil {
+
+		e.Metadata.PageSize = options.PageSize
+		if e.Metadata.PageSize == 0 {
+			e.Metadata.PageSize = uint32(min(max(os.Getpagesize(), MetadataPageSize), MaxPageSize))
+		}
+
+		// A crash before the first commit leaves an empty DB, not an unreadable file.
+		return e.Sync()
+	}
+
+	if err := e.readMetadata(); err != nil {
+		return err
+	}
+
+	if e.PageSize < MetadataPageSize || e.PageSize > MaxPageSize {
+		return fmt.Errorf("%w: page size %d", ErrCorruptMetadata, e.PageSize)
+	}
+
+	if err := e.readFreelist(); err != nil {
+		return err
+	}
+
+	// A crash interrupted a key rotation after it switched the metadata.
+	if e.RotationPageID != 0 && !e.readOnly {
+		if err := e.finishRotation(); err != nil {
 			return err
 		}
+	}
 
-		e.Metadata.PageSize = options.PageSize
+	if options.PageSize != 0 && e.PageSize != options.PageSize {
+		return ErrPageSizeNotUsed
+	}
+
+	// Pages beyond the last committed page were written after the last
+	// commit, before a crash. Nothing references them.
+	if end := int64(e.MaxPageID+1) * int64(e.PageSize); !e.readOnly && size > end {
+		if err := storage.Truncate(end); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
 func (e *Engine) Close() error {
-	if e.file == nil {
+	if e.storage == nil {
 		return nil
 	}
 
-	metadataPage := e.AllocateEmptyPage(0)
+	var err error
+	if !e.readOnly {
+		err = e.Sync()
+	}
+
+	if closer, ok := e.storage.(stdio.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
 
-	e.Metadata.PageSize = MetadataPageSize
-	e.Metadata.WriteToBuffer(metadataPage.Data)
+	return err
+}
+
+// The metadata page holds two slots of metadataSlotSize bytes:
+//
+// -----------------------------------------
+// | Checksum | Generation | Metadata ...
+// -----------------------------------------
+//
+// A commit writes the slot that isn't current, so a torn write leaves the
+// metadata of the last commit intact. The checksum covers the generation and
+// the metadata. In an encrypted file the slot is sealed like page 0.
+const (
+	metadataSlotSize       = MetadataPageSize / 2
+	metadataSlotHeaderSize = 4 + 8
+)
+
+// Commits the pages written so far. The pages and the free list chain are
+// flushed to stable storage before the metadata that points to them is
+// written to the other slot and flushed as well.
+//
+// Pages the last commit references are never overwritten, so a crash at any
+// point leaves the state of the last commit or of this one.
+func (e *Engine) Sync() error {
+	if err := e.checkWritable(); err != nil {
+		return err
+	}
+
+	// Released pages that don't fit into the metadata page go to a new free list chain.
+	capacity := metadataCapacity(e.metadataDataSize())
+	chain := e.allocateFreelist(capacity)
+	released := append(e.ReleasedPages[:len(e.ReleasedPages):len(e.ReleasedPages)], e.pending...)
+	released = append(released, e.freelistPages...)
+
+	metadata := e.Metadata
+	metadata.ReleasedPages = released[:min(capacity, len(released))]
+	metadata.FreelistPageID = 0
+	if len(chain) > 0 {
+		metadata.FreelistPageID = chain[0]
+	}
+
+	err := e.writeFreelist(chain, released[len(metadata.ReleasedPages):])
+	if err == nil {
+		err = e.storage.Sync()
+	}
 
-	err := e.WritePage(metadataPage)
 	if err != nil {
-		e.file.Close()
+		for _, id := range chain {
+			e.MarkPageAsFree(id)
+		}
+
+		return err
+	}
+
+	if err := e.writeMetadataSlot(metadata, e.generation+1); err != nil {
+		// The metadata may have reached the disk, so the chain is reused only after the next commit.
+		for _, id := range chain {
+			delete(e.fresh, id)
+		}
+		e.pending = append(e.pending, chain...)
+
 		return err
 	}
 
-	return e.file.Close()
+	// The pages of the old chain and the pages freed since the last commit
+	// are free once the new metadata points to the new chain.
+	e.generation++
+	if e.holds > 0 {
+		// The metadata lists the held pages as free, so a crash doesn't lose them.
+		e.ReleasedPages = append(e.ReleasedPages, e.freelistPages...)
+	} else {
+		e.ReleasedPages = released
+		e.pending = nil
+	}
+	e.FreelistPageID = metadata.FreelistPageID
+	e.freelistPages = chain
+	clear(e.fresh)
+	return nil
+}
+
+// Writes the metadata to the slot of the generation and flushes it.
+func (e *Engine) writeMetadataSlot(metadata Metadata, generation uint64) error {
+	data := make([]byte, e.metadataSlotDataSize())
+	binary.LittleEndian.PutUint64(data[4:], generation)
+	if err := metadata.WriteToBuffer(data[metadataSlotHeaderSize:]); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(data, crc32.ChecksumIEEE(data[4:]))
+
+	raw := data
+	if e.aead != nil {
+		raw = make([]byte, metadataSlotSize)
+		if err := sealPage(e.aead, 0, data, raw); err != nil {
+			return fmt.Errorf("%w: %v", ErrWritePage, err)
+		}
+	}
+
+	if _, err := e.storage.WriteAt(raw, int64(generation%2)*metadataSlotSize); err != nil {
+		return fmt.Errorf("%w: %v", ErrWritePage, err)
+	}
+
+	return e.storage.Sync()
+}
+
+// Reads the metadata of the valid slot with the highest generation.
+func (e *Engine) readMetadata() error {
+	raw := make([]byte, MetadataPageSize)
+	if _, err := e.storage.ReadAt(raw, 0); err != nil && err != stdio.EOF {
+		return fmt.Errorf("%w: %v", ErrReadPage, err)
+	}
+
+	// Catch a missing key before trying to read the metadata as plaintext.
+	if e.aead == nil && (isEncryptedMetadataPage(raw) || isEncryptedMetadataPage(raw[metadataSlotSize:])) {
+		return ErrBadKey
+	}
+
+	var slotErr error
+	found := false
+
+	for slot := range 2 {
+		metadata, generation, err := e.readMetadataSlot(raw[slot*metadataSlotSize : (slot+1)*metadataSlotSize])
+		if err != nil {
+			// A slot that doesn't decode under the key, or that has an unsupported
+			// version, is more telling than a torn one.
+			if slotErr == nil || errors.Is(err, ErrBadKey) || errors.Is(err, ErrUnsupportedVersion) {
+				slotErr = err
+			}
+			continue
+		}
+
+		if !found || generation > e.generation {
+			e.Metadata = metadata
+			e.generation = generation
+			found = true
+		}
+	}
+
+	if !found {
+		return slotErr
+	}
+
+	return nil
 }
 
+func (e *Engine) readMetadataSlot(raw []byte) (Metadata, uint64, error) {
+	if isZero(raw) {
+		return Metadata{}, 0, fmt.Errorf("%w: empty slot", ErrCorruptMetadata)
+	}
+
+	data := raw
+	if e.aead != nil {
+		var err error
+		if data, err = openPage(e.aead, 0, raw); err != nil {
+			return Metadata{}, 0, err
+		}
+	}
+
+	// Checked first, so a file of another format isn't reported as corrupt.
+	if err := checkMetadataFormat(data[metadataSlotHeaderSize:]); err != nil {
+		return Metadata{}, 0, err
+	}
+
+	if binary.LittleEndian.Uint32(data) != crc32.ChecksumIEEE(data[4:]) {
+		return Metadata{}, 0, fmt.Errorf("%w: checksum mismatch", ErrCorruptMetadata)
+	}
+
+	metadata := Metadata{}
+	if err := metadata.ReadFromBuffer(data[metadataSlotHeaderSize:]); err != nil {
+		return Metadata{}, 0, err
+	}
+
+	return metadata, binary.LittleEndian.Uint64(data[4:]), nil
+}
+
+func (e *Engine) metadataSlotDataSize() int {
+	if e.aead == nil {
+		return metadataSlotSize
+	}
+
+	return metadataSlotSize - encryptionOverhead(e.aead, 0)
+}
+
+// Returns the number of bytes of a slot the metadata can use.
+func (e *Engine) metadataDataSize() int {
+	return e.metadataSlotDataSize() - metadataSlotHeaderSize
+}
+
+// A page beyond the end of the file was never written and is returned as zeros.
 func (e *Engine) ReadPage(id PageID) (*Page, error) {
 	if err := e.checkRWPage(id); err != nil {
 		return nil, err
 	}
 
-	page := e.AllocateEmptyPage(id)
+	raw, err := e.readRawPage(e.storedPageID(id), int(e.PageSize))
+	if err == errPageNotStored {
+		return &Page{Data: make([]byte, e.pageDataSize(id)), id: id}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	e.counters.pageReads.Add(1)
 
-	offset := int64(id) * int64(e.PageSize)
-	_, err := e.file.ReadAt(page.Data, offset)
+	if e.aead == nil {
+		return &Page{Data: raw, id: id}, nil
+	}
+
+	data, err := openPage(e.aead, id, raw)
 	if err != nil {
-		return nil, fmt.Errorf("%w: %v", ErrReadPage, err)
+		return nil, err
 	}
 
-	return page, nil
+	return &Page{Data: data, id: id}, nil
 }
 
 func (e *Engine) WritePage(page *Page) error {
@@ -101,9 +400,46 @@ func (e *Engine) WritePage(page *Page) error {
 		return err
 	}
 
-	offset := int64(page.id) * int64(e.PageSize)
+	if err := e.checkWritable(); err != nil {
+		return err
+	}
+	e.counters.pageWrites.Add(1)
+
+	if e.aead == nil {
+		return e.writeRawPage(page.id, page.Data)
+	}
+
+	if len(page.Data) != e.pageDataSize(page.id) {
+		return fmt.Errorf("%w: page %d has %d bytes of data", ErrWritePage, page.id, len(page.Data))
+	}
+
+	raw := make([]byte, e.PageSize)
+	if err := sealPage(e.aead, page.id, page.Data, raw); err != nil {
+		return fmt.Errorf("%w: %v", ErrWritePage, err)
+	}
+
+	return e.writeRawPage(page.id, raw)
+}
+
+// Returns errPageNotStored if the page starts at or beyond the end of the file.
+func (e *Engine) readRawPage(id PageID, size int) ([]byte, error) {
+	raw := make([]byte, size)
+
+	offset := int64(id) * int64(e.PageSize)
+	n, err := e.storage.ReadAt(raw, offset)
+	if n == 0 && err == stdio.EOF {
+		return nil, errPageNotStored
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrReadPage, err)
+	}
+
+	return raw, nil
+}
+
+func (e *Engine) writeRawPage(id PageID, raw []byte) error {
+	offset := int64(id) * int64(e.PageSize)
 
-	_, err := e.file.WriteAt(page.Data, offset)
+	_, err := e.storage.WriteAt(raw, offset)
 	if err != nil {
 		return fmt.Errorf("%w: %v", ErrWritePage, err)
 	}
@@ -111,8 +447,29 @@ func (e *Engine) WritePage(page *Page) error {
 	return nil
 }
 
+// Reports if the engine was opened with the ReadOnly option.
+func (e *Engine) ReadOnly() bool {
+	return e.readOnly
+}
+
+func (e *Engine) checkWritable() error {
+	if e.storage == nil {
+		return ErrNilFile
+	}
+
+	if e.readOnly {
+		return ErrReadOnly
+	}
+
+	if e.RotationPageID != 0 {
+		return ErrRotationPending
+	}
+
+	return nil
+}
+
 func (e *Engine) checkRWPage(id PageID) error {
-	if e.file == nil {
+	if e.storage == nil {
 		return ErrNilFile
 	}
 
@@ -124,29 +481,119 @@ func (e *Engine) checkRWPage(id PageID) error {
 }
 
 func (e *Engine) AllocateEmptyPage(id PageID) *Page {
-	return &Page{Data: make([]byte, e.PageSize), id: id}
+	return &Page{Data: make([]byte, e.pageDataSize(id)), id: id}
 }
 
 func (e *Engine) AllocateEmptyPageWithFreeID() *Page {
-	return &Page{Data: make([]byte, e.PageSize), id: e.GetNextFreePageID()}
+	id := e.GetNextFreePageID()
+	return &Page{Data: make([]byte, e.pageDataSize(id)), id: id}
+}
+
+// Returns the number of bytes a data page can hold.
+// This is less than the page size if the file is encrypted.
+func (e *Engine) PageDataSize() int {
+	return e.pageDataSize(1)
+}
+
+func (e *Engine) pageDataSize(id PageID) int {
+	if e.aead == nil {
+		return int(e.PageSize)
+	}
+
+	return int(e.PageSize) - encryptionOverhead(e.aead, id)
 }
 
 func (e *Engine) GetNextFreePageID() PageID {
+	e.counters.allocations.Add(1)
+
+	var pageID PageID
 	if len(e.ReleasedPages) == 0 {
 		e.MaxPageID += 1
-		return e.MaxPageID
+		pageID = e.MaxPageID
+	} else {
+		pageID = e.ReleasedPages[len(e.ReleasedPages)-1]
+		e.ReleasedPages = e.ReleasedPages[:len(e.ReleasedPages)-1]
 	}
 
-	pageID := e.ReleasedPages[len(e.ReleasedPages)-1]
-	e.ReleasedPages = e.ReleasedPages[:len(e.ReleasedPages)-1]
-
+	e.fresh[pageID] = struct{}{}
 	return pageID
 }
 
+// Frees the page. A page the last commit may reference is reused after the next commit.
 func (e *Engine) MarkPageAsFree(id PageID) {
 	if id > e.MaxPageID {
 		return
 	}
 
-	e.ReleasedPages = append(e.ReleasedPages, id)
+	if _, ok := e.fresh[id]; ok {
+		delete(e.fresh, id)
+		e.ReleasedPages = append(e.ReleasedPages, id)
+		return
+	}
+
+	e.pending = append(e.pending, id)
+}
+
+// Reports if the page was allocated since the last commit. The committed
+// state doesn't reference it, so it can be overwritten in place.
+func (e *Engine) IsFresh(id PageID) bool {
+	_, ok := e.fresh[id]
+	return ok
+}
+
+// Reports if pages were allocated or freed since the last commit.
+func (e *Engine) HasChanges() bool {
+	return len(e.fresh) > 0 || len(e.pending) > 0
+}
+
+// Returns the pages freed since the last commit, which are reused after the next commit.
+func (e *Engine) PendingPages() []PageID {
+	return e.pending
+}
+
+// Keeps the pages freed since the last commit, and the ones freed afterwards,
+// from being reused until ReleaseFreedPages is called as often. The pages of
+// the last commit stay as they are, so a reader can read them between commits.
+func (e *Engine) HoldFreedPages() {
+	e.holds++
+}
+
+func (e *Engine) ReleaseFreedPages() {
+	e.holds--
+}
+
+// Sorts the released pages so the lowest ones are reused first. Writes that
+// follow move data towards the start of the file, see Shrink.
+func (e *Engine) SortReleasedPages() {
+	slices.SortFunc(e.ReleasedPages, func(a, b PageID) int { return cmp.Compare(b, a) })
+}
+
+// Commits and cuts released pages off the end of the file.
+func (e *Engine) Shrink() error {
+	if err := e.checkWritable(); err != nil {
+		return err
+	}
+
+	// The commit releases the pages of the old free list chain, which may
+	// be at the end of the file, so it runs twice.
+	for range 2 {
+		released := make(map[PageID]bool, len(e.ReleasedPages))
+		for _, id := range e.ReleasedPages {
+			released[id] = true
+		}
+
+		for e.MaxPageID > 0 && released[e.MaxPageID] {
+			delete(released, e.MaxPageID)
+			e.MaxPageID--
+		}
+
+		e.ReleasedPages = slices.DeleteFunc(e.ReleasedPages, func(id PageID) bool { return id > e.MaxPageID })
+		e.SortReleasedPages()
+
+		if err := e.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return e.storage.Truncate(int64(e.MaxPageID+1) * int64(e.PageSize))
 }
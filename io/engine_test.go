@@ -2,6 +2,7 @@ package io_test
 
 import (
 	"bytes"
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
@@ -116,3 +117,329 @@ func TestFreePage(t *testing.T) {
 		t.Fatal("The Freed Page ID is not used")
 	}
 }
+
+func TestHoldFreedPages(t *testing.T) {
+	e, err := io.NewEngineWithStorage(io.NewMemoryStorage(nil), io.EngineOptions{PageSize: io.MetadataPageSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	id := e.GetNextFreePageID()
+	if err := e.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	e.HoldFreedPages()
+	e.MarkPageAsFree(id)
+	for range 2 {
+		if err := e.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		if next := e.GetNextFreePageID(); next == id {
+			t.Fatal("A held page was reused")
+		}
+	}
+
+	e.ReleaseFreedPages()
+	if err := e.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if next := e.GetNextFreePageID(); next != id {
+		t.Fatalf("Expected page %d to be reused once it's released, got %d", id, next)
+	}
+}
+
+func TestOpenForeignFile(t *testing.T) {
+	data := bytes.Repeat([]byte("not a mellowdb file\n"), io.MetadataPageSize)
+
+	_, err := io.NewEngineWithStorage(io.NewMemoryStorage(data), io.EngineOptions{})
+	if !errors.Is(err, io.ErrUnknownFileFormat) {
+		t.Fatalf("Expected ErrUnknownFileFormat, got %v", err)
+	}
+}
+
+func TestSyncMetadata(t *testing.T) {
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "test.mellow")
+
+	options := io.EngineOptions{
+		PageSize: uint32(os.Getpagesize()),
+		FileName: file,
+	}
+	e, err := io.NewEngine(options)
+	if err != nil {
+		t.Fatalf("io.Engine - open file failed: %v", err)
+	}
+	defer e.Close()
+
+	e.Metadata.MaxPageID = 4
+	if err := e.Sync(); err != nil {
+		t.Fatalf("io.Engine - sync failed: %v", err)
+	}
+
+	if e.PageSize != options.PageSize {
+		t.Fatalf("Expected the page size %d after sync, got %d", options.PageSize, e.PageSize)
+	}
+
+	// Open the bytes of the file without closing the first engine.
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e2, err := io.NewEngineWithStorage(io.NewMemoryStorage(data), options)
+	if err != nil {
+		t.Fatalf("io.Engine - open file failed: %v", err)
+	}
+	defer e2.Close()
+
+	if e2.MaxPageID != 4 {
+		t.Fatalf("Expected MaxPageID 4 after sync, got %d", e2.MaxPageID)
+	}
+}
+
+func TestEngineStats(t *testing.T) {
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "test.mellow")
+
+	options := io.EngineOptions{
+		PageSize: uint32(os.Getpagesize()),
+		FileName: file,
+	}
+	e, err := io.NewEngine(options)
+	if err != nil {
+		t.Fatalf("io.Engine - open file failed: %v", err)
+	}
+	defer e.Close()
+
+	page := e.AllocateEmptyPageWithFreeID()
+	if err := e.WritePage(page); err != nil {
+		t.Fatalf("Failed to write page: %v", err)
+	}
+
+	if _, err := e.ReadPage(page.GetID()); err != nil {
+		t.Fatalf("Failed to read page: %v", err)
+	}
+
+	e.MarkPageAsFree(page.GetID())
+
+	stats, err := e.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := io.EngineStats{
+		PageReads:   1,
+		PageWrites:  1,
+		Allocations: 1,
+		FreePages:   1,
+		FileSize:    2 * int64(options.PageSize),
+	}
+
+	if stats != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestPageSizeIsStored(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	if _, err := io.NewEngine(io.EngineOptions{PageSize: 1024, FileName: file}); !errors.Is(err, io.ErrInvalidPageSize) {
+		t.Fatalf("Expected ErrInvalidPageSize, got %v", err)
+	}
+
+	e, err := io.NewEngine(io.EngineOptions{PageSize: 16384, FileName: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page := e.AllocateEmptyPageWithFreeID()
+	copy(page.Data, "large page")
+	if err := e.WritePage(page); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Zero takes the page size of the file.
+	e, err = io.NewEngine(io.EngineOptions{FileName: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.PageSize != 16384 {
+		t.Fatalf("Expected the stored page size 16384, got %d", e.PageSize)
+	}
+
+	read, err := e.ReadPage(page.GetID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(read.Data, page.Data) {
+		t.Fatal("The read data is different from the written data.")
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.NewEngine(io.EngineOptions{PageSize: 8192, FileName: file}); !errors.Is(err, io.ErrPageSizeNotUsed) {
+		t.Fatalf("Expected ErrPageSizeNotUsed, got %v", err)
+	}
+}
+
+func TestReadOnlyEngine(t *testing.T) {
+	options := io.EngineOptions{PageSize: io.MetadataPageSize, ReadOnly: true}
+
+	if _, err := io.NewEngineWithStorage(io.NewMemoryStorage(nil), options); !errors.Is(err, io.ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly for empty storage, got %v", err)
+	}
+
+	storage := io.NewMemoryStorage(nil)
+	e, err := io.NewEngineWithStorage(storage, io.EngineOptions{PageSize: io.MetadataPageSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page := e.AllocateEmptyPageWithFreeID()
+	if err := e.WritePage(page); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	before := bytes.Clone(storage.Bytes())
+
+	e, err = io.NewEngineWithStorage(storage, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.WritePage(page); !errors.Is(err, io.ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly from WritePage, got %v", err)
+	}
+
+	if err := e.Sync(); !errors.Is(err, io.ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly from Sync, got %v", err)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(before, storage.Bytes()) {
+		t.Fatal("Read-only engine changed the storage")
+	}
+}
+
+func TestFreelistOverflow(t *testing.T) {
+	storage := io.NewMemoryStorage(nil)
+	options := io.EngineOptions{PageSize: io.MetadataPageSize}
+
+	e, err := io.NewEngineWithStorage(storage, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 3000 {
+		e.GetNextFreePageID()
+	}
+
+	released := map[io.PageID]bool{}
+	for id := io.PageID(1); id <= 3000; id += 2 {
+		e.MarkPageAsFree(id)
+		released[id] = true
+	}
+
+	// The second write releases the pages of the first chain.
+	for range 2 {
+		if err := e.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	chain := e.FreelistPages()
+	if len(chain) == 0 {
+		t.Fatal("Expected the released pages to overflow into free list pages")
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err = io.NewEngineWithStorage(storage, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	// Close wrote a new chain.
+	chain = e.FreelistPages()
+	if len(chain) == 0 {
+		t.Fatal("Expected the reopened engine to read the free list pages")
+	}
+
+	reopened := map[io.PageID]bool{}
+	for _, id := range e.ReleasedPages {
+		if reopened[id] {
+			t.Fatalf("Page %d is released twice", id)
+		}
+		reopened[id] = true
+	}
+
+	for _, id := range chain {
+		if reopened[id] {
+			t.Fatalf("Free list page %d is also released", id)
+		}
+		reopened[id] = true
+	}
+
+	if len(reopened) != len(released) {
+		t.Fatalf("Expected %d free pages, got %d", len(released), len(reopened))
+	}
+
+	for id := range released {
+		if !reopened[id] {
+			t.Fatalf("Released page %d is missing after reopening", id)
+		}
+	}
+}
+
+func TestCorruptMetadataSlotKeepsLastCommit(t *testing.T) {
+	storage := io.NewMemoryStorage(nil)
+	options := io.EngineOptions{PageSize: io.MetadataPageSize}
+
+	e, err := io.NewEngineWithStorage(storage, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Creating the engine committed to the second slot, these commits go to the first and the second.
+	for _, maxPageID := range []io.PageID{4, 9} {
+		e.MaxPageID = maxPageID
+		if err := e.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := bytes.Clone(storage.Bytes())
+	data[io.MetadataPageSize/2+20] ^= 0xff
+
+	e, err = io.NewEngineWithStorage(io.NewMemoryStorage(data), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	if e.MaxPageID != 4 {
+		t.Fatalf("Expected the commit before the corrupt one with MaxPageID 4, got %d", e.MaxPageID)
+	}
+}
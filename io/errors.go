@@ -1,12 +1,34 @@
 package io
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrPageSizeNotUsed = errors.New("Requeted page size can't be used")
+	ErrInvalidPageSize = errors.New(fmt.Sprintf("Page size must be between %d and %d bytes", MetadataPageSize, MaxPageSize))
 
 	ErrReadPage      = errors.New("Unable to read page")
 	ErrWritePage     = errors.New("Unable to write page")
 	ErrInvalidPageID = errors.New("Invalid PageID")
 	ErrNilFile       = errors.New("DB File is nil")
+
+	ErrReadOnly = errors.New("DB is opened read-only")
+	ErrLocked   = errors.New("DB File is locked by another process")
+
+	ErrCorruptMetadata    = errors.New("Metadata page is corrupt")
+	ErrMetadataTooLarge   = errors.New("Metadata doesn't fit into the metadata page")
+	ErrUnknownFileFormat  = errors.New("DB File is not a mellowdb file")
+	ErrUnsupportedVersion = errors.New("DB File has an unsupported format version")
+
+	ErrBadKey         = errors.New("Encryption key doesn't match the DB file")
+	ErrInvalidKeySize = errors.New("Encryption key must be 32 bytes")
+	ErrNotEncrypted   = errors.New("DB File is not encrypted")
+	// A key rotation failed after it switched to the new key. Reopening the
+	// file with the new key finishes it.
+	ErrRotationPending = errors.New("Key rotation didn't finish, reopen the DB File")
+
+	// A page that starts beyond the end of the file, it was never written.
+	errPageNotStored = errors.New("Page is not stored")
 )
@@ -0,0 +1,268 @@
+// Package faultstorage wraps an io.Storage with faults that happen on a
+// deterministic schedule, to test how a DB copes with a misbehaving disk.
+//
+// Writes count from one. A scheduled fault happens on the nth write after it
+// was scheduled. A crash cuts off all I/O until Restart; writes that weren't
+// synced before the crash are undone if DropUnsynced is set. The half of a
+// torn write is never undone, it's what reached the disk when the power went out.
+package faultstorage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/rettenwander/mellowdb/io"
+)
+
+var (
+	// Returned by writes that fail on purpose.
+	ErrInjected = errors.New("Injected write failure")
+	// Returned by all I/O after a crash.
+	ErrCrashed = errors.New("Storage crashed")
+)
+
+type Fault int
+
+const (
+	// The write returns ErrInjected and writes nothing.
+	FailWrite Fault = iota + 1
+	// The first half of the write reaches the storage, then the storage crashes.
+	TearWrite
+	// The write returns ENOSPC and writes nothing.
+	NoSpace
+	// The storage crashes before the write.
+	Crash
+)
+
+func (f Fault) String() string {
+	switch f {
+	case FailWrite:
+		return "fail write"
+	case TearWrite:
+		return "tear write"
+	case NoSpace:
+		return "no space"
+	case Crash:
+		return "crash"
+	}
+
+	return fmt.Sprintf("Fault(%d)", int(f))
+}
+
+// Restores a range overwritten since the last sync.
+type undo struct {
+	offset int64
+	data   []byte
+}
+
+type Storage struct {
+	// Undo the writes since the last sync when the storage crashes.
+	DropUnsynced bool
+
+	mu      sync.Mutex
+	storage io.Storage
+	crashed bool
+
+	writes   int
+	schedule map[int]Fault
+
+	undo       []undo
+	syncedSize int64
+}
+
+// Wraps storage, which holds the state that was synced so far.
+func New(storage io.Storage) (*Storage, error) {
+	size, err := storage.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Storage{storage: storage, schedule: make(map[int]Fault), syncedSize: size}, nil
+}
+
+// Makes the nth write from now fail with the fault.
+func (s *Storage) Schedule(n int, fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.schedule[s.writes+n] = fault
+}
+
+// Drops all scheduled faults.
+func (s *Storage) ClearSchedule() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clear(s.schedule)
+}
+
+// Cuts off all later I/O until Restart.
+func (s *Storage) Crash() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.crash()
+}
+
+func (s *Storage) crash() error {
+	if s.crashed {
+		return nil
+	}
+	s.crashed = true
+	clear(s.schedule)
+
+	if !s.DropUnsynced {
+		s.undo = nil
+		return nil
+	}
+
+	for i := len(s.undo) - 1; i >= 0; i-- {
+		if _, err := s.storage.WriteAt(s.undo[i].data, s.undo[i].offset); err != nil {
+			return err
+		}
+	}
+	s.undo = nil
+
+	return s.storage.Truncate(s.syncedSize)
+}
+
+// Lets I/O through again after a crash, like a machine that rebooted.
+func (s *Storage) Restart() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	size, err := s.storage.Size()
+	if err != nil {
+		return err
+	}
+
+	s.crashed = false
+	s.syncedSize = size
+	return nil
+}
+
+// Reports if the storage crashed and wasn't restarted.
+func (s *Storage) Crashed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.crashed
+}
+
+// Number of writes so far, including failed ones.
+func (s *Storage) Writes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.writes
+}
+
+func (s *Storage) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.crashed {
+		return 0, ErrCrashed
+	}
+
+	return s.storage.ReadAt(p, off)
+}
+
+func (s *Storage) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.crashed {
+		return 0, ErrCrashed
+	}
+
+	s.writes++
+	fault := s.schedule[s.writes]
+	delete(s.schedule, s.writes)
+
+	switch fault {
+	case FailWrite:
+		return 0, ErrInjected
+	case NoSpace:
+		return 0, syscall.ENOSPC
+	case Crash:
+		return 0, errors.Join(ErrCrashed, s.crash())
+	case TearWrite:
+		if err := s.crash(); err != nil {
+			return 0, errors.Join(ErrCrashed, err)
+		}
+
+		n, err := s.storage.WriteAt(p[:len(p)/2], off)
+		return n, errors.Join(ErrCrashed, err)
+	}
+
+	return s.write(p, off)
+}
+
+// Writes and remembers what was overwritten.
+func (s *Storage) write(p []byte, off int64) (int, error) {
+	if s.DropUnsynced {
+		old := make([]byte, len(p))
+		n, _ := s.storage.ReadAt(old, off)
+		s.undo = append(s.undo, undo{offset: off, data: old[:n]})
+	}
+
+	return s.storage.WriteAt(p, off)
+}
+
+func (s *Storage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.crashed {
+		return ErrCrashed
+	}
+
+	current, err := s.storage.Size()
+	if err != nil {
+		return err
+	}
+
+	if s.DropUnsynced && size < current {
+		old := make([]byte, current-size)
+		n, _ := s.storage.ReadAt(old, size)
+		s.undo = append(s.undo, undo{offset: size, data: old[:n]})
+	}
+
+	return s.storage.Truncate(size)
+}
+
+func (s *Storage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.crashed {
+		return ErrCrashed
+	}
+
+	if err := s.storage.Sync(); err != nil {
+		return err
+	}
+
+	size, err := s.storage.Size()
+	if err != nil {
+		return err
+	}
+
+	s.undo = nil
+	s.syncedSize = size
+	return nil
+}
+
+func (s *Storage) Size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.crashed {
+		return 0, ErrCrashed
+	}
+
+	return s.storage.Size()
+}
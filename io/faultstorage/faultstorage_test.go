@@ -0,0 +1,92 @@
+package faultstorage_test
+
+import (
+	"bytes"
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/io"
+	"github.com/rettenwander/mellowdb/io/faultstorage"
+)
+
+func TestFaults(t *testing.T) {
+	s, err := faultstorage.New(io.NewMemoryStorage(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.DropUnsynced = true
+
+	if _, err := s.WriteAt([]byte("synced"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Schedule(1, faultstorage.FailWrite)
+	s.Schedule(2, faultstorage.NoSpace)
+	s.Schedule(4, faultstorage.TearWrite)
+
+	if _, err := s.WriteAt([]byte("x"), 0); !errors.Is(err, faultstorage.ErrInjected) {
+		t.Fatalf("Expected ErrInjected, got %v", err)
+	}
+
+	if _, err := s.WriteAt([]byte("x"), 0); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("Expected ENOSPC, got %v", err)
+	}
+
+	if _, err := s.WriteAt([]byte("SYNCED"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.WriteAt([]byte("unsynced"), 6); !errors.Is(err, faultstorage.ErrCrashed) {
+		t.Fatalf("Expected ErrCrashed, got %v", err)
+	}
+
+	if _, err := s.ReadAt(make([]byte, 1), 0); !errors.Is(err, faultstorage.ErrCrashed) {
+		t.Fatalf("Expected ErrCrashed after the torn write, got %v", err)
+	}
+
+	if err := s.Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The unsynced write was undone, but the torn half reached the storage.
+	size, err := s.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, size)
+	if _, err := s.ReadAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, []byte("syncedunsy")) {
+		t.Fatalf("Expected the synced data and the torn half, got %q", data)
+	}
+}
+
+func TestCrashKeepsUnsyncedWrites(t *testing.T) {
+	memory := io.NewMemoryStorage(nil)
+	s, err := faultstorage.New(memory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Schedule(2, faultstorage.TearWrite)
+
+	if _, err := s.WriteAt([]byte("first"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.WriteAt([]byte("second"), 5); !errors.Is(err, faultstorage.ErrCrashed) {
+		t.Fatalf("Expected ErrCrashed, got %v", err)
+	}
+
+	// Without DropUnsynced the torn write stays half written.
+	if !bytes.Equal(memory.Bytes(), []byte("firstsec")) {
+		t.Fatalf("Unexpected data %q", memory.Bytes())
+	}
+}
@@ -0,0 +1,100 @@
+package io
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Released pages that don't fit into the metadata page are kept in a chain of
+// free list pages:
+//
+// -----------------------------------------
+// | Next PageID | Count | PageID | PageID ...
+// -----------------------------------------
+//
+// The pages of the chain are taken from the released pages on every commit,
+// and are released again by the next commit.
+const freelistHeaderSize = PageIDSize + 4
+
+// Returns the pages holding the released pages that don't fit into the metadata page.
+func (e *Engine) FreelistPages() []PageID {
+	return e.freelistPages
+}
+
+func (e *Engine) freelistPageCapacity() int {
+	return (e.PageDataSize() - freelistHeaderSize) / PageIDSize
+}
+
+// Takes pages for a chain that holds all released pages beyond the first capacity.
+// The pending pages and the pages of the current chain are counted as
+// released, but not reused, because the metadata on disk still points to them.
+func (e *Engine) allocateFreelist(capacity int) []PageID {
+	chain := []PageID{}
+	for len(e.ReleasedPages)+len(e.pending)+len(e.freelistPages) > capacity+len(chain)*e.freelistPageCapacity() {
+		chain = append(chain, e.GetNextFreePageID())
+	}
+
+	return chain
+}
+
+// Writes ids to the pages of the chain.
+func (e *Engine) writeFreelist(chain []PageID, ids []PageID) error {
+	perPage := e.freelistPageCapacity()
+
+	for i, id := range chain {
+		page := e.AllocateEmptyPage(id)
+
+		next := PageID(0)
+		if i+1 < len(chain) {
+			next = chain[i+1]
+		}
+
+		part := ids[min(i*perPage, len(ids)):min((i+1)*perPage, len(ids))]
+
+		binary.LittleEndian.PutUint64(page.Data, uint64(next))
+		binary.LittleEndian.PutUint32(page.Data[PageIDSize:], uint32(len(part)))
+		for j, released := range part {
+			binary.LittleEndian.PutUint64(page.Data[freelistHeaderSize+j*PageIDSize:], uint64(released))
+		}
+
+		if err := e.WritePage(page); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Appends the released pages of the chain starting at FreelistPageID.
+func (e *Engine) readFreelist() error {
+	perPage := e.freelistPageCapacity()
+	seen := map[PageID]bool{}
+
+	for id := e.FreelistPageID; id != 0; {
+		if id < 0 || id > e.MaxPageID || seen[id] {
+			return fmt.Errorf("%w: invalid free list page %d", ErrCorruptMetadata, id)
+		}
+		seen[id] = true
+
+		page, err := e.ReadPage(id)
+		if err != nil {
+			return err
+		}
+
+		next := PageID(binary.LittleEndian.Uint64(page.Data))
+		count := int(binary.LittleEndian.Uint32(page.Data[PageIDSize:]))
+		if count > perPage {
+			return fmt.Errorf("%w: free list page %d holds %d pages", ErrCorruptMetadata, id, count)
+		}
+
+		for j := range count {
+			released := PageID(binary.LittleEndian.Uint64(page.Data[freelistHeaderSize+j*PageIDSize:]))
+			e.ReleasedPages = append(e.ReleasedPages, released)
+		}
+
+		e.freelistPages = append(e.freelistPages, id)
+		id = next
+	}
+
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package io
+
+import "os"
+
+// Files aren't locked on this platform.
+func lockFile(file *os.File, readOnly bool) error {
+	return nil
+}
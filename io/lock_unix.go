@@ -0,0 +1,25 @@
+//go:build unix
+
+package io
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Takes a shared lock for readers and an exclusive one for writers. The lock
+// is released when the file is closed.
+func lockFile(file *os.File, readOnly bool) error {
+	how := syscall.LOCK_EX
+	if readOnly {
+		how = syscall.LOCK_SH
+	}
+
+	err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrLocked
+	}
+
+	return err
+}
@@ -2,6 +2,7 @@ package io
 
 import (
 	"encoding/binary"
+	"fmt"
 )
 
 type Metadata struct {
@@ -9,14 +10,58 @@ type Metadata struct {
 	MaxPageID PageID
 
 	ReleasedPages []PageID
+
+	// Page of the root of the DB's catalog. Zero if there is none yet.
+	RootPageID PageID
+
+	// Number of commits made to the DB.
+	CommitSequence uint64
+
+	// Size limits of keys and values recorded by the DB. Zero if none were recorded.
+	MaxKeySize   uint32
+	MaxValueSize uint32
+
+	// First overflow page of the released pages that don't fit into the metadata page.
+	// Zero if there is none.
+	FreelistPageID PageID
+
+	// Set while a key rotation copies the pages back, see Engine.RotateKey.
+	// Page id is stored at RotationPageID + id until then. Zero otherwise.
+	RotationPageID PageID
+}
+
+// The metadata starts with the magic and the version of its layout. A file
+// with another magic isn't a mellowdb file, a newer version can't be read.
+const (
+	metadataMagic   = "MLDB"
+	metadataVersion = 1
+)
+
+// Size of the metadata without the released pages: magic, version, page size,
+// max page ID, released pages count, root page ID, commit sequence, size
+// limits, the first free list page and the page of the rotated copies.
+const metadataFixedSize = 4 + 4 + 4 + PageIDSize + 4 + PageIDSize + 8 + 4 + 4 + PageIDSize + PageIDSize
+
+// Returns how many released pages fit into a metadata buffer of size bytes.
+func metadataCapacity(size int) int {
+	return max(size-metadataFixedSize, 0) / PageIDSize
 }
 
 func NewMetadata() *Metadata {
 	return &Metadata{ReleasedPages: make([]PageID, 0), PageSize: MetadataPageSize}
 }
 
-func (m *Metadata) WriteToBuffer(buff []byte) {
-	pos := 0
+// Encodes the metadata. Returns ErrMetadataTooLarge if the released pages don't
+// fit into the buffer, see metadataCapacity.
+func (m *Metadata) WriteToBuffer(buff []byte) error {
+	if len(m.ReleasedPages) > metadataCapacity(len(buff)) {
+		return fmt.Errorf("%w: %d released pages in %d bytes", ErrMetadataTooLarge, len(m.ReleasedPages), len(buff))
+	}
+
+	pos := copy(buff, metadataMagic)
+
+	binary.LittleEndian.PutUint32(buff[pos:], metadataVersion)
+	pos += 4
 
 	binary.LittleEndian.PutUint32(buff[pos:], uint32(m.PageSize))
 	pos += 4
@@ -24,7 +69,7 @@ func (m *Metadata) WriteToBuffer(buff []byte) {
 	binary.LittleEndian.PutUint64(buff[pos:], uint64(m.MaxPageID))
 	pos += PageIDSize
 
-	binary.LittleEndian.PutUint16(buff[pos:], uint16(len(m.ReleasedPages)))
+	binary.LittleEndian.PutUint32(buff[pos:], uint32(len(m.ReleasedPages)))
 	pos += 4
 
 	for _, id := range m.ReleasedPages {
@@ -32,24 +77,95 @@ func (m *Metadata) WriteToBuffer(buff []byte) {
 		pos += PageIDSize
 	}
 
+	binary.LittleEndian.PutUint64(buff[pos:], uint64(m.RootPageID))
+	pos += PageIDSize
+
+	binary.LittleEndian.PutUint64(buff[pos:], m.CommitSequence)
+	pos += 8
+
+	binary.LittleEndian.PutUint32(buff[pos:], m.MaxKeySize)
+	pos += 4
+
+	binary.LittleEndian.PutUint32(buff[pos:], m.MaxValueSize)
+	pos += 4
+
+	binary.LittleEndian.PutUint64(buff[pos:], uint64(m.FreelistPageID))
+	pos += PageIDSize
+
+	binary.LittleEndian.PutUint64(buff[pos:], uint64(m.RotationPageID))
+	pos += PageIDSize
+
+	return nil
 }
 
-func (m *Metadata) ReadFromBuffer(buff []byte) {
-	pos := 0
+// Decodes the metadata. The counts are checked against the buffer, a corrupt
+// page returns ErrCorruptMetadata. Another magic returns ErrUnknownFileFormat
+// and a newer version ErrUnsupportedVersion.
+func (m *Metadata) ReadFromBuffer(buff []byte) error {
+	if err := checkMetadataFormat(buff); err != nil {
+		return err
+	}
+
+	if len(buff) < metadataFixedSize {
+		return fmt.Errorf("%w: page has %d bytes", ErrCorruptMetadata, len(buff))
+	}
+
+	pos := len(metadataMagic) + 4
 
-	m.PageSize = uint32(binary.LittleEndian.Uint32(buff[pos:]))
+	pageSize := uint32(binary.LittleEndian.Uint32(buff[pos:]))
 	pos += 4
 
-	m.MaxPageID = int64(binary.LittleEndian.Uint64(buff[pos:]))
+	maxPageID := int64(binary.LittleEndian.Uint64(buff[pos:]))
 	pos += PageIDSize
 
-	releasedPagesLen := uint32(binary.LittleEndian.Uint32(buff[pos:]))
+	releasedPagesLen := int(binary.LittleEndian.Uint32(buff[pos:]))
 	pos += 4
 
-	m.ReleasedPages = make([]int64, releasedPagesLen)
+	if releasedPagesLen > metadataCapacity(len(buff)) {
+		return fmt.Errorf("%w: %d released pages don't fit into the page", ErrCorruptMetadata, releasedPagesLen)
+	}
+
+	releasedPages := make([]int64, releasedPagesLen)
 
-	for i := uint32(0); i < releasedPagesLen; i++ {
-		m.ReleasedPages[i] = int64(binary.LittleEndian.Uint64(buff[pos:]))
+	for i := 0; i < releasedPagesLen; i++ {
+		releasedPages[i] = int64(binary.LittleEndian.Uint64(buff[pos:]))
 		pos += PageIDSize
 	}
+
+	m.PageSize = pageSize
+	m.MaxPageID = maxPageID
+	m.ReleasedPages = releasedPages
+
+	m.RootPageID = int64(binary.LittleEndian.Uint64(buff[pos:]))
+	pos += PageIDSize
+
+	m.CommitSequence = binary.LittleEndian.Uint64(buff[pos:])
+	pos += 8
+
+	m.MaxKeySize = binary.LittleEndian.Uint32(buff[pos:])
+	pos += 4
+
+	m.MaxValueSize = binary.LittleEndian.Uint32(buff[pos:])
+	pos += 4
+
+	m.FreelistPageID = int64(binary.LittleEndian.Uint64(buff[pos:]))
+	pos += PageIDSize
+
+	m.RotationPageID = int64(binary.LittleEndian.Uint64(buff[pos:]))
+	pos += PageIDSize
+
+	return nil
+}
+
+// Checks the magic and the version at the start of the metadata.
+func checkMetadataFormat(buff []byte) error {
+	if len(buff) < len(metadataMagic)+4 || string(buff[:len(metadataMagic)]) != metadataMagic {
+		return ErrUnknownFileFormat
+	}
+
+	if version := binary.LittleEndian.Uint32(buff[len(metadataMagic):]); version != metadataVersion {
+		return fmt.Errorf("%w: version %d, this build reads version %d", ErrUnsupportedVersion, version, metadataVersion)
+	}
+
+	return nil
 }
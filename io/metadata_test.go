@@ -1,6 +1,7 @@
 package io_test
 
 import (
+	"errors"
 	"reflect"
 	"testing"
 
@@ -15,12 +16,73 @@ func TestMetatadaRW(t *testing.T) {
 	metadataW.PageSize = 10
 	metadataW.MaxPageID = 1
 	metadataW.ReleasedPages = []io.PageID{1, 4, 7}
-	metadataW.WriteToBuffer(data)
+	metadataW.RootPageID = 3
+	metadataW.CommitSequence = 42
+	metadataW.MaxKeySize = 64
+	metadataW.MaxValueSize = 100
+	metadataW.FreelistPageID = 9
+	if err := metadataW.WriteToBuffer(data); err != nil {
+		t.Fatal(err)
+	}
 
 	metadataR := io.NewMetadata()
-	metadataR.ReadFromBuffer(data)
+	if err := metadataR.ReadFromBuffer(data); err != nil {
+		t.Fatal(err)
+	}
 
 	if !reflect.DeepEqual(metadataW, metadataR) {
 		t.Fatalf("Metadata not equal")
 	}
 }
+
+func TestMetadataTooLarge(t *testing.T) {
+	metadata := io.NewMetadata()
+	for id := range io.PageID(600) {
+		metadata.ReleasedPages = append(metadata.ReleasedPages, id+1)
+	}
+
+	if err := metadata.WriteToBuffer(make([]byte, io.MetadataPageSize)); !errors.Is(err, io.ErrMetadataTooLarge) {
+		t.Fatalf("Expected ErrMetadataTooLarge, got %v", err)
+	}
+}
+
+func TestMetadataFormat(t *testing.T) {
+	data := make([]byte, 400)
+	if err := io.NewMetadata().WriteToBuffer(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data[:4]) != "MLDB" {
+		t.Fatalf("Expected the metadata to start with the magic, got %q", data[:4])
+	}
+
+	if err := io.NewMetadata().ReadFromBuffer([]byte("SQLite format 3\x00")); !errors.Is(err, io.ErrUnknownFileFormat) {
+		t.Fatalf("Expected ErrUnknownFileFormat, got %v", err)
+	}
+
+	// A version written by a later build.
+	data[4]++
+	if err := io.NewMetadata().ReadFromBuffer(data); !errors.Is(err, io.ErrUnsupportedVersion) {
+		t.Fatalf("Expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+func FuzzMetadataReadFromBuffer(f *testing.F) {
+	data := make([]byte, 128)
+
+	metadata := io.NewMetadata()
+	metadata.ReleasedPages = []io.PageID{2, 3}
+	metadata.WriteToBuffer(data)
+
+	f.Add(data)
+	f.Add([]byte{})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		metadata := io.NewMetadata()
+		err := metadata.ReadFromBuffer(data)
+		if err != nil && !errors.Is(err, io.ErrCorruptMetadata) && !errors.Is(err, io.ErrUnknownFileFormat) && !errors.Is(err, io.ErrUnsupportedVersion) {
+			t.Fatalf("Expected ErrCorruptMetadata, ErrUnknownFileFormat or ErrUnsupportedVersion, got %v", err)
+		}
+	})
+}
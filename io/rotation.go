@@ -0,0 +1,162 @@
+package io
+
+import "fmt"
+
+// Re-encrypts every page with newKey. The pending writes are committed first.
+//
+// The pages are re-encrypted into copies after the last page, so the file stays
+// readable with the old key until the copies are synced. Then the metadata
+// switches to the new key and points to the copies, and they are copied back
+// over the pages. A crash before the switch leaves the file with the old key,
+// after it the file opens with the new key and the copies are copied back when
+// it's opened writable. No page is overwritten while it holds the only copy
+// of its data, so torn writes lose nothing.
+//
+// If the rotation fails after the switch, the engine only reads until the file
+// is reopened, see ErrRotationPending.
+func (e *Engine) RotateKey(newKey []byte) error {
+	if err := e.checkWritable(); err != nil {
+		return err
+	}
+
+	if e.aead == nil {
+		return ErrNotEncrypted
+	}
+
+	newAEAD, err := newPageCipher(newKey)
+	if err != nil {
+		return err
+	}
+
+	if err := e.Sync(); err != nil {
+		return err
+	}
+
+	storageSize, err := e.storage.Size()
+	if err != nil {
+		return err
+	}
+
+	// Nothing is allocated until the rotation is done, so the copies stay after the last page.
+	copies := e.MaxPageID + 1
+
+	for id := PageID(1); id <= e.MaxPageID; id++ {
+		// The page was allocated but never written.
+		if int64(id+1)*int64(e.PageSize) > storageSize {
+			continue
+		}
+
+		raw, err := e.readRawPage(id, int(e.PageSize))
+		if err != nil {
+			return err
+		}
+
+		// A page that was never written, before one that was, stays a hole.
+		if isZero(raw) {
+			continue
+		}
+
+		data, err := openPage(e.aead, id, raw)
+		if err != nil {
+			return err
+		}
+
+		// The copy is sealed for the page it's copied back to.
+		if err := sealPage(newAEAD, id, data, raw); err != nil {
+			return fmt.Errorf("%w: %v", ErrWritePage, err)
+		}
+
+		if err := e.writeRawPage(copies+id, raw); err != nil {
+			return err
+		}
+	}
+
+	if err := e.storage.Sync(); err != nil {
+		return fmt.Errorf("%w: %v", ErrWritePage, err)
+	}
+
+	// From here on the metadata may point to the copies, so reads go to them.
+	metadata := e.committedMetadata()
+	metadata.RotationPageID = copies
+	e.aead = newAEAD
+	e.RotationPageID = copies
+
+	if err := e.writeMetadataSlot(metadata, e.generation+1); err != nil {
+		return err
+	}
+	e.generation++
+
+	return e.finishRotation()
+}
+
+// Copies the rotated pages back and commits the metadata without them.
+func (e *Engine) finishRotation() error {
+	// The other slot may still hold the metadata of the old key, which would
+	// open the file while the copies overwrite the pages.
+	if _, err := e.storage.WriteAt(make([]byte, metadataSlotSize), int64((e.generation+1)%2)*metadataSlotSize); err != nil {
+		return fmt.Errorf("%w: %v", ErrWritePage, err)
+	}
+
+	if err := e.storage.Sync(); err != nil {
+		return fmt.Errorf("%w: %v", ErrWritePage, err)
+	}
+
+	for id := PageID(1); id < e.RotationPageID; id++ {
+		raw, err := e.readRawPage(e.RotationPageID+id, int(e.PageSize))
+		if err == errPageNotStored {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if isZero(raw) {
+			continue
+		}
+
+		if err := e.writeRawPage(id, raw); err != nil {
+			return err
+		}
+	}
+
+	if err := e.storage.Sync(); err != nil {
+		return fmt.Errorf("%w: %v", ErrWritePage, err)
+	}
+
+	metadata := e.committedMetadata()
+	metadata.RotationPageID = 0
+	if err := e.writeMetadataSlot(metadata, e.generation+1); err != nil {
+		return err
+	}
+	e.generation++
+	e.RotationPageID = 0
+
+	size, err := e.storage.Size()
+	if err != nil {
+		return err
+	}
+
+	if end := int64(e.MaxPageID+1) * int64(e.PageSize); size > end {
+		return e.storage.Truncate(end)
+	}
+
+	return nil
+}
+
+// Returns the metadata as the last commit wrote it. Only valid while nothing
+// changed since the commit.
+func (e *Engine) committedMetadata() Metadata {
+	metadata := e.Metadata
+	capacity := metadataCapacity(e.metadataDataSize())
+	metadata.ReleasedPages = e.ReleasedPages[:min(capacity, len(e.ReleasedPages))]
+	return metadata
+}
+
+// Returns the page that holds the page id. That's the copy while a key rotation
+// copies the pages back.
+func (e *Engine) storedPageID(id PageID) PageID {
+	if e.RotationPageID != 0 && id > 0 && id < e.RotationPageID {
+		return e.RotationPageID + id
+	}
+
+	return id
+}
@@ -0,0 +1,164 @@
+package io_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/io"
+	"github.com/rettenwander/mellowdb/io/faultstorage"
+)
+
+// Crashes the storage at every write of a key rotation. The file has to open
+// with the old or the new key afterwards and hold all pages.
+func TestRotateKeyCrash(t *testing.T) {
+	for _, dropUnsynced := range []bool{false, true} {
+		for _, fault := range []faultstorage.Fault{faultstorage.Crash, faultstorage.TearWrite} {
+			t.Run(fmt.Sprintf("DropUnsynced=%v/%v", dropUnsynced, fault), func(t *testing.T) {
+				for n := 1; ; n++ {
+					if !rotateWithFault(t, n, fault, dropUnsynced) {
+						return
+					}
+				}
+			})
+		}
+	}
+}
+
+// Returns false once the rotation needs less than n writes.
+func rotateWithFault(t *testing.T, n int, fault faultstorage.Fault, dropUnsynced bool) bool {
+	storage, err := faultstorage.New(io.NewMemoryStorage(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.DropUnsynced = dropUnsynced
+
+	options := io.EngineOptions{PageSize: io.MetadataPageSize, EncryptionKey: testKey(1)}
+	e, err := io.NewEngineWithStorage(storage, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages := make([]*io.Page, 20)
+	for i := range pages {
+		pages[i] = e.AllocateEmptyPageWithFreeID()
+		copy(pages[i].Data, bytes.Repeat([]byte{byte(i + 1)}, 64))
+
+		if err := e.WritePage(pages[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := e.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	storage.Schedule(n, fault)
+	rotateErr := e.RotateKey(testKey(2))
+	if !storage.Crashed() {
+		if rotateErr != nil {
+			t.Fatalf("Write %d: rotation failed without a crash: %v", n, rotateErr)
+		}
+
+		verifyRotatedPages(t, fmt.Sprintf("write %d", n), e, pages)
+		return false
+	}
+
+	if err := storage.Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file switches to the new key at once, so exactly one of the keys opens it.
+	options.EncryptionKey = testKey(2)
+	e, err = io.NewEngineWithStorage(storage, options)
+	if errors.Is(err, io.ErrBadKey) {
+		options.EncryptionKey = testKey(1)
+		e, err = io.NewEngineWithStorage(storage, options)
+	}
+	if err != nil {
+		t.Fatalf("Write %d: failed to reopen: %v", n, err)
+	}
+
+	verifyRotatedPages(t, fmt.Sprintf("write %d", n), e, pages)
+
+	// The reopened file takes writes again.
+	page := e.AllocateEmptyPageWithFreeID()
+	if err := e.WritePage(page); err != nil {
+		t.Fatalf("Write %d: %v", n, err)
+	}
+
+	if err := e.Sync(); err != nil {
+		t.Fatalf("Write %d: %v", n, err)
+	}
+
+	return true
+}
+
+func verifyRotatedPages(t *testing.T, context string, e *io.Engine, pages []*io.Page) {
+	t.Helper()
+
+	for _, page := range pages {
+		stored, err := e.ReadPage(page.GetID())
+		if err != nil {
+			t.Fatalf("%s: failed to read page %d: %v", context, page.GetID(), err)
+		}
+
+		if !bytes.Equal(stored.Data, page.Data) {
+			t.Fatalf("%s: page %d changed", context, page.GetID())
+		}
+	}
+}
+
+// A rotation that fails after the switch leaves the engine readable, and
+// reopening the file finishes the rotation.
+func TestRotateKeyFailure(t *testing.T) {
+	storage, err := faultstorage.New(io.NewMemoryStorage(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := io.EngineOptions{PageSize: io.MetadataPageSize, EncryptionKey: testKey(1)}
+	e, err := io.NewEngineWithStorage(storage, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages := make([]*io.Page, 5)
+	for i := range pages {
+		pages[i] = e.AllocateEmptyPageWithFreeID()
+		copy(pages[i].Data, bytes.Repeat([]byte{byte(i + 1)}, 64))
+
+		if err := e.WritePage(pages[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := e.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The metadata of the first commit and the copies of the five pages are
+	// written, then the other slot is cleared and the first page copied back.
+	storage.Schedule(1+len(pages)+1+1+1, faultstorage.FailWrite)
+	if err := e.RotateKey(testKey(2)); !errors.Is(err, io.ErrWritePage) {
+		t.Fatalf("Expected ErrWritePage, got %v", err)
+	}
+
+	verifyRotatedPages(t, "after the failure", e, pages)
+
+	if err := e.WritePage(pages[0]); !errors.Is(err, io.ErrRotationPending) {
+		t.Fatalf("Expected ErrRotationPending, got %v", err)
+	}
+
+	options.EncryptionKey = testKey(2)
+	if e, err = io.NewEngineWithStorage(storage, options); err != nil {
+		t.Fatal(err)
+	}
+
+	verifyRotatedPages(t, "after reopening", e, pages)
+
+	if err := e.WritePage(pages[0]); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,42 @@
+package io
+
+import "sync/atomic"
+
+// EngineStats reports the activity of an engine since it was opened.
+type EngineStats struct {
+	PageReads  uint64
+	PageWrites uint64
+	// Number of pages handed out, including reused released pages.
+	Allocations uint64
+
+	// Number of released pages, including the pages reused after the next commit.
+	FreePages int
+	FileSize  int64
+}
+
+type engineCounters struct {
+	pageReads   atomic.Uint64
+	pageWrites  atomic.Uint64
+	allocations atomic.Uint64
+}
+
+func (e *Engine) Stats() (EngineStats, error) {
+	stats := EngineStats{
+		PageReads:   e.counters.pageReads.Load(),
+		PageWrites:  e.counters.pageWrites.Load(),
+		Allocations: e.counters.allocations.Load(),
+		FreePages:   len(e.ReleasedPages) + len(e.pending),
+	}
+
+	if e.storage == nil {
+		return stats, ErrNilFile
+	}
+
+	size, err := e.storage.Size()
+	if err != nil {
+		return stats, err
+	}
+
+	stats.FileSize = size
+	return stats, nil
+}
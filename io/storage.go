@@ -0,0 +1,139 @@
+package io
+
+import (
+	stdio "io"
+	"os"
+	"sync"
+)
+
+// Storage holds the pages of an engine. The metadata page is at offset 0 and
+// every page is PageSize bytes, just like in a DB file.
+type Storage interface {
+	stdio.ReaderAt
+	stdio.WriterAt
+	// Cuts off the pages written after the last commit when the engine opens.
+	Truncate(size int64) error
+	Sync() error
+	// Returns the number of bytes stored.
+	Size() (int64, error)
+}
+
+type fileStorage struct {
+	*os.File
+}
+
+func (f fileStorage) Size() (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+// SectionStorage keeps the pages in a file from an offset on, for example
+// behind the header of a container format. The bytes before the offset are
+// never read or written.
+type SectionStorage struct {
+	file   *os.File
+	offset int64
+}
+
+func NewSectionStorage(file *os.File, offset int64) *SectionStorage {
+	return &SectionStorage{file: file, offset: offset}
+}
+
+func (s *SectionStorage) ReadAt(p []byte, off int64) (int, error) {
+	return s.file.ReadAt(p, s.offset+off)
+}
+
+func (s *SectionStorage) WriteAt(p []byte, off int64) (int, error) {
+	return s.file.WriteAt(p, s.offset+off)
+}
+
+func (s *SectionStorage) Truncate(size int64) error {
+	return s.file.Truncate(s.offset + size)
+}
+
+func (s *SectionStorage) Sync() error {
+	return s.file.Sync()
+}
+
+func (s *SectionStorage) Size() (int64, error) {
+	info, err := s.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return max(info.Size()-s.offset, 0), nil
+}
+
+// MemoryStorage keeps the pages in a byte slice.
+type MemoryStorage struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+// Creates a storage holding data, which can be the bytes of a DB file. Empty data creates a new DB.
+func NewMemoryStorage(data []byte) *MemoryStorage {
+	return &MemoryStorage{data: data}
+}
+
+func (m *MemoryStorage) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if off >= int64(len(m.data)) {
+		return 0, stdio.EOF
+	}
+
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, stdio.EOF
+	}
+
+	return n, nil
+}
+
+func (m *MemoryStorage) WriteAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if end := off + int64(len(p)); end > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, end-int64(len(m.data)))...)
+	}
+
+	return copy(m.data[off:], p), nil
+}
+
+func (m *MemoryStorage) Truncate(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if size < int64(len(m.data)) {
+		m.data = m.data[:size]
+	} else {
+		m.data = append(m.data, make([]byte, size-int64(len(m.data)))...)
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) Sync() error {
+	return nil
+}
+
+func (m *MemoryStorage) Size() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return int64(len(m.data)), nil
+}
+
+// Returns a copy of the stored bytes, which can be written to a DB file.
+func (m *MemoryStorage) Bytes() []byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]byte(nil), m.data...)
+}
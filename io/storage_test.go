@@ -0,0 +1,145 @@
+package io_test
+
+import (
+	"bytes"
+	stdio "io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/io"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	options := io.EngineOptions{PageSize: io.MetadataPageSize}
+
+	storage := io.NewMemoryStorage(nil)
+	e, err := io.NewEngineWithStorage(storage, options)
+	if err != nil {
+		t.Fatalf("Failed to open the engine: %v", err)
+	}
+
+	page := e.AllocateEmptyPageWithFreeID()
+	copy(page.Data, "in memory")
+	if err := e.WritePage(page); err != nil {
+		t.Fatalf("Failed to write page: %v", err)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatalf("Failed to close the engine: %v", err)
+	}
+
+	// The bytes are a DB file.
+	file := filepath.Join(t.TempDir(), "test.mellow")
+	if err := os.WriteFile(file, storage.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	options.FileName = file
+	e, err = io.NewEngine(options)
+	if err != nil {
+		t.Fatalf("Failed to open the file: %v", err)
+	}
+	defer e.Close()
+
+	read, err := e.ReadPage(page.GetID())
+	if err != nil {
+		t.Fatalf("Failed to read page: %v", err)
+	}
+
+	if !bytes.Equal(read.Data, page.Data) {
+		t.Fatalf("The read data is different from the written data.")
+	}
+}
+
+func TestSectionStorage(t *testing.T) {
+	header := []byte("container header")
+
+	file, err := os.Create(filepath.Join(t.TempDir(), "container"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(header); err != nil {
+		t.Fatal(err)
+	}
+
+	options := io.EngineOptions{PageSize: io.MetadataPageSize}
+	storage := io.NewSectionStorage(file, int64(len(header)))
+
+	e, err := io.NewEngineWithStorage(storage, options)
+	if err != nil {
+		t.Fatalf("Failed to open the engine: %v", err)
+	}
+
+	e.Metadata.MaxPageID = 3
+	if err := e.Close(); err != nil {
+		t.Fatalf("Failed to close the engine: %v", err)
+	}
+
+	e, err = io.NewEngineWithStorage(storage, options)
+	if err != nil {
+		t.Fatalf("Failed to reopen the engine: %v", err)
+	}
+	defer e.Close()
+
+	if e.MaxPageID != 3 {
+		t.Fatalf("Expected MaxPageID 3, got %d", e.MaxPageID)
+	}
+
+	read := make([]byte, len(header))
+	if _, err := file.ReadAt(read, 0); err != nil && err != stdio.EOF {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(read, header) {
+		t.Fatalf("The header was overwritten: %q", read)
+	}
+}
+
+func TestOpenTruncatesUncommittedPages(t *testing.T) {
+	options := io.EngineOptions{PageSize: io.MetadataPageSize}
+
+	storage := io.NewMemoryStorage(nil)
+	e, err := io.NewEngineWithStorage(storage, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page := e.AllocateEmptyPageWithFreeID()
+	if err := e.WritePage(page); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	committed, _ := storage.Size()
+
+	// Pages written after the last commit, before a crash.
+	if _, err := storage.WriteAt(make([]byte, 3*io.MetadataPageSize), committed); err != nil {
+		t.Fatal(err)
+	}
+
+	options.ReadOnly = true
+	if e, err = io.NewEngineWithStorage(storage, options); err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+
+	if size, _ := storage.Size(); size != committed+3*io.MetadataPageSize {
+		t.Fatalf("Expected a read-only engine to leave the storage, got %d bytes", size)
+	}
+
+	options.ReadOnly = false
+	if e, err = io.NewEngineWithStorage(storage, options); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	if size, _ := storage.Size(); size != committed {
+		t.Fatalf("Expected %d bytes after opening, got %d", committed, size)
+	}
+}
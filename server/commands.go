@@ -0,0 +1,373 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rettenwander/mellowdb/db"
+)
+
+// Number of keys SCAN returns if COUNT isn't given.
+const defaultScanCount = 10
+
+type command func(s *Server, args [][]byte, w writer)
+
+var commands = map[string]command{
+	"PING":   ping,
+	"GET":    get,
+	"SET":    set,
+	"DEL":    del,
+	"EXISTS": exists,
+	"MGET":   mget,
+	"MSET":   mset,
+	"SCAN":   scan,
+}
+
+// Smallest number of arguments of each command, including its name.
+var minArgs = map[string]int{
+	"PING":   1,
+	"GET":    2,
+	"SET":    3,
+	"DEL":    2,
+	"EXISTS": 2,
+	"MGET":   2,
+	"MSET":   3,
+	"SCAN":   2,
+}
+
+func (s *Server) execute(args [][]byte, w writer) {
+	name := strings.ToUpper(string(args[0]))
+
+	cmd, ok := commands[name]
+	if !ok {
+		w.error("ERR unknown command '" + string(args[0]) + "'")
+		return
+	}
+
+	if len(args) < minArgs[name] {
+		w.error("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+		return
+	}
+
+	cmd(s, args, w)
+}
+
+func writeDBError(w writer, err error) {
+	if errors.Is(err, db.ErrReadOnly) {
+		w.error("READONLY " + err.Error())
+		return
+	}
+
+	w.error("ERR " + err.Error())
+}
+
+func ping(s *Server, args [][]byte, w writer) {
+	switch len(args) {
+	case 1:
+		w.simple("PONG")
+	case 2:
+		w.bulk(args[1])
+	default:
+		w.error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func (s *Server) find(key []byte) ([]byte, bool, error) {
+	tree, err := s.collection(false)
+	if err != nil || tree == nil {
+		return nil, false, err
+	}
+
+	item, err := tree.Find(key)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	return item.Value(), true, nil
+}
+
+func get(s *Server, args [][]byte, w writer) {
+	if len(args) != 2 {
+		w.error("ERR wrong number of arguments for 'get' command")
+		return
+	}
+
+	value, ok, err := s.find(args[1])
+	if err != nil {
+		writeDBError(w, err)
+	} else if !ok {
+		w.null()
+	} else {
+		w.bulk(value)
+	}
+}
+
+// SET key value [EX seconds | PX milliseconds]
+func set(s *Server, args [][]byte, w writer) {
+	var ttl time.Duration
+
+	options := args[3:]
+	for len(options) > 0 {
+		option := strings.ToUpper(string(options[0]))
+		if (option != "EX" && option != "PX") || len(options) < 2 || ttl != 0 {
+			w.error("ERR syntax error")
+			return
+		}
+
+		n, err := strconv.ParseInt(string(options[1]), 10, 64)
+		if err != nil || n <= 0 {
+			w.error("ERR invalid expire time in 'set' command")
+			return
+		}
+
+		if option == "EX" {
+			ttl = time.Duration(n) * time.Second
+		} else {
+			ttl = time.Duration(n) * time.Millisecond
+		}
+
+		options = options[2:]
+	}
+
+	var item *db.Item
+	var err error
+	if ttl > 0 {
+		item, err = db.NewItemWithExpiry(args[1], args[2], time.Now().Add(ttl))
+	} else {
+		item, err = db.NewItem(args[1], args[2])
+	}
+
+	var tree *db.BTree
+	if err == nil {
+		tree, err = s.collection(true)
+	}
+
+	if err == nil {
+		err = tree.Insert(item)
+	}
+
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	w.simple("OK")
+}
+
+func del(s *Server, args [][]byte, w writer) {
+	tree, err := s.collection(false)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	if tree == nil {
+		w.integer(0)
+		return
+	}
+
+	deleted := 0
+	for _, key := range args[1:] {
+		existed, err := tree.Remove(key)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+
+		if existed {
+			deleted++
+		}
+	}
+
+	w.integer(deleted)
+}
+
+func exists(s *Server, args [][]byte, w writer) {
+	count := 0
+	for _, key := range args[1:] {
+		_, ok, err := s.find(key)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+
+		if ok {
+			count++
+		}
+	}
+
+	w.integer(count)
+}
+
+func mget(s *Server, args [][]byte, w writer) {
+	values := make([][]byte, len(args)-1)
+	found := make([]bool, len(args)-1)
+
+	for i, key := range args[1:] {
+		var err error
+		values[i], found[i], err = s.find(key)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+	}
+
+	w.array(len(values))
+	for i, value := range values {
+		if found[i] {
+			w.bulk(value)
+		} else {
+			w.null()
+		}
+	}
+}
+
+// MSET key value [key value ...]
+//
+// All pairs are checked before the first one is written. The writes aren't
+// atomic: if one fails, the pairs before it stay written and the error is returned.
+func mset(s *Server, args [][]byte, w writer) {
+	if len(args)%2 != 1 {
+		w.error("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+
+	items := make([]*db.Item, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		item, err := db.NewItem(args[i], args[i+1])
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+
+		items = append(items, item)
+	}
+
+	tree, err := s.collection(true)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	for _, item := range items {
+		if err := tree.Insert(item); err != nil {
+			writeDBError(w, err)
+			return
+		}
+	}
+
+	w.simple("OK")
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count]
+//
+// The cursor is the first key of the next page, hex encoded, or 0 at the start
+// and the end. Keys written or deleted between the calls don't shift the pages.
+// Only patterns that match a prefix, like "user:*", or a single key are supported.
+func scan(s *Server, args [][]byte, w writer) {
+	var cursor []byte
+	if string(args[1]) != "0" {
+		var err error
+		if cursor, err = hex.DecodeString(string(args[1])); err != nil || len(cursor) == 0 {
+			w.error("ERR invalid cursor")
+			return
+		}
+	}
+
+	var prefix []byte
+	exact := false
+	count := defaultScanCount
+
+	options := args[2:]
+	for len(options) > 0 {
+		if len(options) < 2 {
+			w.error("ERR syntax error")
+			return
+		}
+
+		switch strings.ToUpper(string(options[0])) {
+		case "MATCH":
+			var ok bool
+			prefix, exact, ok = parsePattern(options[1])
+			if !ok {
+				w.error("ERR only prefix patterns like 'prefix*' are supported")
+				return
+			}
+		case "COUNT":
+			var err error
+			count, err = strconv.Atoi(string(options[1]))
+			if err != nil || count < 1 {
+				w.error("ERR syntax error")
+				return
+			}
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+
+		options = options[2:]
+	}
+
+	start := prefix
+	if bytes.Compare(cursor, start) > 0 {
+		start = cursor
+	}
+
+	keys := [][]byte{}
+	next := []byte("0")
+
+	tree, err := s.collection(false)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	if tree != nil {
+		err = tree.Scan(start, db.PrefixEnd(prefix), func(i *db.Item) bool {
+			if exact && !bytes.Equal(i.Key(), prefix) {
+				return false
+			}
+
+			if len(keys) == count {
+				next = []byte(hex.EncodeToString(i.Key()))
+				return false
+			}
+
+			keys = append(keys, append([]byte(nil), i.Key()...))
+			return true
+		})
+	}
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	w.array(2)
+	w.bulk(next)
+	w.array(len(keys))
+	for _, key := range keys {
+		w.bulk(key)
+	}
+}
+
+// Returns the prefix of a pattern like "prefix*". Exact is true for patterns
+// without wildcards, which match a single key.
+func parsePattern(pattern []byte) (prefix []byte, exact bool, ok bool) {
+	exact = true
+	if bytes.HasSuffix(pattern, []byte("*")) {
+		pattern = pattern[:len(pattern)-1]
+		exact = false
+	}
+
+	if bytes.ContainsAny(pattern, `*?[\`) {
+		return nil, false, false
+	}
+
+	return pattern, exact, true
+}
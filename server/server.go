@@ -0,0 +1,224 @@
+// Package server serves the default collection of a DB over TCP with the
+// Redis protocol (RESP2).
+//
+// Writes are durable once the DB is synced, like all writes to a DB.
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rettenwander/mellowdb/db"
+)
+
+var ErrServerClosed = errors.New("Server closed")
+
+type Server struct {
+	db *db.DB
+
+	mu sync.Mutex
+	// The default collection, nil until it exists, see collection.
+	tree      *db.BTree
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closing   bool
+	wg        sync.WaitGroup
+}
+
+// Serves the default collection of d. It's created by the first write, so a
+// read-only DB without it is served as empty.
+func New(d *db.DB) (*Server, error) {
+	s := &Server{
+		db:        d,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+
+	if _, err := s.collection(false); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Returns the default collection. A missing one is created if create is set,
+// otherwise nil is returned.
+func (s *Server) collection(create bool) (*db.BTree, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tree != nil {
+		return s.tree, nil
+	}
+
+	tree, err := s.db.FindCollection(db.DefaultCollection)
+	if errors.Is(err, db.ErrCollectionNotFound) {
+		if !create {
+			return nil, nil
+		}
+
+		tree, err = s.db.Collection(db.DefaultCollection)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.tree = tree
+	return tree, nil
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Accepts connections on l until Shutdown is called, then returns ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+
+			if closing {
+				return ErrServerClosed
+			}
+
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+
+			return err
+		}
+
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return false
+	}
+
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+// Stops accepting connections and lets every client finish the command it's
+// running. Connections still open when ctx is done are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	for l := range s.listeners {
+		l.Close()
+	}
+
+	// Wake up clients waiting for their next command.
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+
+		conn.Close()
+		s.wg.Done()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := writer{bufio.NewWriter(conn)}
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if errors.Is(err, ErrProtocol) {
+				w.error("ERR " + err.Error())
+				w.Flush()
+			}
+
+			return
+		}
+
+		if len(args) == 0 {
+			continue
+		}
+
+		s.execute(args, w)
+
+		// Pipelined commands are answered together.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+
+		s.mu.Lock()
+		closing := s.closing
+		s.mu.Unlock()
+
+		if closing {
+			w.Flush()
+			return
+		}
+	}
+}
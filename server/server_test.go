@@ -0,0 +1,323 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rettenwander/mellowdb/db"
+	"github.com/rettenwander/mellowdb/server"
+)
+
+// A minimal RESP2 client.
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *client {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &client{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *client) send(args ...string) error {
+	msg := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		msg += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	_, err := c.conn.Write([]byte(msg))
+	return err
+}
+
+// Returns strings for simple and bulk strings, int for integers, error for
+// errors, nil for null and []any for arrays.
+func (c *client) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return errors.New(line[1:]), nil
+	case ':':
+		return strconv.Atoi(line[1:])
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+
+		return string(buf[:n]), nil
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		array := make([]any, n)
+		for i := range array {
+			if array[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+
+		return array, nil
+	}
+
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+func (c *client) do(t *testing.T, args ...string) any {
+	t.Helper()
+
+	if err := c.send(args...); err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := c.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return reply
+}
+
+func startServer(t *testing.T) (*server.Server, string) {
+	dbEngine, err := db.NewDB(filepath.Join(t.TempDir(), "test.mellow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbEngine.Close() })
+
+	return startServerWithDB(t, dbEngine)
+}
+
+func startServerWithDB(t *testing.T, dbEngine *db.DB) (*server.Server, string) {
+	srv, err := server.New(dbEngine)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+
+	return srv, l.Addr().String()
+}
+
+func TestCommands(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	expect := func(want any, args ...string) {
+		t.Helper()
+
+		got := c.do(t, args...)
+		if err, ok := got.(error); ok {
+			if _, wantErr := want.(error); !wantErr {
+				t.Fatalf("%v: unexpected error %v", args, err)
+			}
+			return
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%v: expected %#v, got %#v", args, want, got)
+		}
+	}
+
+	anyError := errors.New("any error")
+
+	expect("PONG", "PING")
+	expect("hello", "ping", "hello")
+	expect(nil, "GET", "missing")
+	expect("OK", "SET", "a", "1")
+	expect("1", "GET", "a")
+	expect("OK", "MSET", "b", "2", "c", "3")
+	expect([]any{"1", nil, "3"}, "MGET", "a", "missing", "c")
+	expect(2, "EXISTS", "a", "b", "missing")
+	expect(1, "DEL", "b", "missing")
+	expect(0, "EXISTS", "b")
+	expect("OK", "SET", "ttl", "x", "PX", "20")
+	expect(anyError, "SET", "a", "1", "NX")
+	expect(anyError, "GET")
+	expect(anyError, "MSET", "a")
+	expect(anyError, "FLUSHALL")
+
+	// Polls until the key expires.
+	deadline := time.Now().Add(5 * time.Second)
+	for c.do(t, "GET", "ttl") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the key to expire")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	expect(0, "DEL", "ttl")
+
+	// Pipelined commands.
+	for i := range 25 {
+		c.send("SET", fmt.Sprintf("user:%02d", i), "v")
+	}
+	for range 25 {
+		if reply, err := c.read(); err != nil || reply != "OK" {
+			t.Fatalf("Expected OK, got %v, %v", reply, err)
+		}
+	}
+
+	keys := []any{}
+	cursor := "0"
+	for {
+		reply := c.do(t, "SCAN", cursor, "MATCH", "user:*", "COUNT", "7").([]any)
+		keys = append(keys, reply[1].([]any)...)
+
+		cursor = reply[0].(string)
+		if cursor == "0" {
+			break
+		}
+	}
+
+	if len(keys) != 25 || keys[0] != "user:00" || keys[24] != "user:24" {
+		t.Fatalf("Unexpected scan result %v", keys)
+	}
+
+	// Deleting returned keys doesn't make the next page skip any.
+	reply := c.do(t, "SCAN", "0", "MATCH", "user:*", "COUNT", "7").([]any)
+	for _, key := range reply[1].([]any) {
+		expect(1, "DEL", key.(string))
+	}
+
+	reply = c.do(t, "SCAN", reply[0].(string), "MATCH", "user:*", "COUNT", "1").([]any)
+	if keys := reply[1].([]any); len(keys) != 1 || keys[0] != "user:07" {
+		t.Fatalf("Expected user:07 after the deletes, got %v", keys)
+	}
+
+	expect([]any{"0", []any{"a"}}, "SCAN", "0", "MATCH", "a")
+	expect(anyError, "SCAN", "0", "MATCH", "u*r")
+	expect(anyError, "SCAN", "not-hex")
+
+	// Inline commands.
+	if _, err := c.conn.Write([]byte("PING\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if reply, _ := c.read(); reply != "PONG" {
+		t.Fatalf("Expected PONG, got %v", reply)
+	}
+}
+
+func TestReadOnlyDB(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mellow")
+
+	dbEngine, err := db.NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dbEngine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file has no default collection, and the server doesn't create one.
+	dbEngine, err = db.NewDBWithOptions(file, db.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	_, addr := startServerWithDB(t, dbEngine)
+	c := dial(t, addr)
+
+	if reply := c.do(t, "GET", "a"); reply != nil {
+		t.Fatalf("Expected nil, got %#v", reply)
+	}
+
+	if reply := c.do(t, "DEL", "a"); reply != 0 {
+		t.Fatalf("Expected 0, got %#v", reply)
+	}
+
+	if reply := c.do(t, "SCAN", "0"); !reflect.DeepEqual(reply, []any{"0", []any{}}) {
+		t.Fatalf("Expected an empty scan, got %#v", reply)
+	}
+
+	reply, ok := c.do(t, "SET", "a", "1").(error)
+	if !ok || !strings.HasPrefix(reply.Error(), "READONLY") {
+		t.Fatalf("Expected a READONLY error, got %#v", reply)
+	}
+}
+
+func TestManyClients(t *testing.T) {
+	_, addr := startServer(t)
+
+	var wg sync.WaitGroup
+	for n := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			c := dial(t, addr)
+			for i := range 50 {
+				key := fmt.Sprintf("%d:%d", n, i)
+				if err := c.send("SET", key, key); err != nil {
+					t.Error(err)
+					return
+				}
+				if reply, err := c.read(); err != nil || reply != "OK" {
+					t.Errorf("Expected OK, got %v, %v", reply, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	c := dial(t, addr)
+	reply := c.do(t, "SCAN", "0", "COUNT", "5000").([]any)
+	if keys := reply[1].([]any); len(keys) != 1000 {
+		t.Fatalf("Expected 1000 keys, got %d", len(keys))
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	srv, addr := startServer(t)
+
+	idle := dial(t, addr)
+	idle.do(t, "PING")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Expected a graceful shutdown, got %v", err)
+	}
+
+	if _, err := idle.read(); err == nil {
+		t.Fatal("Expected the idle connection to be closed")
+	}
+
+	if conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond); err == nil {
+		conn.Close()
+		t.Fatal("Expected the listener to be closed")
+	}
+}
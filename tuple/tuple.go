@@ -0,0 +1,336 @@
+// Package tuple encodes tuples of strings, byte slices, integers, floats,
+// booleans, nils and nested tuples into keys. bytes.Compare on two encoded
+// tuples agrees with the order of the tuples, so composite keys can be used
+// for range and prefix scans of a B-tree.
+//
+// Tuples are compared element by element, a shorter tuple sorts before the
+// tuples it is a prefix of. Elements of different types are ordered by type:
+// nil, byte slices, strings, tuples, integers, float32s, float64s and
+// booleans. Integers of all sizes, signed or not, are compared by value.
+// Unlike integers, float32 and float64 are different types, so every float32
+// sorts before every float64; convert floats to one of them to compare them
+// by value. Floats of the same type are ordered by value with -0 before 0.
+// NaNs sort after +Inf, or before -Inf if their sign bit is set.
+package tuple
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	ErrUnsupportedType = errors.New("Type can't be stored in a tuple")
+	ErrInvalidTuple    = errors.New("Invalid encoded tuple")
+)
+
+// The first byte of every encoded element.
+const (
+	codeNil    = 0x00
+	codeBytes  = 0x01
+	codeString = 0x02
+	codeTuple  = 0x05
+	// Integers are stored with the fewest bytes. The code is codeInt plus the
+	// number of bytes for positive and minus the number of bytes for negative integers.
+	codeInt     = 0x14
+	codeFloat32 = 0x20
+	codeFloat64 = 0x21
+	codeFalse   = 0x26
+	codeTrue    = 0x27
+
+	// Follows a zero byte inside byte slices, strings and nested tuples.
+	escape = 0xff
+)
+
+// Tuple is a list of elements. Elements can be nil, []byte, string, Tuple,
+// signed and unsigned integers, float32, float64 and bool.
+type Tuple []any
+
+// Encodes the tuple.
+func (t Tuple) Pack() ([]byte, error) {
+	return t.AppendPack(nil)
+}
+
+// Appends the encoded tuple to buf.
+func (t Tuple) AppendPack(buf []byte) ([]byte, error) {
+	var err error
+	for _, element := range t {
+		if buf, err = appendElement(buf, element, false); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf, nil
+}
+
+// Returns the range of keys of all tuples that start with the elements of t
+// and have more elements. Start is inclusive and end exclusive, like the
+// bounds of a B-tree scan.
+func (t Tuple) Range() (start []byte, end []byte, err error) {
+	prefix, err := t.Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	start = append(prefix[:len(prefix):len(prefix)], 0x00)
+	end = append(prefix[:len(prefix):len(prefix)], 0xff)
+	return start, end, nil
+}
+
+func appendElement(buf []byte, element any, nested bool) ([]byte, error) {
+	switch v := element.(type) {
+	case nil:
+		if nested {
+			return append(buf, codeNil, escape), nil
+		}
+		return append(buf, codeNil), nil
+	case []byte:
+		return appendEscaped(append(buf, codeBytes), v), nil
+	case string:
+		return appendEscaped(append(buf, codeString), []byte(v)), nil
+	case Tuple:
+		buf = append(buf, codeTuple)
+		for _, e := range v {
+			var err error
+			if buf, err = appendElement(buf, e, true); err != nil {
+				return nil, err
+			}
+		}
+		return append(buf, 0x00), nil
+	case int:
+		return appendInt(buf, int64(v)), nil
+	case int8:
+		return appendInt(buf, int64(v)), nil
+	case int16:
+		return appendInt(buf, int64(v)), nil
+	case int32:
+		return appendInt(buf, int64(v)), nil
+	case int64:
+		return appendInt(buf, v), nil
+	case uint:
+		return appendUint(buf, uint64(v)), nil
+	case uint8:
+		return appendUint(buf, uint64(v)), nil
+	case uint16:
+		return appendUint(buf, uint64(v)), nil
+	case uint32:
+		return appendUint(buf, uint64(v)), nil
+	case uint64:
+		return appendUint(buf, v), nil
+	case float32:
+		bits := math.Float32bits(v)
+		if bits&(1<<31) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 31
+		}
+		return binary.BigEndian.AppendUint32(append(buf, codeFloat32), bits), nil
+	case float64:
+		bits := math.Float64bits(v)
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		return binary.BigEndian.AppendUint64(append(buf, codeFloat64), bits), nil
+	case bool:
+		if v {
+			return append(buf, codeTrue), nil
+		}
+		return append(buf, codeFalse), nil
+	}
+
+	return nil, fmt.Errorf("%w: %T", ErrUnsupportedType, element)
+}
+
+// Zero bytes are escaped, the element ends with an unescaped zero byte.
+func appendEscaped(buf []byte, data []byte) []byte {
+	for _, b := range data {
+		buf = append(buf, b)
+		if b == 0x00 {
+			buf = append(buf, escape)
+		}
+	}
+
+	return append(buf, 0x00)
+}
+
+func appendInt(buf []byte, v int64) []byte {
+	if v >= 0 {
+		return appendUint(buf, uint64(v))
+	}
+
+	// Negative integers store the ones' complement of their absolute value,
+	// so a larger absolute value sorts first.
+	abs := uint64(-(v + 1)) + 1
+	n := byteLen(abs)
+
+	var raw [8]byte
+	binary.BigEndian.PutUint64(raw[:], ^abs)
+	return append(append(buf, byte(codeInt-n)), raw[8-n:]...)
+}
+
+func appendUint(buf []byte, v uint64) []byte {
+	n := byteLen(v)
+
+	var raw [8]byte
+	binary.BigEndian.PutUint64(raw[:], v)
+	return append(append(buf, byte(codeInt+n)), raw[8-n:]...)
+}
+
+func byteLen(v uint64) int {
+	n := 0
+	for ; v > 0; v >>= 8 {
+		n++
+	}
+
+	return n
+}
+
+// Decodes a tuple encoded by Pack. Integers are returned as int64, or as
+// uint64 if they don't fit.
+func Unpack(data []byte) (Tuple, error) {
+	t := Tuple{}
+	for len(data) > 0 {
+		element, rest, err := decodeElement(data, false)
+		if err != nil {
+			return nil, err
+		}
+
+		t = append(t, element)
+		data = rest
+	}
+
+	return t, nil
+}
+
+func decodeElement(data []byte, nested bool) (any, []byte, error) {
+	code := data[0]
+	data = data[1:]
+
+	switch {
+	case code == codeNil:
+		if nested {
+			if len(data) == 0 || data[0] != escape {
+				return nil, nil, fmt.Errorf("%w: unescaped nil in nested tuple", ErrInvalidTuple)
+			}
+			data = data[1:]
+		}
+		return nil, data, nil
+	case code == codeBytes:
+		v, rest, err := decodeEscaped(data)
+		return v, rest, err
+	case code == codeString:
+		v, rest, err := decodeEscaped(data)
+		return string(v), rest, err
+	case code == codeTuple:
+		t := Tuple{}
+		for {
+			if len(data) == 0 {
+				return nil, nil, fmt.Errorf("%w: unterminated nested tuple", ErrInvalidTuple)
+			}
+
+			// A zero byte not followed by the escape ends the tuple.
+			if data[0] == 0x00 && (len(data) == 1 || data[1] != escape) {
+				return t, data[1:], nil
+			}
+
+			element, rest, err := decodeElement(data, true)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			t = append(t, element)
+			data = rest
+		}
+	case code >= codeInt-8 && code <= codeInt+8:
+		return decodeInt(code, data)
+	case code == codeFloat32:
+		if len(data) < 4 {
+			return nil, nil, fmt.Errorf("%w: truncated float32", ErrInvalidTuple)
+		}
+
+		bits := binary.BigEndian.Uint32(data)
+		if bits&(1<<31) != 0 {
+			bits &^= 1 << 31
+		} else {
+			bits = ^bits
+		}
+		return math.Float32frombits(bits), data[4:], nil
+	case code == codeFloat64:
+		if len(data) < 8 {
+			return nil, nil, fmt.Errorf("%w: truncated float64", ErrInvalidTuple)
+		}
+
+		bits := binary.BigEndian.Uint64(data)
+		if bits&(1<<63) != 0 {
+			bits &^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return math.Float64frombits(bits), data[8:], nil
+	case code == codeFalse:
+		return false, data, nil
+	case code == codeTrue:
+		return true, data, nil
+	}
+
+	return nil, nil, fmt.Errorf("%w: unknown type code 0x%02x", ErrInvalidTuple, code)
+}
+
+func decodeEscaped(data []byte) ([]byte, []byte, error) {
+	v := []byte{}
+	for i := 0; i < len(data); i++ {
+		if data[i] != 0x00 {
+			v = append(v, data[i])
+			continue
+		}
+
+		if i+1 < len(data) && data[i+1] == escape {
+			v = append(v, 0x00)
+			i++
+			continue
+		}
+
+		return v, data[i+1:], nil
+	}
+
+	return nil, nil, fmt.Errorf("%w: unterminated byte string", ErrInvalidTuple)
+}
+
+func decodeInt(code byte, data []byte) (any, []byte, error) {
+	n := int(code) - codeInt
+	negative := n < 0
+	if negative {
+		n = -n
+	}
+
+	if len(data) < n {
+		return nil, nil, fmt.Errorf("%w: truncated integer", ErrInvalidTuple)
+	}
+
+	var raw [8]byte
+	copy(raw[8-n:], data[:n])
+	v := binary.BigEndian.Uint64(raw[:])
+	data = data[n:]
+
+	if !negative {
+		if v > math.MaxInt64 {
+			return v, data, nil
+		}
+		return int64(v), data, nil
+	}
+
+	// Undo the ones' complement on the stored bytes only.
+	abs := ^v
+	if n < 8 {
+		abs &= 1<<(8*n) - 1
+	}
+
+	if abs > 1<<63 {
+		return nil, nil, fmt.Errorf("%w: integer out of range", ErrInvalidTuple)
+	}
+
+	return -int64(abs-1) - 1, data, nil
+}
@@ -0,0 +1,193 @@
+package tuple_test
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rettenwander/mellowdb/db"
+	"github.com/rettenwander/mellowdb/tuple"
+)
+
+// Each list is in ascending tuple order.
+var ordered = []tuple.Tuple{
+	{},
+	{nil},
+	{nil, nil},
+	{[]byte{}},
+	{[]byte{0x00}},
+	{[]byte{0x00, 0x00}},
+	{[]byte{0x00, 0x01}},
+	{[]byte{0x01}},
+	{[]byte{0xff}},
+	{""},
+	{"\x00"},
+	{"a"},
+	{"a", nil},
+	{"a", "b"},
+	{"a\x00"},
+	{"ab"},
+	{tuple.Tuple{}},
+	{tuple.Tuple{nil}},
+	{tuple.Tuple{nil, "a"}},
+	{tuple.Tuple{"a"}},
+	{tuple.Tuple{"a", tuple.Tuple{}}},
+	{tuple.Tuple{"b"}},
+	{int64(math.MinInt64)},
+	{int64(math.MinInt64 + 1)},
+	{-65536},
+	{-65535},
+	{-256},
+	{-255},
+	{-2},
+	{-1},
+	{0},
+	{0, "x"},
+	{1},
+	{255},
+	{256},
+	{int64(math.MaxInt64)},
+	{uint64(math.MaxInt64) + 1},
+	{uint64(math.MaxUint64)},
+	{float32(math.Inf(-1))},
+	{float32(-1)},
+	{float32(math.Copysign(0, -1))},
+	{float32(0)},
+	{float32(0.5)},
+	{float32(math.Inf(1))},
+	// Every float32 sorts before every float64.
+	{math.Inf(-1)},
+	{-1e300},
+	{-math.SmallestNonzeroFloat64},
+	{math.Copysign(0, -1)},
+	{0.0},
+	{math.SmallestNonzeroFloat64},
+	{1.5},
+	{math.Inf(1)},
+	{false},
+	{true},
+	{true, nil},
+}
+
+func TestOrder(t *testing.T) {
+	packed := make([][]byte, len(ordered))
+	for i, tup := range ordered {
+		var err error
+		if packed[i], err = tup.Pack(); err != nil {
+			t.Fatalf("Failed to pack %v: %v", tup, err)
+		}
+	}
+
+	for i := range packed {
+		for j := i + 1; j < len(packed); j++ {
+			if bytes.Compare(packed[i], packed[j]) >= 0 {
+				t.Fatalf("Expected %v to sort before %v", ordered[i], ordered[j])
+			}
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, tup := range ordered {
+		packed, err := tup.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		unpacked, err := tuple.Unpack(packed)
+		if err != nil {
+			t.Fatalf("Failed to unpack %v: %v", tup, err)
+		}
+
+		if !reflect.DeepEqual(unpacked, normalize(tup)) {
+			t.Fatalf("Expected %#v, got %#v", normalize(tup), unpacked)
+		}
+	}
+}
+
+// Converts integers to the types Unpack returns.
+func normalize(t tuple.Tuple) tuple.Tuple {
+	n := tuple.Tuple{}
+	for _, element := range t {
+		switch v := element.(type) {
+		case int:
+			element = int64(v)
+		case tuple.Tuple:
+			element = normalize(v)
+		}
+
+		n = append(n, element)
+	}
+
+	return n
+}
+
+func TestInvalid(t *testing.T) {
+	if _, err := (tuple.Tuple{struct{}{}}).Pack(); !errors.Is(err, tuple.ErrUnsupportedType) {
+		t.Fatalf("Expected ErrUnsupportedType, got %v", err)
+	}
+
+	for _, data := range [][]byte{{0x02, 'a'}, {0x05, 0x02, 0x00}, {0x16, 0x01}, {0x21, 0x00}, {0x99}} {
+		if _, err := tuple.Unpack(data); !errors.Is(err, tuple.ErrInvalidTuple) {
+			t.Fatalf("Expected ErrInvalidTuple for %x, got %v", data, err)
+		}
+	}
+}
+
+func TestRangeScan(t *testing.T) {
+	dbEngine, err := db.NewDB(filepath.Join(t.TempDir(), "test.mellow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbEngine.Close()
+
+	tree, err := dbEngine.Collection("events")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tenant := range []string{"a", "b", "c"} {
+		for ts := -5; ts < 5; ts++ {
+			key, err := tuple.Tuple{tenant, ts, "id"}.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			item, _ := db.NewItem(key, nil)
+			if err := tree.Insert(item); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	start, end, err := tuple.Tuple{"b"}.Range()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timestamps := []int64{}
+	err = tree.Scan(start, end, func(i *db.Item) bool {
+		key, err := tuple.Unpack(i.Key())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if key[0] != "b" {
+			t.Fatalf("Unexpected key %v", key)
+		}
+
+		timestamps = append(timestamps, key[1].(int64))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []int64{-5, -4, -3, -2, -1, 0, 1, 2, 3, 4}
+	if !reflect.DeepEqual(timestamps, want) {
+		t.Fatalf("Expected %v, got %v", want, timestamps)
+	}
+}